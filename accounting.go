@@ -0,0 +1,401 @@
+package windivert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// Dimension is what traffic is aggregated by
+type Dimension uint8
+
+const (
+	// ByProcess aggregates traffic per process
+	ByProcess Dimension = iota
+	// ByHost aggregates traffic per remote address
+	ByHost
+	// ByPort aggregates traffic per protocol and remote port
+	ByPort
+	dimensions
+)
+
+func (d Dimension) String() string {
+	switch d {
+	case ByProcess:
+		return "process"
+	case ByHost:
+		return "host"
+	case ByPort:
+		return "port"
+	default:
+		return ""
+	}
+}
+
+func (d Dimension) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Dimension) UnmarshalText(b []byte) error {
+	for i := Dimension(0); i < dimensions; i++ {
+		if i.String() == string(b) {
+			*d = i
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid dimension %q", b)
+}
+
+const (
+	// AccountSpanDefault is the longest window rates are kept for
+	AccountSpanDefault = time.Hour
+	// AccountResolutionDefault is the granularity of the windows
+	AccountResolutionDefault = 10 * time.Second
+
+	// accountPIDTimeout is how long the process of a connection is cached
+	accountPIDTimeout = time.Minute
+)
+
+// usageKey identifies an aggregate, only the fields of its dimension are
+// set
+type usageKey struct {
+	pid   uint32
+	host  netip.Addr
+	proto uint8
+	port  uint16
+}
+
+// Usage is the traffic of an aggregate
+type Usage struct {
+	Dimension Dimension `json:"dimension"`
+	// PID and Name are set for ByProcess, Name when it is known
+	PID  uint32 `json:"pid,omitempty"`
+	Name string `json:"name,omitempty"`
+	// Host is set for ByHost
+	Host string `json:"host,omitempty"`
+	// Protocol and Port are set for ByPort
+	Protocol string `json:"protocol,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+
+	// Sent and Received are the totals since the aggregate was first seen
+	Sent     Counters `json:"sent"`
+	Received Counters `json:"received"`
+	// WindowSent and WindowReceived are the traffic within the window
+	WindowSent     Counters `json:"windowSent"`
+	WindowReceived Counters `json:"windowReceived"`
+	// Rate is the average rate within the window in bytes per second
+	Rate float64 `json:"rate"`
+}
+
+// Bytes returns the bytes sent and received within the window
+func (u *Usage) Bytes() uint64 {
+	return u.WindowSent.Bytes + u.WindowReceived.Bytes
+}
+
+type usageBucket struct {
+	slot       int64
+	sent, recv Counters
+}
+
+type usageEntry struct {
+	sent, recv Counters
+	ring       []usageBucket
+	last       time.Time
+}
+
+type pidCacheEntry struct {
+	pid    uint32
+	ok     bool
+	expire time.Time
+}
+
+// Accountant aggregates traffic per process, remote host and remote port
+// and keeps rolling windows of it
+type Accountant struct {
+	// Lookup returns the process owning a connection, Src being the local
+	// endpoint. Traffic is not aggregated per process when it is nil. It is
+	// read with the accountant locked, set it before the accountant is
+	// shared or let Device.SetAccountant set it.
+	Lookup func(t FiveTuple) (uint32, bool)
+	// Processes names the processes, it may be nil
+	Processes ProcessResolver
+
+	span       time.Duration
+	resolution time.Duration
+
+	mu     sync.Mutex
+	tables [dimensions]map[usageKey]*usageEntry
+	pids   map[FiveTuple]pidCacheEntry
+	pruned int64
+}
+
+// NewAccountant creates an accountant keeping windows up to span long at
+// the given resolution, zero means the defaults
+func NewAccountant(span, resolution time.Duration) *Accountant {
+	if span <= 0 {
+		span = AccountSpanDefault
+	}
+	if resolution <= 0 {
+		resolution = AccountResolutionDefault
+	}
+	if resolution > span {
+		resolution = span
+	}
+
+	a := &Accountant{
+		span:       span,
+		resolution: resolution,
+		pids:       make(map[FiveTuple]pidCacheEntry),
+	}
+	for i := range a.tables {
+		a.tables[i] = make(map[usageKey]*usageEntry)
+	}
+	return a
+}
+
+// Span returns the longest window
+func (a *Accountant) Span() time.Duration {
+	return a.span
+}
+
+// Record is RecordAt at the current time
+func (a *Accountant) Record(t FiveTuple, outbound bool, size int) {
+	a.RecordAt(t, outbound, size, time.Now())
+}
+
+// RecordAt accounts a packet of size bytes of the connection t, Src being
+// the local endpoint
+func (a *Accountant) RecordAt(t FiveTuple, outbound bool, size int, now time.Time) {
+	pid, hasPID := a.process(t, now)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	slot := now.UnixNano() / int64(a.resolution)
+	if slot != a.pruned {
+		a.prune(now)
+		a.pruned = slot
+	}
+
+	keys := [dimensions]usageKey{
+		ByHost: {host: t.DstAddr.Unmap()},
+		ByPort: {proto: t.Protocol, port: t.DstPort},
+	}
+	for d := Dimension(0); d < dimensions; d++ {
+		if d == ByProcess {
+			if !hasPID {
+				continue
+			}
+			keys[d] = usageKey{pid: pid}
+		}
+		a.add(d, keys[d], slot, outbound, size, now)
+	}
+}
+
+func (a *Accountant) add(d Dimension, k usageKey, slot int64, outbound bool, size int, now time.Time) {
+	e, ok := a.tables[d][k]
+	if !ok {
+		e = &usageEntry{ring: make([]usageBucket, a.slots())}
+		a.tables[d][k] = e
+	}
+
+	b := &e.ring[slot%int64(len(e.ring))]
+	if b.slot != slot {
+		*b = usageBucket{slot: slot}
+	}
+
+	c, bc := &e.recv, &b.recv
+	if outbound {
+		c, bc = &e.sent, &b.sent
+	}
+	c.Packets++
+	c.Bytes += uint64(size)
+	bc.Packets++
+	bc.Bytes += uint64(size)
+	e.last = now
+}
+
+// process returns the process of t, caching the answers of Lookup
+func (a *Accountant) process(t FiveTuple, now time.Time) (uint32, bool) {
+	a.mu.Lock()
+	lookup := a.Lookup
+	c, ok := a.pids[t]
+	a.mu.Unlock()
+	if lookup == nil {
+		return 0, false
+	}
+	if ok && now.Before(c.expire) {
+		return c.pid, c.ok
+	}
+
+	pid, found := lookup(t)
+
+	a.mu.Lock()
+	a.pids[t] = pidCacheEntry{pid: pid, ok: found, expire: now.Add(accountPIDTimeout)}
+	a.mu.Unlock()
+	return pid, found
+}
+
+func (a *Accountant) slots() int {
+	return int((a.span + a.resolution - 1) / a.resolution)
+}
+
+// prune drops the aggregates idle for longer than the span and the expired
+// process lookups
+func (a *Accountant) prune(now time.Time) {
+	for _, t := range a.tables {
+		for k, e := range t {
+			if now.Sub(e.last) > a.span {
+				delete(t, k)
+			}
+		}
+	}
+	for k, c := range a.pids {
+		if now.After(c.expire) {
+			delete(a.pids, k)
+		}
+	}
+}
+
+// Len returns the number of aggregates of dimension d
+func (a *Accountant) Len(d Dimension) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.tables[d])
+}
+
+// Top is TopAt at the current time
+func (a *Accountant) Top(d Dimension, n int, window time.Duration) []Usage {
+	return a.TopAt(d, n, window, time.Now())
+}
+
+// TopAt returns the n aggregates of dimension d with the most bytes within
+// the window ending at now, all of them when n is not positive. The window
+// is rounded up to the resolution and capped at the span.
+func (a *Accountant) TopAt(d Dimension, n int, window time.Duration, now time.Time) []Usage {
+	if window <= 0 || window > a.span {
+		window = a.span
+	}
+	slots := int64((window + a.resolution - 1) / a.resolution)
+	slot := now.UnixNano() / int64(a.resolution)
+
+	a.mu.Lock()
+	us := make([]Usage, 0, len(a.tables[d]))
+	for k, e := range a.tables[d] {
+		u := Usage{Dimension: d, Sent: e.sent, Received: e.recv}
+		switch d {
+		case ByProcess:
+			u.PID = k.pid
+		case ByHost:
+			u.Host = k.host.String()
+		case ByPort:
+			u.Protocol, u.Port = protocolName(k.proto), k.port
+		}
+
+		for _, b := range e.ring {
+			if b.slot > slot-slots && b.slot <= slot {
+				u.WindowSent.Packets += b.sent.Packets
+				u.WindowSent.Bytes += b.sent.Bytes
+				u.WindowReceived.Packets += b.recv.Packets
+				u.WindowReceived.Bytes += b.recv.Bytes
+			}
+		}
+		u.Rate = float64(u.Bytes()) / (time.Duration(slots) * a.resolution).Seconds()
+		us = append(us, u)
+	}
+	a.mu.Unlock()
+
+	sort.Slice(us, func(i, j int) bool {
+		if us[i].Bytes() != us[j].Bytes() {
+			return us[i].Bytes() > us[j].Bytes()
+		}
+		return us[i].Sent.Bytes+us[i].Received.Bytes > us[j].Sent.Bytes+us[j].Received.Bytes
+	})
+	if n > 0 && len(us) > n {
+		us = us[:n]
+	}
+
+	if d == ByProcess && a.Processes != nil {
+		for i := range us {
+			if p, err := a.Processes.Process(us[i].PID); err == nil {
+				us[i].Name = p.Name
+			}
+		}
+	}
+	return us
+}
+
+func protocolName(proto uint8) string {
+	switch proto {
+	case iana.ProtocolTCP:
+		return "tcp"
+	case iana.ProtocolUDP:
+		return "udp"
+	case iana.ProtocolICMP:
+		return "icmp"
+	case iana.ProtocolIPv6ICMP:
+		return "icmpv6"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+// AccountSnapshot is the top aggregates of every dimension at a time
+type AccountSnapshot struct {
+	Time      time.Time `json:"time"`
+	Window    string    `json:"window"`
+	Processes []Usage   `json:"processes"`
+	Hosts     []Usage   `json:"hosts"`
+	Ports     []Usage   `json:"ports"`
+}
+
+// SnapshotAt returns the n top aggregates of every dimension within the
+// window ending at now
+func (a *Accountant) SnapshotAt(n int, window time.Duration, now time.Time) AccountSnapshot {
+	return AccountSnapshot{
+		Time:      now,
+		Window:    window.String(),
+		Processes: a.TopAt(ByProcess, n, window, now),
+		Hosts:     a.TopAt(ByHost, n, window, now),
+		Ports:     a.TopAt(ByPort, n, window, now),
+	}
+}
+
+// WriteSnapshots writes a snapshot of the n top aggregates within window as
+// a JSON line to w every interval until ctx is done
+func (a *Accountant) WriteSnapshots(ctx context.Context, w io.Writer, interval time.Duration, n int, window time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case now := <-t.C:
+			if err := enc.Encode(a.SnapshotAt(n, window, now)); err != nil {
+				return fmt.Errorf("write snapshot error: %v", err)
+			}
+		}
+	}
+}
+
+// WriteSnapshotFile is WriteSnapshots appending to the file at path
+func (a *Accountant) WriteSnapshotFile(ctx context.Context, path string, interval time.Duration, n int, window time.Duration) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open snapshot file error: %v", err)
+	}
+	defer f.Close()
+
+	return a.WriteSnapshots(ctx, f, interval, n, window)
+}
@@ -0,0 +1,144 @@
+package windivert
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccountant(t *testing.T) {
+	a := NewAccountant(time.Minute, 10*time.Second)
+	lookups := 0
+	a.Lookup = func(t FiveTuple) (uint32, bool) {
+		lookups++
+		return uint32(t.SrcPort) / 1000, t.SrcPort >= 1000
+	}
+	a.Processes = NewFakeProcessResolver(ProcessInfo{PID: 40, Name: "browser.exe"})
+
+	t0 := time.Unix(1000, 0)
+	web := testTuple(6, "10.0.0.1:40000", "1.1.1.1:443")
+	dns := testTuple(17, "10.0.0.1:50000", "8.8.8.8:53")
+	sys := testTuple(17, "10.0.0.1:123", "8.8.8.8:123")
+	for _, r := range []struct {
+		t        FiveTuple
+		outbound bool
+		size     int
+		at       time.Duration
+	}{
+		{web, true, 100, 0},
+		{web, false, 1000, time.Second},
+		{dns, true, 60, 5 * time.Second},
+		{dns, false, 200, 5 * time.Second},
+		{sys, true, 76, 20 * time.Second},
+		{web, false, 1500, 45 * time.Second},
+	} {
+		a.RecordAt(r.t, r.outbound, r.size, t0.Add(r.at))
+	}
+
+	if lookups != 3 {
+		t.Errorf("%d lookups for 3 connections", lookups)
+	}
+	now := t0.Add(45 * time.Second)
+	for _, tt := range []struct {
+		d      Dimension
+		window time.Duration
+		want   []Usage
+	}{
+		{ByProcess, time.Minute, []Usage{
+			{Dimension: ByProcess, PID: 40, Name: "browser.exe", Sent: Counters{1, 100}, Received: Counters{2, 2500}, WindowSent: Counters{1, 100}, WindowReceived: Counters{2, 2500}, Rate: 2600.0 / 60},
+			{Dimension: ByProcess, PID: 50, Sent: Counters{1, 60}, Received: Counters{1, 200}, WindowSent: Counters{1, 60}, WindowReceived: Counters{1, 200}, Rate: 260.0 / 60},
+		}},
+		{ByHost, 10 * time.Second, []Usage{
+			{Dimension: ByHost, Host: "1.1.1.1", Sent: Counters{1, 100}, Received: Counters{2, 2500}, WindowReceived: Counters{1, 1500}, Rate: 150},
+			{Dimension: ByHost, Host: "8.8.8.8", Sent: Counters{2, 136}, Received: Counters{1, 200}, Rate: 0},
+		}},
+		{ByPort, 30 * time.Second, []Usage{
+			{Dimension: ByPort, Protocol: "tcp", Port: 443, Sent: Counters{1, 100}, Received: Counters{2, 2500}, WindowReceived: Counters{1, 1500}, Rate: 50},
+			{Dimension: ByPort, Protocol: "udp", Port: 123, Sent: Counters{1, 76}, WindowSent: Counters{1, 76}, Rate: 76.0 / 30},
+			{Dimension: ByPort, Protocol: "udp", Port: 53, Sent: Counters{1, 60}, Received: Counters{1, 200}, Rate: 0},
+		}},
+	} {
+		got := a.TopAt(tt.d, 0, tt.window, now)
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: TopAt = %+v", tt.d, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%v: TopAt[%d] = %+v, want %+v", tt.d, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	if us := a.TopAt(ByHost, 1, 0, now); len(us) != 1 || us[0].Host != "1.1.1.1" {
+		t.Errorf("TopAt(ByHost, 1) = %+v", us)
+	}
+
+	// idle aggregates are dropped after the span
+	a.RecordAt(web, true, 1, t0.Add(100*time.Second))
+	if a.Len(ByHost) != 1 || a.Len(ByPort) != 1 {
+		t.Errorf("Len = %d, %d after the span", a.Len(ByHost), a.Len(ByPort))
+	}
+}
+
+func TestAccountantSnapshot(t *testing.T) {
+	a := NewAccountant(0, 0)
+	now := time.Unix(1000, 0)
+	a.RecordAt(testTuple(6, "10.0.0.1:40000", "1.1.1.1:443"), true, 100, now)
+
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(a.SnapshotAt(10, time.Minute, now)); err != nil {
+		t.Fatal(err)
+	}
+	var s struct {
+		Window    string
+		Processes []Usage
+		Hosts     []Usage
+	}
+	if err := json.Unmarshal(b.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Window != "1m0s" || len(s.Processes) != 0 || len(s.Hosts) != 1 || s.Hosts[0].Dimension != ByHost || s.Hosts[0].Sent.Bytes != 100 {
+		t.Errorf("snapshot = %s", b.Bytes())
+	}
+}
+
+func TestDeviceAccount(t *testing.T) {
+	d := &Device{
+		Flows:  NewFlowTracker(&countingFlowSource{}),
+		Conns:  NewConnTrack(),
+		active: make(chan struct{}),
+		acctCh: make(chan accountRecord, 1),
+	}
+	a := NewAccountant(0, 0)
+	d.SetAccountant(a)
+	if a.Lookup == nil {
+		t.Fatal("Lookup not set")
+	}
+
+	var n atomic.Int32
+	a.mu.Lock()
+	a.Lookup = func(FiveTuple) (uint32, bool) { n.Add(1); return 7, true }
+	a.mu.Unlock()
+	p := testPacket(6, testDst4, testSrc4, ACK, 1, testPayload(10))
+
+	// the queue holds one packet until the loop runs
+	d.account(p, false)
+	d.account(p, false)
+	if d.Stats().AccountDropped != 1 || n.Load() != 0 {
+		t.Errorf("AccountDropped = %d, %d lookups on the packet path", d.Stats().AccountDropped, n.Load())
+	}
+
+	go d.accountLoop()
+	defer close(d.active)
+	deadline := time.Now().Add(time.Second)
+	for a.Len(ByProcess) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	us := a.Top(ByPort, 0, 0)
+	if len(us) != 1 || us[0].Port != 443 || us[0].Received.Packets != 1 {
+		t.Errorf("Top = %+v", us)
+	}
+}
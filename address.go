@@ -1,6 +1,7 @@
 package windivert
 
 import (
+	"strings"
 	"unsafe"
 )
 
@@ -84,11 +85,51 @@ type Address struct {
 	HasIPChecksum  uint8 // renamed from IPChecksum
 	HasTCPChecksum uint8 // renamed from TCPChecksum
 	HasUDPChecksum uint8 // renamed from UDPChecksum
-	Flags          uint8
+	Flags          AddressFlags
 	union          [64]byte
 	length         uint64
 }
 
+// AddressFlags are the flag bits of an Address
+type AddressFlags uint8
+
+const (
+	AddressSniffed     AddressFlags = 0x01 << 0
+	AddressOutbound    AddressFlags = 0x01 << 1
+	AddressLoopback    AddressFlags = 0x01 << 2
+	AddressImpostor    AddressFlags = 0x01 << 3
+	AddressIPv6        AddressFlags = 0x01 << 4
+	AddressIPChecksum  AddressFlags = 0x01 << 5
+	AddressTCPChecksum AddressFlags = 0x01 << 6
+	AddressUDPChecksum AddressFlags = 0x01 << 7
+)
+
+var addressFlagNames = [...]string{
+	"Sniffed",
+	"Outbound",
+	"Loopback",
+	"Impostor",
+	"IPv6",
+	"IPChecksum",
+	"TCPChecksum",
+	"UDPChecksum",
+}
+
+// Has returns whether all bits of v are set
+func (f AddressFlags) Has(v AddressFlags) bool {
+	return f&v == v
+}
+
+func (f AddressFlags) String() string {
+	s := make([]string, 0, len(addressFlagNames))
+	for i, name := range addressFlagNames {
+		if f&(0x01<<i) != 0 {
+			s = append(s, name)
+		}
+	}
+	return strings.Join(s, "|")
+}
+
 // GetLayer returns the layer type
 func (a *Address) Layer() Layer {
 	return a.LayerType
@@ -111,77 +152,122 @@ func (a *Address) SetEvent(event Event) {
 
 // IsSniffed returns whether the packet was sniffed
 func (a *Address) Sniffed() bool {
-	return (a.Flags & uint8(0x01<<0)) == uint8(0x01<<0)
+	return a.Flags.Has(AddressSniffed)
 }
 
 // SetSniffed sets the sniffed flag
 func (a *Address) SetSniffed() {
-	a.Flags |= uint8(0x01 << 0)
+	a.Flags |= AddressSniffed
 }
 
 // UnsetSniffed unsets the sniffed flag
 func (a *Address) UnsetSniffed() {
-	a.Flags &= ^uint8(0x01 << 0)
+	a.Flags &^= AddressSniffed
 }
 
 // IsOutbound returns whether the packet is outbound
 func (a *Address) Outbound() bool {
-	return (a.Flags & uint8(0x01<<1)) == uint8(0x01<<1)
+	return a.Flags.Has(AddressOutbound)
 }
 
 // SetOutbound sets the outbound flag
 func (a *Address) SetOutbound() {
-	a.Flags |= uint8(0x01 << 1)
+	a.Flags |= AddressOutbound
 }
 
 // UnsetOutbound unsets the outbound flag
 func (a *Address) UnsetOutbound() {
-	a.Flags &= ^uint8(0x01 << 1)
+	a.Flags &^= AddressOutbound
+}
+
+// Loopback returns whether the packet is a loopback packet
+func (a *Address) Loopback() bool {
+	return a.Flags.Has(AddressLoopback)
+}
+
+// SetLoopback sets the loopback flag
+func (a *Address) SetLoopback() {
+	a.Flags |= AddressLoopback
+}
+
+// UnsetLoopback unsets the loopback flag
+func (a *Address) UnsetLoopback() {
+	a.Flags &^= AddressLoopback
+}
+
+// Impostor returns whether the packet was injected by another handle
+func (a *Address) Impostor() bool {
+	return a.Flags.Has(AddressImpostor)
+}
+
+// SetImpostor sets the impostor flag
+func (a *Address) SetImpostor() {
+	a.Flags |= AddressImpostor
+}
+
+// UnsetImpostor unsets the impostor flag
+func (a *Address) UnsetImpostor() {
+	a.Flags &^= AddressImpostor
+}
+
+// IPv6 returns whether the packet or flow is IPv6
+func (a *Address) IPv6() bool {
+	return a.Flags.Has(AddressIPv6)
+}
+
+// SetIPv6 sets the IPv6 flag
+func (a *Address) SetIPv6() {
+	a.Flags |= AddressIPv6
+}
+
+// UnsetIPv6 unsets the IPv6 flag
+func (a *Address) UnsetIPv6() {
+	a.Flags &^= AddressIPv6
 }
 
 // HasIPChecksum returns whether IP checksum is present
 func (a *Address) IPChecksum() bool {
-	return (a.Flags & uint8(0x01<<5)) == uint8(0x01<<5)
+	return a.Flags.Has(AddressIPChecksum)
 }
 
 // SetIPChecksum sets the IP checksum flag
 func (a *Address) SetIPChecksum() {
-	a.Flags |= uint8(0x01 << 5)
+	a.Flags |= AddressIPChecksum
 }
 
 // UnsetIPChecksum unsets the IP checksum flag
 func (a *Address) UnsetIPChecksum() {
-	a.Flags &= ^uint8(0x01 << 5)
+	a.Flags &^= AddressIPChecksum
 }
 
 // HasTCPChecksum returns whether TCP checksum is present
 func (a *Address) TCPChecksum() bool {
-	return (a.Flags & uint8(0x01<<6)) == uint8(0x01<<6)
+	return a.Flags.Has(AddressTCPChecksum)
 }
 
 // SetTCPChecksum sets the TCP checksum flag
 func (a *Address) SetTCPChecksum() {
-	a.Flags |= uint8(0x01 << 6)
+	a.Flags |= AddressTCPChecksum
 }
 
 // UnsetTCPChecksum unsets the TCP checksum flag
 func (a *Address) UnsetTCPChecksum() {
-	a.Flags &= ^uint8(0x01 << 6)
+	a.Flags &^= AddressTCPChecksum
 }
 
 // HasUDPChecksum returns whether UDP checksum is present
 func (a *Address) UDPChecksum() bool {
-	return (a.Flags & uint8(0x01<<7)) == uint8(0x01<<7)
+	return a.Flags.Has(AddressUDPChecksum)
 }
 
 // SetUDPChecksum sets the UDP checksum flag
 func (a *Address) SetUDPChecksum() {
-	a.Flags |= uint8(0x01 << 7)
+	a.Flags |= AddressUDPChecksum
 }
 
 // UnsetUDPChecksum unsets the UDP checksum flag
 func (a *Address) UnsetUDPChecksum() {
-	a.Flags &= ^uint8(0x01 << 7)
+	a.Flags &^= AddressUDPChecksum
 }
 
 func (a *Address) Length() uint32 {
@@ -212,6 +298,75 @@ func (a *Address) Reflect() *Reflect {
 	return (*Reflect)(unsafe.Pointer(&a.union))
 }
 
+// NewOutboundAddress returns a network layer address to inject outbound
+// packets on the given interface
+func NewOutboundAddress(ifIdx, subIfIdx uint32) *Address {
+	a := newNetworkAddress(ifIdx, subIfIdx)
+	a.SetOutbound()
+	return a
+}
+
+// NewInboundAddress returns a network layer address to inject inbound
+// packets on the given interface
+func NewInboundAddress(ifIdx, subIfIdx uint32) *Address {
+	return newNetworkAddress(ifIdx, subIfIdx)
+}
+
+func newNetworkAddress(ifIdx, subIfIdx uint32) *Address {
+	a := &Address{LayerType: LayerNetwork, EventType: EventNetworkPacket}
+	nw := a.Network()
+	nw.InterfaceIndex = ifIdx
+	nw.SubInterfaceIndex = subIfIdx
+	return a
+}
+
+// AsNetwork returns the network layer information, ok is false unless the
+// address belongs to the network or network forward layer
+func (a *Address) AsNetwork() (nw *Network, ok bool) {
+	switch a.Layer() {
+	case LayerNetwork, LayerNetworkForward:
+		return a.Network(), true
+	default:
+		return nil, false
+	}
+}
+
+// AsFlow returns the flow layer information, ok is false unless the address
+// belongs to the flow layer
+func (a *Address) AsFlow() (f *Flow, ok bool) {
+	if a.Layer() != LayerFlow {
+		return nil, false
+	}
+	return a.Flow(), true
+}
+
+// AsSocket returns the socket layer information, ok is false unless the
+// address belongs to the socket layer
+func (a *Address) AsSocket() (s *Socket, ok bool) {
+	if a.Layer() != LayerSocket {
+		return nil, false
+	}
+	return a.Socket(), true
+}
+
+// AsReflect returns the reflect layer information, ok is false unless the
+// address belongs to the reflect layer
+func (a *Address) AsReflect() (r *Reflect, ok bool) {
+	if a.Layer() != LayerReflect {
+		return nil, false
+	}
+	return a.Reflect(), true
+}
+
+// AsEthernet returns the ethernet information, ok is false unless the
+// address is for an ethernet frame event
+func (a *Address) AsEthernet() (e *Ethernet, ok bool) {
+	if a.Event() != EventEthernetFrame {
+		return nil, false
+	}
+	return a.Ethernet(), true
+}
+
 type AddressHelper interface {
 	CalcChecksums(packet []byte, flags uint64) error
 	ParseIPv4Header(packet []byte) (*IPv4Header, error)
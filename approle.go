@@ -0,0 +1,290 @@
+package windivert
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AppRule matches processes by their executable. Every field that is set
+// has to match, an empty rule matches nothing.
+type AppRule struct {
+	// Path is a glob as understood by filepath.Match matched against the
+	// full image path, ignoring case
+	Path string
+	// Name is the image name, ignoring case
+	Name string
+	// SHA256 is the hex encoded hash of the image file
+	SHA256 string
+	// Publisher is the subject common name of the certificate the image is
+	// signed with. The signature is not verified, use SHA256 when the
+	// image has to be trusted.
+	Publisher string
+	// Parent matches the parent process
+	Parent *AppRule
+}
+
+func (r *AppRule) empty() bool {
+	return r.Path == "" && r.Name == "" && r.SHA256 == "" && r.Publisher == "" && r.Parent == nil
+}
+
+// appVerdict is the outcome of the rules for a process
+type appVerdict struct {
+	start   time.Time
+	checked time.Time
+	ok      bool
+	// failed is set when the process could not be looked up, it is looked
+	// up again after Recheck
+	failed bool
+}
+
+// AppRules resolves rules about executables to the PIDs running them. The
+// outcome for a PID is cached until the process exits or the PID is reused,
+// so a rule keeps matching an application across restarts.
+type AppRules struct {
+	// Recheck is how long an outcome is used before the start time of its
+	// process is read again to tell whether the PID was reused
+	Recheck time.Duration
+	// Hash returns the SHA256 of an image file
+	Hash func(path string) (string, error)
+	// Publisher returns the publisher of an image file
+	Publisher func(path string) (string, error)
+
+	procs ProcessResolver
+
+	mu       sync.RWMutex
+	rules    []AppRule
+	gen      uint64
+	verdicts map[uint32]appVerdict
+	hashes   map[string]imageHash
+}
+
+// imageHash is the hash of a version of an image file
+type imageHash struct {
+	mod  time.Time
+	size int64
+	hash string
+}
+
+// NewAppRules creates an empty rule set resolving processes with r
+func NewAppRules(r ProcessResolver) *AppRules {
+	return &AppRules{
+		Recheck:   time.Second,
+		Hash:      fileSHA256,
+		Publisher: imagePublisher,
+		procs:     r,
+		verdicts:  make(map[uint32]appVerdict),
+		hashes:    make(map[string]imageHash),
+	}
+}
+
+// Add adds a rule
+func (a *AppRules) Add(r AppRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = append(a.rules[:len(a.rules):len(a.rules)], r)
+	a.gen++
+	a.verdicts = make(map[uint32]appVerdict)
+}
+
+// Reset removes all rules
+func (a *AppRules) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = nil
+	a.gen++
+	a.verdicts = make(map[uint32]appVerdict)
+}
+
+// Len returns the number of rules
+func (a *AppRules) Len() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.rules)
+}
+
+// Lookup reports whether the process pid matches any rule
+func (a *AppRules) Lookup(pid uint32) bool {
+	a.mu.RLock()
+	n := len(a.rules)
+	v, cached := a.verdicts[pid]
+	a.mu.RUnlock()
+
+	if n == 0 {
+		return false
+	}
+	now := time.Now()
+	if cached && now.Sub(v.checked) < a.Recheck {
+		return v.ok
+	}
+
+	start, err := a.procs.StartTime(pid)
+	if err != nil {
+		a.Forget(pid)
+		return false
+	}
+	if cached && !v.failed && start.Equal(v.start) {
+		a.mu.Lock()
+		if w, ok := a.verdicts[pid]; ok && w.start.Equal(start) {
+			w.checked = now
+			a.verdicts[pid] = w
+		}
+		a.mu.Unlock()
+		return v.ok
+	}
+
+	p, err := a.procs.Process(pid)
+	if err != nil {
+		a.mu.Lock()
+		a.verdicts[pid] = appVerdict{start: start, checked: now, failed: true}
+		a.mu.Unlock()
+		return false
+	}
+
+	a.mu.RLock()
+	rules, gen := a.rules, a.gen
+	a.mu.RUnlock()
+
+	ok := false
+	for i := range rules {
+		if a.match(&rules[i], &p) {
+			ok = true
+			break
+		}
+	}
+
+	a.mu.Lock()
+	if gen == a.gen {
+		a.verdicts[pid] = appVerdict{start: p.StartTime, checked: now, ok: ok}
+	}
+	a.mu.Unlock()
+	return ok
+}
+
+// KnownPIDs returns the processes found to match so far. Only the PIDs
+// passed to Lookup since the rules last changed are known, running
+// processes that were never looked up are not enumerated.
+func (a *AppRules) KnownPIDs() []uint32 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	pids := []uint32{}
+	for pid, v := range a.verdicts {
+		if v.ok {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Forget drops the outcome for pid, it is called when the process exits
+func (a *AppRules) Forget(pid uint32) {
+	a.mu.Lock()
+	delete(a.verdicts, pid)
+	a.mu.Unlock()
+}
+
+// Prune drops the outcomes for processes that have exited
+func (a *AppRules) Prune() {
+	a.mu.RLock()
+	verdicts := make(map[uint32]appVerdict, len(a.verdicts))
+	for pid, v := range a.verdicts {
+		verdicts[pid] = v
+	}
+	a.mu.RUnlock()
+
+	for pid, v := range verdicts {
+		if t, err := a.procs.StartTime(pid); err != nil || !t.Equal(v.start) {
+			a.Forget(pid)
+		}
+	}
+}
+
+func (a *AppRules) match(r *AppRule, p *ProcessInfo) bool {
+	if r.empty() {
+		return false
+	}
+
+	if r.Name != "" && !strings.EqualFold(r.Name, p.Name) {
+		return false
+	}
+	if r.Path != "" {
+		ok, err := filepath.Match(strings.ToLower(r.Path), strings.ToLower(p.Path))
+		if err != nil || !ok {
+			return false
+		}
+	}
+	if r.SHA256 != "" {
+		h, err := a.hash(p.Path)
+		if err != nil || !strings.EqualFold(r.SHA256, h) {
+			return false
+		}
+	}
+	if r.Publisher != "" {
+		s, err := a.Publisher(p.Path)
+		if err != nil || s != r.Publisher {
+			return false
+		}
+	}
+	if r.Parent != nil {
+		pp, err := a.procs.Process(p.ParentPID)
+		// a parent started after the child is a process reusing its PID
+		if err != nil || pp.PID == p.PID || pp.StartTime.After(p.StartTime) {
+			return false
+		}
+		if !a.match(r.Parent, &pp) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hash returns the hash of an image, hashing each version of a file once.
+// Only the hash of the latest version seen of a file is kept.
+func (a *AppRules) hash(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		a.mu.Lock()
+		delete(a.hashes, path)
+		a.mu.Unlock()
+		return "", err
+	}
+
+	a.mu.RLock()
+	h, ok := a.hashes[path]
+	a.mu.RUnlock()
+	if ok && h.mod.Equal(fi.ModTime()) && h.size == fi.Size() {
+		return h.hash, nil
+	}
+
+	s, err := a.Hash(path)
+	if err != nil {
+		return "", err
+	}
+
+	a.mu.Lock()
+	a.hashes[path] = imageHash{mod: fi.ModTime(), size: fi.Size(), hash: s}
+	a.mu.Unlock()
+	return s, nil
+}
+
+// fileSHA256 returns the hex encoded SHA256 of a file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
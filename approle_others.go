@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "errors"
+
+// imagePublisher needs the Win32 crypto API
+func imagePublisher(path string) (string, error) {
+	return "", errors.New("image publisher is only supported on windows")
+}
@@ -0,0 +1,153 @@
+package windivert
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProcessResolver counts the start times and processes read, the
+// processes fail to be read while fail is set
+type countingProcessResolver struct {
+	*FakeProcessResolver
+	n     atomic.Int32
+	procs atomic.Int32
+	fail  atomic.Bool
+}
+
+func (r *countingProcessResolver) StartTime(pid uint32) (time.Time, error) {
+	r.n.Add(1)
+	return r.FakeProcessResolver.StartTime(pid)
+}
+
+func (r *countingProcessResolver) Process(pid uint32) (ProcessInfo, error) {
+	r.procs.Add(1)
+	if r.fail.Load() {
+		return ProcessInfo{}, errors.New("access denied")
+	}
+	return r.FakeProcessResolver.Process(pid)
+}
+
+func TestAppRulesLookup(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := &countingProcessResolver{FakeProcessResolver: NewFakeProcessResolver(
+		ProcessInfo{PID: 1, Path: "C:/Windows/explorer.exe", Name: "explorer.exe", StartTime: t0},
+		ProcessInfo{PID: 10, ParentPID: 1, Path: "C:/Apps/app.exe", Name: "app.exe", StartTime: t0.Add(time.Second)},
+		ProcessInfo{PID: 11, ParentPID: 1, Path: "C:/Apps/other.exe", Name: "other.exe", StartTime: t0.Add(time.Second)},
+	)}
+	a := NewAppRules(r)
+	a.Recheck = time.Hour
+	a.Add(AppRule{Path: "c:/apps/*.exe", Parent: &AppRule{Name: "EXPLORER.EXE"}})
+	a.Add(AppRule{})
+
+	for _, tt := range []struct {
+		pid  uint32
+		want bool
+	}{
+		{10, true},
+		{11, true},
+		{1, false},
+		{99, false},
+	} {
+		if got := a.Lookup(tt.pid); got != tt.want {
+			t.Errorf("Lookup(%d) = %v, want %v", tt.pid, got, tt.want)
+		}
+	}
+
+	n := r.n.Load()
+	for i := 0; i < 10; i++ {
+		a.Lookup(10)
+	}
+	if r.n.Load() != n {
+		t.Errorf("start time read %d times for cached outcomes", r.n.Load()-n)
+	}
+
+	// a reused PID is noticed once the outcome is rechecked
+	r.Add(ProcessInfo{PID: 10, Path: "C:/Other/app.exe", Name: "app.exe", StartTime: t0.Add(time.Minute)})
+	a.Recheck = 0
+	if a.Lookup(10) {
+		t.Error("Lookup(10) matches the process reusing the PID")
+	}
+	if pids := a.KnownPIDs(); len(pids) != 1 || pids[0] != 11 {
+		t.Errorf("KnownPIDs() = %v", pids)
+	}
+}
+
+func TestAppRulesLookupFailure(t *testing.T) {
+	r := &countingProcessResolver{FakeProcessResolver: NewFakeProcessResolver(
+		ProcessInfo{PID: 10, Name: "app.exe", StartTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	)}
+	r.fail.Store(true)
+	a := NewAppRules(r)
+	a.Recheck = time.Hour
+	a.Add(AppRule{Name: "app.exe"})
+
+	for i := 0; i < 3; i++ {
+		if a.Lookup(10) {
+			t.Error("Lookup(10) matches a process that could not be read")
+		}
+	}
+	if n := r.procs.Load(); n != 1 {
+		t.Errorf("process read %d times before Recheck", n)
+	}
+
+	r.fail.Store(false)
+	a.Recheck = 0
+	if !a.Lookup(10) {
+		t.Error("Lookup(10) does not match after Recheck")
+	}
+}
+
+func TestAppRulesHash(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.exe")
+	if err := os.WriteFile(path, []byte("v1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewFakeProcessResolver(ProcessInfo{PID: 10, Path: path, StartTime: time.Unix(1000, 0)})
+	a := NewAppRules(r)
+	a.Recheck = 0
+	hashed := 0
+	a.Hash = func(path string) (string, error) {
+		hashed++
+		return fileSHA256(path)
+	}
+	// SHA256 of "v1"
+	rule := AppRule{SHA256: "3bfc269594ef649228e9a74bab00f042efc91d5acc6fbee31a382e80d42388fe"}
+
+	for _, tt := range []struct {
+		content string
+		want    bool
+		hashed  int
+	}{
+		{"v1", true, 1},
+		{"v1", true, 1},
+		{"v2 changed", false, 2},
+	} {
+		if tt.content != "v1" {
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the outcome is kept as long as the process runs, start over
+		a.Reset()
+		a.Add(rule)
+		if got := a.Lookup(10); got != tt.want || hashed != tt.hashed {
+			t.Errorf("%q: Lookup(10) = %v, hashed %d times, want %v, %d", tt.content, got, hashed, tt.want, tt.hashed)
+		}
+	}
+	if len(a.hashes) != 1 {
+		t.Errorf("%d hashes kept for one file", len(a.hashes))
+	}
+
+	os.Remove(path)
+	a.Reset()
+	a.Add(rule)
+	if a.Lookup(10) || len(a.hashes) != 0 {
+		t.Errorf("hash of a removed file kept")
+	}
+}
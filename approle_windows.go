@@ -0,0 +1,90 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"crypto/x509"
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modcrypt32 = syscall.NewLazyDLL("crypt32.dll")
+
+	procCryptMsgClose    = modcrypt32.NewProc("CryptMsgClose")
+	procCryptMsgGetParam = modcrypt32.NewProc("CryptMsgGetParam")
+)
+
+// cmsgSignerInfoParam is CMSG_SIGNER_INFO_PARAM
+const cmsgSignerInfoParam = 6
+
+// cmsgSignerInfo is the head of CMSG_SIGNER_INFO
+type cmsgSignerInfo struct {
+	Version      uint32
+	Issuer       windows.CertNameBlob
+	SerialNumber windows.CryptIntegerBlob
+}
+
+// errNotSigned is returned for an image without an embedded signature
+var errNotSigned = errors.New("image is not signed")
+
+// imagePublisher returns the subject common name of the certificate that
+// signed the Authenticode signature embedded in an image
+func imagePublisher(path string) (string, error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		encoding, content, format uint32
+		store, msg                windows.Handle
+	)
+	err = windows.CryptQueryObject(
+		windows.CERT_QUERY_OBJECT_FILE,
+		unsafe.Pointer(p),
+		windows.CERT_QUERY_CONTENT_FLAG_PKCS7_SIGNED_EMBED,
+		windows.CERT_QUERY_FORMAT_FLAG_BINARY,
+		0,
+		&encoding,
+		&content,
+		&format,
+		&store,
+		&msg,
+		nil,
+	)
+	if err != nil {
+		return "", errNotSigned
+	}
+	defer windows.CertCloseStore(store, 0)
+	defer procCryptMsgClose.Call(uintptr(msg))
+
+	// the signer is named by issuer and serial number, the store also
+	// holds the chain and the certificates of any countersignature
+	size := uint32(0)
+	if r, _, err := procCryptMsgGetParam.Call(uintptr(msg), cmsgSignerInfoParam, 0, 0, uintptr(unsafe.Pointer(&size))); r == 0 {
+		return "", err
+	}
+	buf := make([]uint64, (size+7)/8)
+	if r, _, err := procCryptMsgGetParam.Call(uintptr(msg), cmsgSignerInfoParam, 0, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size))); r == 0 {
+		return "", err
+	}
+	si := (*cmsgSignerInfo)(unsafe.Pointer(&buf[0]))
+
+	ci := windows.CertInfo{Issuer: si.Issuer, SerialNumber: si.SerialNumber}
+	ctx, err := windows.CertFindCertificateInStore(store, encoding, 0, windows.CERT_FIND_SUBJECT_CERT, unsafe.Pointer(&ci), nil)
+	if err != nil {
+		return "", errNotSigned
+	}
+	defer windows.CertFreeCertificateContext(ctx)
+
+	c, err := x509.ParseCertificate(append([]byte(nil), unsafe.Slice(ctx.EncodedCert, ctx.Length)...))
+	if err != nil {
+		return "", err
+	}
+	return c.Subject.CommonName, nil
+}
@@ -0,0 +1,103 @@
+package windivert
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Networks bypassed by default, their traffic stays on the LAN or the host
+var (
+	// BypassPrivate are the RFC 1918 private networks
+	BypassPrivate = []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}
+	// BypassLinkLocal are the IPv4 and IPv6 link-local networks
+	BypassLinkLocal = []netip.Prefix{
+		netip.MustParsePrefix("169.254.0.0/16"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+	// BypassCGNAT is the RFC 6598 shared address space
+	BypassCGNAT = []netip.Prefix{
+		netip.MustParsePrefix("100.64.0.0/10"),
+	}
+	// BypassMulticast are the IPv4 and IPv6 multicast networks
+	BypassMulticast = []netip.Prefix{
+		netip.MustParsePrefix("224.0.0.0/4"),
+		netip.MustParsePrefix("ff00::/8"),
+	}
+	// BypassBroadcast is the limited broadcast address
+	BypassBroadcast = []netip.Prefix{
+		netip.MustParsePrefix("255.255.255.255/32"),
+	}
+	// BypassLoopback are the IPv4 and IPv6 loopback networks
+	BypassLoopback = []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("::1/128"),
+	}
+	// BypassULA are the IPv6 unique local addresses
+	BypassULA = []netip.Prefix{
+		netip.MustParsePrefix("fc00::/7"),
+	}
+)
+
+// DefaultBypass returns all the networks bypassed by default
+func DefaultBypass() []netip.Prefix {
+	ps := []netip.Prefix{}
+	for _, s := range [][]netip.Prefix{
+		BypassPrivate,
+		BypassLinkLocal,
+		BypassCGNAT,
+		BypassMulticast,
+		BypassBroadcast,
+		BypassLoopback,
+		BypassULA,
+	} {
+		ps = append(ps, s...)
+	}
+	return ps
+}
+
+// BypassFilter returns a filter matching the packets whose remote address,
+// the destination of outbound packets and the source of inbound ones, is in
+// prefixes
+func BypassFilter(prefixes []netip.Prefix) string {
+	if len(prefixes) == 0 {
+		return "false"
+	}
+
+	dst := make([]string, 0, len(prefixes))
+	src := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		dst = append(dst, prefixFilter(p, "DstAddr"))
+		src = append(src, prefixFilter(p, "SrcAddr"))
+	}
+	return fmt.Sprintf("(outbound and (%s)) or (inbound and (%s))",
+		strings.Join(dst, " or "), strings.Join(src, " or "))
+}
+
+// prefixFilter returns a filter matching field of the packets in p
+func prefixFilter(p netip.Prefix, field string) string {
+	p = p.Masked()
+	layer := "ip"
+	if p.Addr().Is6() {
+		layer = "ipv6"
+	}
+
+	if p.IsSingleIP() {
+		return fmt.Sprintf("%s.%s = %s", layer, field, p.Addr())
+	}
+	return fmt.Sprintf("(%s.%s >= %s and %s.%s <= %s)", layer, field, p.Addr(), layer, field, prefixLast(p))
+}
+
+// prefixLast returns the last address of p
+func prefixLast(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
@@ -0,0 +1,77 @@
+package windivert
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"testing"
+)
+
+func TestBypassFilter(t *testing.T) {
+	for _, tt := range []struct {
+		prefixes []string
+		want     string
+	}{
+		{nil, "false"},
+		{[]string{"10.1.2.3/32"}, "(outbound and (ip.DstAddr = 10.1.2.3)) or (inbound and (ip.SrcAddr = 10.1.2.3))"},
+		{[]string{"10.1.2.3/8", "fe80::1/10"}, "(outbound and ((ip.DstAddr >= 10.0.0.0 and ip.DstAddr <= 10.255.255.255) or " +
+			"(ipv6.DstAddr >= fe80:: and ipv6.DstAddr <= febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff))) or " +
+			"(inbound and ((ip.SrcAddr >= 10.0.0.0 and ip.SrcAddr <= 10.255.255.255) or " +
+			"(ipv6.SrcAddr >= fe80:: and ipv6.SrcAddr <= febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff)))"},
+	} {
+		ps := []netip.Prefix{}
+		for _, p := range tt.prefixes {
+			ps = append(ps, netip.MustParsePrefix(p))
+		}
+		if got := BypassFilter(ps); got != tt.want {
+			t.Errorf("BypassFilter(%v) = %s", tt.prefixes, got)
+		}
+	}
+
+	f := BypassFilter(DefaultBypass())
+	for _, tt := range []struct {
+		filter string
+		want   bool
+	}{
+		{"outbound and ip.DstAddr == 192.168.1.1", true},
+		{"inbound and ipv6.SrcAddr == ff02::fb", true},
+		{"outbound and ip.DstAddr == 8.8.8.8", false},
+		{"inbound and ip.DstAddr == 10.0.0.1 and ip.SrcAddr == 1.1.1.1", false},
+	} {
+		if got := FiltersOverlap(f, tt.filter); got != tt.want {
+			t.Errorf("default bypass overlaps %q = %v", tt.filter, got)
+		}
+	}
+}
+
+func TestFilterObjects(t *testing.T) {
+	for _, tt := range []struct {
+		filter string
+		want   int
+	}{
+		{"true", 1},
+		{"tcp", 1},
+		{"outbound and tcp.DstPort == 80", 2},
+		{"not (ip.DstAddr >= 10.0.0.0 and ip.DstAddr <= 10.255.255.255) || ipv6.DstAddr = ::1", 3},
+		{"tcp ? tcp.DstPort == 80 : udp.DstPort = 53", 3},
+	} {
+		if n, err := FilterObjects(tt.filter); err != nil || n != tt.want {
+			t.Errorf("FilterObjects(%q) = %d, %v, want %d", tt.filter, n, err, tt.want)
+		}
+	}
+
+	if n, _ := FilterObjects(BypassFilter(DefaultBypass())); n > FilterObjectsMax/2 {
+		t.Errorf("default bypass takes %d objects", n)
+	}
+}
+
+func TestOpenDeviceHandleTooLong(t *testing.T) {
+	ps := []netip.Prefix{}
+	for i := 0; i < 100; i++ {
+		ps = append(ps, netip.MustParsePrefix(fmt.Sprintf("203.0.%d.0/24", i)))
+	}
+	_, err := openDeviceHandle("tcp", &Interface{Index: 1}, false, ps)
+	if !errors.Is(err, ErrFilterTooLong) {
+		t.Errorf("openDeviceHandle = %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package windivert
+
+import (
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// checksumAdd adds b to the ones' complement sum s
+func checksumAdd(s uint32, b []byte) uint32 {
+	n := len(b)
+	for i := 0; i+1 < n; i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n&1 == 1 {
+		s += uint32(b[n-1]) << 8
+	}
+	return s
+}
+
+// checksumFold folds the sum s and returns its ones' complement
+func checksumFold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
+
+// setIPv4HeaderChecksum recalculates the header checksum of an IPv4 packet
+func setIPv4HeaderChecksum(b []byte) {
+	hl := int(b[0]&0x0f) << 2
+	b[10], b[11] = 0, 0
+	c := checksumFold(checksumAdd(0, b[:hl]))
+	b[10], b[11] = byte(c>>8), byte(c)
+}
+
+// pseudoHeaderSum returns the sum of the pseudo header of the transport
+// header at off
+func pseudoHeaderSum(b []byte, off int, proto uint8) uint32 {
+	var s uint32
+	l := ipPacketLen(b) - off
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		s = checksumAdd(s, b[12:20])
+	case ipv6.Version:
+		s = checksumAdd(s, b[8:40])
+	}
+	return s + uint32(proto) + uint32(l>>16) + uint32(l&0xffff)
+}
+
+// setTransportChecksum recalculates the checksum of the TCP, UDP, ICMP or
+// ICMPv6 header at off
+func setTransportChecksum(b []byte, off int) {
+	var (
+		proto uint8
+		pos   int
+	)
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		proto = b[9]
+	case ipv6.Version:
+		e, err := parseIPv6Ext(b)
+		if err != nil {
+			return
+		}
+		proto = e.proto
+	}
+
+	switch proto {
+	case iana.ProtocolTCP:
+		pos = 16
+	case iana.ProtocolUDP:
+		pos = 6
+	case iana.ProtocolICMP, iana.ProtocolIPv6ICMP:
+		pos = 2
+	default:
+		return
+	}
+
+	m := b[off:ipPacketLen(b)]
+	m[pos], m[pos+1] = 0, 0
+
+	s := uint32(0)
+	if proto != iana.ProtocolICMP {
+		s = pseudoHeaderSum(b, off, proto)
+	}
+	c := checksumFold(checksumAdd(s, m))
+	if c == 0 && proto == iana.ProtocolUDP {
+		c = 0xffff
+	}
+	m[pos], m[pos+1] = byte(c>>8), byte(c)
+}
@@ -0,0 +1,134 @@
+package windivert
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClockSource reports the frequency of the counter behind Address.Timestamp
+// and Reflect.TimeStamp, and reads the counter together with the wall clock
+type ClockSource interface {
+	// Frequency returns the number of counter ticks per second
+	Frequency() int64
+	// Now returns the counter and the wall clock read at the same instant
+	Now() (ticks int64, t time.Time)
+}
+
+// FixedClockSource is a ClockSource that always returns the same reading,
+// it is meant for tests and for converting recorded timestamps
+type FixedClockSource struct {
+	Freq  int64
+	Ticks int64
+	Time  time.Time
+}
+
+func (s *FixedClockSource) Frequency() int64 {
+	return s.Freq
+}
+
+func (s *FixedClockSource) Now() (int64, time.Time) {
+	return s.Ticks, s.Time
+}
+
+// Clock converts QueryPerformanceCounter ticks to time.Time and
+// time.Duration. It is calibrated by reading the counter and the wall clock
+// once, so a Clock drifts from the wall clock as the latter is adjusted and
+// should be calibrated again from time to time.
+type Clock struct {
+	src ClockSource
+
+	mu    sync.RWMutex
+	freq  int64
+	ticks int64
+	base  time.Time
+}
+
+// NewClock returns a Clock calibrated from src
+func NewClock(src ClockSource) *Clock {
+	c := &Clock{src: src}
+	c.Calibrate()
+	return c
+}
+
+// Calibrate reads src again
+func (c *Clock) Calibrate() {
+	freq := c.src.Frequency()
+	ticks, t := c.src.Now()
+	if freq <= 0 {
+		freq = 1
+	}
+
+	c.mu.Lock()
+	c.freq, c.ticks, c.base = freq, ticks, t
+	c.mu.Unlock()
+}
+
+// Frequency returns the number of ticks per second
+func (c *Clock) Frequency() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.freq
+}
+
+// Duration converts a number of ticks to a time.Duration
+func (c *Clock) Duration(ticks int64) time.Duration {
+	c.mu.RLock()
+	freq := c.freq
+	c.mu.RUnlock()
+	return ticksToDuration(ticks, freq)
+}
+
+// Time converts a counter value to wall clock time
+func (c *Clock) Time(ticks int64) time.Time {
+	c.mu.RLock()
+	freq, base, t := c.freq, c.ticks, c.base
+	c.mu.RUnlock()
+	return t.Add(ticksToDuration(ticks-base, freq))
+}
+
+// Ticks converts wall clock time to a counter value
+func (c *Clock) Ticks(t time.Time) int64 {
+	c.mu.RLock()
+	freq, base, bt := c.freq, c.ticks, c.base
+	c.mu.RUnlock()
+	return base + durationToTicks(t.Sub(bt), freq)
+}
+
+// ticksToDuration converts without overflowing for any realistic frequency
+func ticksToDuration(ticks, freq int64) time.Duration {
+	sec, rem := ticks/freq, ticks%freq
+	return time.Duration(sec)*time.Second + time.Duration(rem*int64(time.Second)/freq)
+}
+
+func durationToTicks(d time.Duration, freq int64) int64 {
+	sec, rem := int64(d/time.Second), int64(d%time.Second)
+	return sec*freq + rem*freq/int64(time.Second)
+}
+
+var defaultClock atomic.Pointer[Clock]
+
+// DefaultClock returns the Clock used where the library reports time. It is
+// calibrated from the system counter on first use.
+func DefaultClock() *Clock {
+	if c := defaultClock.Load(); c != nil {
+		return c
+	}
+	defaultClock.CompareAndSwap(nil, NewClock(SystemClockSource()))
+	return defaultClock.Load()
+}
+
+// SetDefaultClock replaces the Clock returned by DefaultClock
+func SetDefaultClock(c *Clock) {
+	defaultClock.Store(c)
+}
+
+// Time returns the Timestamp of the address as wall clock time
+func (a *Address) Time() time.Time {
+	return DefaultClock().Time(a.Timestamp)
+}
+
+// Time returns the TimeStamp of the handle as wall clock time
+func (r *Reflect) Time() time.Time {
+	return DefaultClock().Time(r.TimeStamp)
+}
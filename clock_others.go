@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "time"
+
+// monoSource counts nanoseconds since process start, it stands in for
+// QueryPerformanceCounter where there is none
+type monoSource struct{}
+
+var monoStart = time.Now()
+
+// SystemClockSource returns the ClockSource of the running system
+func SystemClockSource() ClockSource {
+	return monoSource{}
+}
+
+func (monoSource) Frequency() int64 {
+	return int64(time.Second)
+}
+
+func (monoSource) Now() (int64, time.Time) {
+	t := time.Now()
+	return int64(t.Sub(monoStart)), t
+}
@@ -0,0 +1,46 @@
+package windivert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewClock(&FixedClockSource{Freq: 10_000_000, Ticks: 1_000_000_000, Time: base})
+
+	for _, tt := range []struct {
+		ticks int64
+		want  time.Time
+	}{
+		{1_000_000_000, base},
+		{1_015_000_000, base.Add(1500 * time.Millisecond)},
+		{999_999_995, base.Add(-500 * time.Nanosecond)},
+	} {
+		if got := c.Time(tt.ticks); !got.Equal(tt.want) {
+			t.Errorf("Time(%d) = %v, want %v", tt.ticks, got, tt.want)
+		}
+		if got := c.Ticks(tt.want); got != tt.ticks {
+			t.Errorf("Ticks(%v) = %d, want %d", tt.want, got, tt.ticks)
+		}
+	}
+
+	if got := c.Duration(3); got != 300*time.Nanosecond {
+		t.Errorf("Duration(3) = %v", got)
+	}
+	if got := c.Frequency(); got != 10_000_000 {
+		t.Errorf("Frequency() = %d", got)
+	}
+}
+
+func TestClockCalibrate(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	src := &FixedClockSource{Freq: 1000, Ticks: 0, Time: base}
+	c := NewClock(src)
+
+	src.Ticks, src.Time = 5000, base.Add(time.Hour)
+	c.Calibrate()
+	if got := c.Time(5000); !got.Equal(base.Add(time.Hour)) {
+		t.Errorf("Time after Calibrate = %v", got)
+	}
+}
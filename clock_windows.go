@@ -0,0 +1,41 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procQueryPerformanceCounter   = modkernel32.NewProc("QueryPerformanceCounter")
+	procQueryPerformanceFrequency = modkernel32.NewProc("QueryPerformanceFrequency")
+)
+
+// qpcSource reads QueryPerformanceCounter, the counter WinDivert stamps
+// addresses with
+type qpcSource struct{}
+
+// SystemClockSource returns the ClockSource of the running system
+func SystemClockSource() ClockSource {
+	return qpcSource{}
+}
+
+func (qpcSource) Frequency() int64 {
+	freq := int64(0)
+	procQueryPerformanceFrequency.Call(uintptr(unsafe.Pointer(&freq)))
+	return freq
+}
+
+// Now reads the counter twice around the wall clock and takes the midpoint
+func (qpcSource) Now() (int64, time.Time) {
+	t0, t1 := int64(0), int64(0)
+	procQueryPerformanceCounter.Call(uintptr(unsafe.Pointer(&t0)))
+	t := time.Now()
+	procQueryPerformanceCounter.Call(uintptr(unsafe.Pointer(&t1)))
+	return t0 + (t1-t0)/2, t
+}
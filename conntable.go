@@ -0,0 +1,198 @@
+package windivert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// TCPState is the state of a TCP connection as reported by IP Helper
+type TCPState uint32
+
+const (
+	TCPStateClosed TCPState = iota + 1
+	TCPStateListen
+	TCPStateSynSent
+	TCPStateSynReceived
+	TCPStateEstablished
+	TCPStateFinWait1
+	TCPStateFinWait2
+	TCPStateCloseWait
+	TCPStateClosing
+	TCPStateLastAck
+	TCPStateTimeWait
+	TCPStateDeleteTCB
+)
+
+var tcpStateNames = [...]string{
+	"CLOSED",
+	"LISTEN",
+	"SYN_SENT",
+	"SYN_RCVD",
+	"ESTABLISHED",
+	"FIN_WAIT1",
+	"FIN_WAIT2",
+	"CLOSE_WAIT",
+	"CLOSING",
+	"LAST_ACK",
+	"TIME_WAIT",
+	"DELETE_TCB",
+}
+
+// String returns the name of the state, the number of an unknown state or
+// an empty string for no state
+func (s TCPState) String() string {
+	switch {
+	case s == 0:
+		return ""
+	case s > TCPStateDeleteTCB:
+		return strconv.FormatUint(uint64(s), 10)
+	}
+	return tcpStateNames[s-1]
+}
+
+func (s TCPState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *TCPState) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*s = 0
+		return nil
+	}
+	for i, name := range tcpStateNames {
+		if name == string(b) {
+			*s = TCPState(i + 1)
+			return nil
+		}
+	}
+
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid tcp state %q", b)
+	}
+	*s = TCPState(n)
+	return nil
+}
+
+// ConnEntry is a row of a connection table. UDP entries have no remote
+// endpoint and no state.
+type ConnEntry struct {
+	Protocol uint8          `json:"protocol"`
+	Local    netip.AddrPort `json:"local"`
+	Remote   netip.AddrPort `json:"remote"`
+	State    TCPState       `json:"state,omitempty"`
+	PID      uint32         `json:"pid"`
+	// Created is when the connection or endpoint was created, zero when
+	// not known
+	Created time.Time `json:"created"`
+	// Module and ModulePath name the module owning the entry, they are
+	// only filled in when asked for
+	Module     string `json:"module,omitempty"`
+	ModulePath string `json:"modulePath,omitempty"`
+}
+
+// ConnTable lists the connections of the system
+type ConnTable interface {
+	// Connections returns the TCP or UDP, IPv4 or IPv6 table
+	Connections(proto uint8, ipv6 bool) ([]ConnEntry, error)
+}
+
+// AllConnections returns the four tables of t one after the other
+func AllConnections(t ConnTable) ([]ConnEntry, error) {
+	es := []ConnEntry{}
+	for _, proto := range []uint8{iana.ProtocolTCP, iana.ProtocolUDP} {
+		for _, v6 := range []bool{false, true} {
+			e, err := t.Connections(proto, v6)
+			if err != nil {
+				return nil, err
+			}
+			es = append(es, e...)
+		}
+	}
+	return es, nil
+}
+
+// ConnectionsByPID returns the entries of the four tables of t owned by the
+// process pid
+func ConnectionsByPID(t ConnTable, pid uint32) ([]ConnEntry, error) {
+	cs, err := AllConnections(t)
+	if err != nil {
+		return nil, err
+	}
+
+	es := []ConnEntry{}
+	for _, c := range cs {
+		if c.PID == pid {
+			es = append(es, c)
+		}
+	}
+	return es, nil
+}
+
+// FakeConnTable is a ConnTable serving fixed entries, for tests
+type FakeConnTable struct {
+	Entries []ConnEntry
+}
+
+// LoadConnTable reads a fixture, a JSON array of entries
+func LoadConnTable(r io.Reader) (*FakeConnTable, error) {
+	t := &FakeConnTable{}
+	if err := json.NewDecoder(r).Decode(&t.Entries); err != nil {
+		return nil, fmt.Errorf("decode connection table error: %v", err)
+	}
+	return t, nil
+}
+
+func (t *FakeConnTable) Connections(proto uint8, ipv6 bool) ([]ConnEntry, error) {
+	es := []ConnEntry{}
+	for _, e := range t.Entries {
+		if e.Protocol == proto && e.Local.Addr().Is6() == ipv6 {
+			es = append(es, e)
+		}
+	}
+	return es, nil
+}
+
+// connTableSource lists flows from a ConnTable
+type connTableSource struct {
+	table ConnTable
+}
+
+// ConnTableFlowSource returns a FlowSource reading t
+func ConnTableFlowSource(t ConnTable) FlowSource {
+	return connTableSource{table: t}
+}
+
+// IPHelperFlowSource returns a FlowSource reading the connection tables of
+// the system
+func IPHelperFlowSource() FlowSource {
+	return ConnTableFlowSource(SystemConnTable(false))
+}
+
+func (s connTableSource) Flows() ([]FlowEntry, error) {
+	cs, err := AllConnections(s.table)
+	if err != nil {
+		return nil, err
+	}
+
+	es := make([]FlowEntry, 0, len(cs))
+	for _, c := range cs {
+		es = append(es, FlowEntry{
+			Tuple: FiveTuple{
+				Protocol: c.Protocol,
+				SrcAddr:  c.Local.Addr(),
+				DstAddr:  c.Remote.Addr(),
+				SrcPort:  c.Local.Port(),
+				DstPort:  c.Remote.Port(),
+			},
+			ProcessID: c.PID,
+		})
+	}
+	return es, nil
+}
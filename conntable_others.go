@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "errors"
+
+// emptyTable has no connections, there is no IP Helper to ask
+type emptyTable struct{}
+
+// SystemConnTable returns the ConnTable of the system
+func SystemConnTable(modules bool) ConnTable {
+	return emptyTable{}
+}
+
+func (emptyTable) Connections(proto uint8, ipv6 bool) ([]ConnEntry, error) {
+	return nil, errors.New("connection tables are only supported on windows")
+}
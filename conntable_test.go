@@ -0,0 +1,166 @@
+package windivert
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadTestConnTable(t *testing.T) *FakeConnTable {
+	t.Helper()
+	f, err := os.Open("testdata/conntable.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ct, err := LoadConnTable(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ct
+}
+
+func TestLoadConnTable(t *testing.T) {
+	ct := loadTestConnTable(t)
+	if len(ct.Entries) != 7 {
+		t.Fatalf("loaded %d entries", len(ct.Entries))
+	}
+
+	e := ct.Entries[0]
+	if e.Protocol != 6 || e.Local != testSrc4 || e.Remote != testDst4 || e.State != TCPStateEstablished || e.PID != 1200 ||
+		!e.Created.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) || e.Module != "app.exe" || e.ModulePath != `C:\Apps\app.exe` {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := ct.Entries[4]; e.State != 13 {
+		t.Errorf("unknown state = %v", e.State)
+	}
+	if e := ct.Entries[5]; e.State != 0 || e.Remote.IsValid() {
+		t.Errorf("udp entry = %+v", e)
+	}
+
+	for _, s := range []string{`{}`, `[{"state": "OPEN"}]`, `[{"local": "10.0.0.1"}]`} {
+		if _, err := LoadConnTable(strings.NewReader(s)); err == nil {
+			t.Errorf("LoadConnTable(%s) succeeded", s)
+		}
+	}
+}
+
+func TestFakeConnTable(t *testing.T) {
+	ct := loadTestConnTable(t)
+
+	for _, tt := range []struct {
+		proto uint8
+		ipv6  bool
+		ports []uint16
+	}{
+		{6, false, []uint16{40000, 40001, 445}},
+		{6, true, []uint16{40002, 135}},
+		{17, false, []uint16{5353}},
+		{17, true, []uint16{546}},
+		{1, false, nil},
+	} {
+		es, err := ct.Connections(tt.proto, tt.ipv6)
+		if err != nil || len(es) != len(tt.ports) {
+			t.Errorf("Connections(%d, %v) = %d entries, %v", tt.proto, tt.ipv6, len(es), err)
+			continue
+		}
+		for i, e := range es {
+			if e.Local.Port() != tt.ports[i] {
+				t.Errorf("Connections(%d, %v)[%d] = %v", tt.proto, tt.ipv6, i, e.Local)
+			}
+		}
+	}
+
+	all, err := AllConnections(ct)
+	if err != nil || len(all) != len(ct.Entries) {
+		t.Errorf("AllConnections = %d entries, %v", len(all), err)
+	}
+}
+
+func TestConnectionsByPID(t *testing.T) {
+	ct := loadTestConnTable(t)
+
+	for _, tt := range []struct {
+		pid   uint32
+		ports []uint16
+	}{
+		{1200, []uint16{40000, 40002}},
+		{4, []uint16{445}},
+		{1500, []uint16{5353}},
+		{9999, nil},
+	} {
+		es, err := ConnectionsByPID(ct, tt.pid)
+		if err != nil || len(es) != len(tt.ports) {
+			t.Errorf("pid %d: %d entries, %v", tt.pid, len(es), err)
+			continue
+		}
+		for i, e := range es {
+			if e.PID != tt.pid || e.Local.Port() != tt.ports[i] {
+				t.Errorf("pid %d: entry %+v", tt.pid, e)
+			}
+		}
+	}
+}
+
+func TestConnTableFlowSource(t *testing.T) {
+	ct := loadTestConnTable(t)
+	fs, err := ConnTableFlowSource(ct).Flows()
+	if err != nil || len(fs) != len(ct.Entries) {
+		t.Fatalf("Flows() = %d entries, %v", len(fs), err)
+	}
+	if fs[0].Tuple != testTuple(6, "10.0.0.1:40000", "93.184.216.34:443") || fs[0].ProcessID != 1200 {
+		t.Errorf("flow = %+v", fs[0])
+	}
+
+	tr := NewFlowTracker(ConnTableFlowSource(ct))
+	for _, tt := range []struct {
+		name          string
+		proto         uint8
+		local, remote string
+		pid           uint32
+		ok            bool
+	}{
+		{"exact", 6, "10.0.0.1:40000", "93.184.216.34:443", 1200, true},
+		{"v6", 6, "[2001:db8::1]:40002", "[2001:db8::2]:443", 1200, true},
+		{"listener", 6, "10.0.0.1:445", "10.0.0.9:50000", 4, true},
+		{"udp bound to any", 17, "10.0.0.1:5353", "224.0.0.251:5353", 1500, true},
+		{"udp v6 bound to any", 17, "[fe80::1]:546", "[ff02::1:2]:547", 1600, true},
+		{"other port", 6, "10.0.0.1:40005", "93.184.216.34:443", 0, false},
+		{"other protocol", 17, "10.0.0.1:445", "10.0.0.9:50000", 0, false},
+	} {
+		pid, ok := tr.Lookup(testTuple(tt.proto, tt.local, tt.remote))
+		if pid != tt.pid || ok != tt.ok {
+			t.Errorf("%s: Lookup = %d, %v, want %d, %v", tt.name, pid, ok, tt.pid, tt.ok)
+		}
+	}
+}
+
+func TestTCPStateText(t *testing.T) {
+	for s := TCPState(0); s <= TCPStateDeleteTCB+1; s++ {
+		b, err := s.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got TCPState
+		if err := got.UnmarshalText(b); err != nil || got != s {
+			t.Errorf("%d: %q unmarshals to %d, %v", s, b, got, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		s    TCPState
+		want string
+	}{
+		{0, ""},
+		{TCPStateListen, "LISTEN"},
+		{TCPStateEstablished, "ESTABLISHED"},
+		{TCPStateDeleteTCB, "DELETE_TCB"},
+		{13, "13"},
+	} {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("%d: String() = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
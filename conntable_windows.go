@@ -0,0 +1,132 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+	"github.com/sbilly/go-windivert2/internal/utils"
+)
+
+// ipHelperTable reads the extended tables of IP Helper
+type ipHelperTable struct {
+	modules bool
+}
+
+// SystemConnTable returns the ConnTable of the system. Looking up the owner
+// modules takes a call per entry and is only done when modules is set.
+func SystemConnTable(modules bool) ConnTable {
+	return ipHelperTable{modules: modules}
+}
+
+// rowPort converts a port as stored in a table row, in network byte order
+// in the low 16 bits
+func rowPort(p uint32) uint16 {
+	return uint16(p&0xff)<<8 | uint16(p>>8&0xff)
+}
+
+func rowAddr4(a uint32) netip.Addr {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], a)
+	return netip.AddrFrom4(b)
+}
+
+// rowTime converts a creation timestamp, a FILETIME
+func rowTime(ft int64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (ft-116444736000000000)*100)
+}
+
+func (t ipHelperTable) Connections(proto uint8, ipv6 bool) ([]ConnEntry, error) {
+	es := []ConnEntry{}
+
+	switch {
+	case proto == iana.ProtocolTCP && !ipv6:
+		rs, err := utils.GetExtendedTCPTable()
+		if err != nil {
+			return nil, err
+		}
+		for i := range rs {
+			r := &rs[i]
+			e := ConnEntry{
+				Protocol: proto,
+				Local:    netip.AddrPortFrom(rowAddr4(r.LocalAddr), rowPort(r.LocalPort)),
+				Remote:   netip.AddrPortFrom(rowAddr4(r.RemoteAddr), rowPort(r.RemotePort)),
+				State:    TCPState(r.State),
+				PID:      r.OwningPid,
+				Created:  rowTime(r.CreateTimestamp),
+			}
+			if t.modules {
+				e.Module, e.ModulePath, _ = r.Module()
+			}
+			es = append(es, e)
+		}
+	case proto == iana.ProtocolTCP && ipv6:
+		rs, err := utils.GetExtendedTCP6Table()
+		if err != nil {
+			return nil, err
+		}
+		for i := range rs {
+			r := &rs[i]
+			e := ConnEntry{
+				Protocol: proto,
+				Local:    netip.AddrPortFrom(netip.AddrFrom16(r.LocalAddr), rowPort(r.LocalPort)),
+				Remote:   netip.AddrPortFrom(netip.AddrFrom16(r.RemoteAddr), rowPort(r.RemotePort)),
+				State:    TCPState(r.State),
+				PID:      r.OwningPid,
+				Created:  rowTime(r.CreateTimestamp),
+			}
+			if t.modules {
+				e.Module, e.ModulePath, _ = r.Module()
+			}
+			es = append(es, e)
+		}
+	case proto == iana.ProtocolUDP && !ipv6:
+		rs, err := utils.GetExtendedUDPTable()
+		if err != nil {
+			return nil, err
+		}
+		for i := range rs {
+			r := &rs[i]
+			e := ConnEntry{
+				Protocol: proto,
+				Local:    netip.AddrPortFrom(rowAddr4(r.LocalAddr), rowPort(r.LocalPort)),
+				PID:      r.OwningPid,
+				Created:  rowTime(r.CreateTimestamp),
+			}
+			if t.modules {
+				e.Module, e.ModulePath, _ = r.Module()
+			}
+			es = append(es, e)
+		}
+	case proto == iana.ProtocolUDP && ipv6:
+		rs, err := utils.GetExtendedUDP6Table()
+		if err != nil {
+			return nil, err
+		}
+		for i := range rs {
+			r := &rs[i]
+			e := ConnEntry{
+				Protocol: proto,
+				Local:    netip.AddrPortFrom(netip.AddrFrom16(r.LocalAddr), rowPort(r.LocalPort)),
+				PID:      r.OwningPid,
+				Created:  rowTime(r.CreateTimestamp),
+			}
+			if t.modules {
+				e.Module, e.ModulePath, _ = r.Module()
+			}
+			es = append(es, e)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %d", proto)
+	}
+
+	return es, nil
+}
@@ -0,0 +1,375 @@
+package windivert
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// ConnState is the state of a tracked connection
+type ConnState uint8
+
+const (
+	// ConnSynSent is a TCP connection whose handshake is not complete
+	ConnSynSent ConnState = iota
+	// ConnEstablished is a TCP connection passing data, or any UDP flow
+	ConnEstablished
+	// ConnFinWait is a TCP connection closed in one direction
+	ConnFinWait
+	// ConnTimeWait is a TCP connection closed in both directions
+	ConnTimeWait
+	// ConnReset is a TCP connection that has been reset
+	ConnReset
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnSynSent:
+		return "SYN_SENT"
+	case ConnEstablished:
+		return "ESTABLISHED"
+	case ConnFinWait:
+		return "FIN_WAIT"
+	case ConnTimeWait:
+		return "TIME_WAIT"
+	case ConnReset:
+		return "RST"
+	default:
+		return ""
+	}
+}
+
+// ConnTimeouts are the idle timeouts of each state
+type ConnTimeouts struct {
+	SynSent     time.Duration
+	Established time.Duration
+	FinWait     time.Duration
+	TimeWait    time.Duration
+	Reset       time.Duration
+	UDP         time.Duration
+}
+
+// ConnTimeoutsDefault are the timeouts used by NewConnTrack
+var ConnTimeoutsDefault = ConnTimeouts{
+	SynSent:     2 * time.Minute,
+	Established: 2 * time.Hour,
+	FinWait:     2 * time.Minute,
+	TimeWait:    2 * time.Minute,
+	Reset:       10 * time.Second,
+	UDP:         time.Minute,
+}
+
+const (
+	// ConnMaxEntriesDefault bounds the number of tracked connections
+	ConnMaxEntriesDefault = 1 << 16
+
+	connWheelSlots = 512
+	connWheelTick  = time.Second
+)
+
+// Conn is a tracked connection
+type Conn struct {
+	// Tuple is the direction of the first packet seen
+	Tuple FiveTuple
+	State ConnState
+	// Verdict is the verdict taken on the first packet
+	Verdict Verdict
+	Packets uint64
+	Bytes   uint64
+	Created time.Time
+	Last    time.Time
+}
+
+type connEntry struct {
+	Conn
+	fin      [2]bool
+	deadline time.Time
+	fire     time.Time
+	slot     int
+	wheel    *list.Element
+	lru      *list.Element
+}
+
+// ConnTrack tracks connections by 5-tuple in both directions. Idle
+// connections expire on a timing wheel advanced by Advance and the least
+// recently used connection is evicted when MaxEntries is reached.
+type ConnTrack struct {
+	Timeouts   ConnTimeouts
+	MaxEntries int
+
+	mu      sync.Mutex
+	conns   map[FiveTuple]*connEntry
+	lru     *list.List
+	slots   [connWheelSlots]*list.List
+	pos     int
+	at      time.Time
+	evicted uint64
+	expired uint64
+}
+
+// NewConnTrack creates a table with the default timeouts and size limit
+func NewConnTrack() *ConnTrack {
+	c := &ConnTrack{
+		Timeouts:   ConnTimeoutsDefault,
+		MaxEntries: ConnMaxEntriesDefault,
+		conns:      make(map[FiveTuple]*connEntry),
+		lru:        list.New(),
+	}
+	for i := range c.slots {
+		c.slots[i] = list.New()
+	}
+	return c
+}
+
+// Len returns the number of tracked connections
+func (c *ConnTrack) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.conns)
+}
+
+// Evicted returns the number of connections evicted by the size limit
+func (c *ConnTrack) Evicted() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evicted
+}
+
+// Expired returns the number of connections that timed out
+func (c *ConnTrack) Expired() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired
+}
+
+// Conns returns a copy of the tracked connections, most recently used first
+func (c *ConnTrack) Conns() []Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cs := make([]Conn, 0, len(c.conns))
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		cs = append(cs, e.Value.(*connEntry).Conn)
+	}
+	return cs
+}
+
+// Lookup returns the connection t belongs to in either direction
+func (c *ConnTrack) Lookup(t FiveTuple) (Conn, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, _ := c.find(t); e != nil {
+		return e.Conn, true
+	}
+	return Conn{}, false
+}
+
+// Delete stops tracking the connection t belongs to
+func (c *ConnTrack) Delete(t FiveTuple) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, _ := c.find(t); e != nil {
+		c.remove(e)
+	}
+}
+
+// Track is TrackAt at the current time
+func (c *ConnTrack) Track(t FiveTuple, flags uint8, size int, decide func() Verdict) Verdict {
+	return c.TrackAt(t, flags, size, decide, time.Now())
+}
+
+// TrackAt accounts a packet of size bytes with TCP flags to the connection
+// of t and returns the verdict of the connection. decide is called without
+// the table locked to take the verdict of a new connection. A TCP SYN on a
+// closed connection starts a new one.
+func (c *ConnTrack) TrackAt(t FiveTuple, flags uint8, size int, decide func() Verdict, now time.Time) Verdict {
+	c.mu.Lock()
+	e, dir := c.find(t)
+	if e != nil && e.closed() && flags&(SYN|ACK) == SYN {
+		c.remove(e)
+		e = nil
+	}
+	if e != nil {
+		c.update(e, dir, flags, size, now)
+		v := e.Verdict
+		c.mu.Unlock()
+		return v
+	}
+	c.mu.Unlock()
+
+	v := decide()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another packet of the connection may have been tracked meanwhile
+	if e, dir := c.find(t); e != nil {
+		c.update(e, dir, flags, size, now)
+		return e.Verdict
+	}
+
+	e = &connEntry{Conn: Conn{Tuple: t, Verdict: v, Created: now}}
+	switch {
+	case t.Protocol != iana.ProtocolTCP:
+		e.State = ConnEstablished
+	case flags&(SYN|ACK) == SYN:
+		e.State = ConnSynSent
+	default:
+		e.State = ConnEstablished
+	}
+
+	if c.at.IsZero() {
+		c.at = now
+	}
+	for c.MaxEntries > 0 && len(c.conns) >= c.MaxEntries {
+		c.remove(c.lru.Back().Value.(*connEntry))
+		c.evicted++
+	}
+
+	c.conns[t] = e
+	e.lru = c.lru.PushFront(e)
+	c.update(e, 0, flags, size, now)
+	return v
+}
+
+// Advance is AdvanceAt at the current time
+func (c *ConnTrack) Advance() {
+	c.AdvanceAt(time.Now())
+}
+
+// AdvanceAt turns the timing wheel to now, expiring idle connections
+func (c *ConnTrack) AdvanceAt(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.at.IsZero() {
+		c.at = now
+		return
+	}
+
+	steps := int(now.Sub(c.at) / connWheelTick)
+	if steps <= 0 {
+		return
+	}
+	// a full turn visits every slot, skip the turns beyond that
+	if steps > connWheelSlots {
+		c.at = c.at.Add(time.Duration(steps-connWheelSlots) * connWheelTick)
+		steps = connWheelSlots
+	}
+
+	for i := 0; i < steps; i++ {
+		c.pos = (c.pos + 1) % connWheelSlots
+		c.at = c.at.Add(connWheelTick)
+
+		l := c.slots[c.pos]
+		for w := l.Front(); w != nil; {
+			next := w.Next()
+			e := w.Value.(*connEntry)
+			if !e.deadline.After(c.at) {
+				c.remove(e)
+				c.expired++
+			} else {
+				l.Remove(w)
+				c.schedule(e)
+			}
+			w = next
+		}
+	}
+}
+
+// find returns the connection of t and the direction of t in it
+func (c *ConnTrack) find(t FiveTuple) (*connEntry, int) {
+	if e, ok := c.conns[t]; ok {
+		return e, 0
+	}
+	if e, ok := c.conns[t.Reverse()]; ok {
+		return e, 1
+	}
+	return nil, 0
+}
+
+func (c *ConnTrack) remove(e *connEntry) {
+	delete(c.conns, e.Tuple)
+	c.lru.Remove(e.lru)
+	if e.wheel != nil {
+		c.slots[e.slot].Remove(e.wheel)
+	}
+}
+
+// schedule puts e in the slot of its deadline, or in the farthest slot when
+// the deadline is beyond a turn of the wheel
+func (c *ConnTrack) schedule(e *connEntry) {
+	ticks := int((e.deadline.Sub(c.at) + connWheelTick - 1) / connWheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	if ticks > connWheelSlots-1 {
+		ticks = connWheelSlots - 1
+	}
+
+	e.slot = (c.pos + ticks) % connWheelSlots
+	e.fire = c.at.Add(time.Duration(ticks) * connWheelTick)
+	e.wheel = c.slots[e.slot].PushBack(e)
+}
+
+// update runs the state machine and pushes the deadline of e back. The
+// entry stays in its slot unless the deadline moved before it.
+func (c *ConnTrack) update(e *connEntry, dir int, flags uint8, size int, now time.Time) {
+	if e.Tuple.Protocol == iana.ProtocolTCP {
+		switch {
+		case flags&RST == RST:
+			e.State = ConnReset
+		case e.State == ConnSynSent:
+			if flags&(SYN|ACK) == ACK {
+				e.State = ConnEstablished
+			}
+		case e.State == ConnEstablished || e.State == ConnFinWait:
+			if flags&FIN == FIN {
+				e.fin[dir] = true
+				e.State = ConnFinWait
+				if e.fin[0] && e.fin[1] {
+					e.State = ConnTimeWait
+				}
+			}
+		}
+	}
+
+	e.Packets++
+	e.Bytes += uint64(size)
+	e.Last = now
+	e.deadline = now.Add(c.timeout(e))
+	c.lru.MoveToFront(e.lru)
+
+	if e.wheel == nil {
+		c.schedule(e)
+	} else if e.deadline.Before(e.fire) {
+		c.slots[e.slot].Remove(e.wheel)
+		c.schedule(e)
+	}
+}
+
+func (c *ConnTrack) timeout(e *connEntry) time.Duration {
+	if e.Tuple.Protocol != iana.ProtocolTCP {
+		return c.Timeouts.UDP
+	}
+	switch e.State {
+	case ConnSynSent:
+		return c.Timeouts.SynSent
+	case ConnFinWait:
+		return c.Timeouts.FinWait
+	case ConnTimeWait:
+		return c.Timeouts.TimeWait
+	case ConnReset:
+		return c.Timeouts.Reset
+	default:
+		return c.Timeouts.Established
+	}
+}
+
+func (e *connEntry) closed() bool {
+	return e.State == ConnTimeWait || e.State == ConnReset
+}
@@ -0,0 +1,141 @@
+package windivert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnTrackStates(t *testing.T) {
+	out := testTuple(6, "10.0.0.1:40000", "1.1.1.1:443")
+	in := out.Reverse()
+
+	type packet struct {
+		t     FiveTuple
+		flags uint8
+	}
+	for _, tt := range []struct {
+		name    string
+		packets []packet
+		want    ConnState
+	}{
+		{"syn", []packet{{out, SYN}}, ConnSynSent},
+		{"syn ack", []packet{{out, SYN}, {in, SYN | ACK}}, ConnSynSent},
+		{"handshake", []packet{{out, SYN}, {in, SYN | ACK}, {out, ACK}}, ConnEstablished},
+		{"picked up midway", []packet{{in, ACK}}, ConnEstablished},
+		{"fin", []packet{{out, ACK}, {out, FIN | ACK}}, ConnFinWait},
+		{"fin twice one way", []packet{{out, ACK}, {out, FIN | ACK}, {out, FIN | ACK}}, ConnFinWait},
+		{"fin both ways", []packet{{out, ACK}, {out, FIN | ACK}, {in, FIN | ACK}}, ConnTimeWait},
+		{"rst", []packet{{out, SYN}, {in, RST}}, ConnReset},
+		{"syn after close", []packet{{out, ACK}, {in, RST}, {out, SYN}}, ConnSynSent},
+	} {
+		c := NewConnTrack()
+		now := time.Unix(1000, 0)
+		decided := 0
+		for _, p := range tt.packets {
+			c.TrackAt(p.t, p.flags, 60, func() Verdict { decided++; return VerdictPass }, now)
+		}
+
+		conn, ok := c.Lookup(in)
+		if !ok || conn.State != tt.want {
+			t.Errorf("%s: state = %v, %v, want %v", tt.name, conn.State, ok, tt.want)
+		}
+		if c.Len() != 1 {
+			t.Errorf("%s: Len() = %d", tt.name, c.Len())
+		}
+		if tt.name != "syn after close" && decided != 1 {
+			t.Errorf("%s: decided %d times", tt.name, decided)
+		}
+	}
+}
+
+func TestConnTrackVerdict(t *testing.T) {
+	c := NewConnTrack()
+	tu := testTuple(17, "10.0.0.1:5353", "8.8.8.8:53")
+	now := time.Unix(1000, 0)
+
+	if v := c.TrackAt(tu, 0, 100, func() Verdict { return VerdictDrop }, now); v != VerdictDrop {
+		t.Fatalf("verdict = %v", v)
+	}
+	if v := c.TrackAt(tu.Reverse(), 0, 200, func() Verdict { return VerdictPass }, now); v != VerdictDrop {
+		t.Errorf("reply verdict = %v", v)
+	}
+
+	conn, _ := c.Lookup(tu)
+	if conn.State != ConnEstablished || conn.Packets != 2 || conn.Bytes != 300 || conn.Tuple != tu {
+		t.Errorf("conn = %+v", conn)
+	}
+
+	c.Delete(tu.Reverse())
+	if _, ok := c.Lookup(tu); ok || c.Len() != 0 {
+		t.Error("connection not deleted")
+	}
+}
+
+func TestConnTrackExpiry(t *testing.T) {
+	c := NewConnTrack()
+	c.Timeouts.UDP = 10 * time.Second
+	c.Timeouts.Reset = 5 * time.Second
+	pass := func() Verdict { return VerdictPass }
+	t0 := time.Unix(1000, 0)
+
+	udp := testTuple(17, "10.0.0.1:5353", "8.8.8.8:53")
+	tcp := testTuple(6, "10.0.0.1:40000", "1.1.1.1:443")
+	long := testTuple(6, "10.0.0.1:40001", "1.1.1.1:443")
+	c.TrackAt(udp, 0, 60, pass, t0)
+	c.TrackAt(tcp, ACK, 60, pass, t0)
+	c.TrackAt(long, ACK, 60, pass, t0)
+
+	for _, tt := range []struct {
+		at      time.Duration
+		packet  *FiveTuple
+		flags   uint8
+		alive   []FiveTuple
+		expired uint64
+	}{
+		{at: 3 * time.Second, packet: &tcp, flags: RST, alive: []FiveTuple{udp, tcp, long}},
+		{at: 7 * time.Second, packet: &udp, alive: []FiveTuple{udp, tcp, long}},
+		{at: 8 * time.Second, alive: []FiveTuple{udp, long}, expired: 1},
+		{at: 16 * time.Second, alive: []FiveTuple{udp, long}, expired: 1},
+		{at: 17 * time.Second, alive: []FiveTuple{long}, expired: 2},
+		// beyond a turn of the wheel
+		{at: 2*time.Hour - time.Second, alive: []FiveTuple{long}, expired: 2},
+		{at: 2 * time.Hour, expired: 3},
+	} {
+		now := t0.Add(tt.at)
+		if tt.packet != nil {
+			c.TrackAt(*tt.packet, tt.flags, 60, pass, now)
+		}
+		c.AdvanceAt(now)
+
+		if c.Len() != len(tt.alive) || c.Expired() != tt.expired {
+			t.Errorf("at %v: Len() = %d, Expired() = %d", tt.at, c.Len(), c.Expired())
+		}
+		for _, a := range tt.alive {
+			if _, ok := c.Lookup(a); !ok {
+				t.Errorf("at %v: %v expired", tt.at, a)
+			}
+		}
+	}
+}
+
+func TestConnTrackEviction(t *testing.T) {
+	c := NewConnTrack()
+	c.MaxEntries = 2
+	pass := func() Verdict { return VerdictPass }
+	now := time.Unix(1000, 0)
+
+	a := testTuple(17, "10.0.0.1:1", "8.8.8.8:53")
+	b := testTuple(17, "10.0.0.1:2", "8.8.8.8:53")
+	d := testTuple(17, "10.0.0.1:3", "8.8.8.8:53")
+	c.TrackAt(a, 0, 60, pass, now)
+	c.TrackAt(b, 0, 60, pass, now)
+	c.TrackAt(a.Reverse(), 0, 60, pass, now)
+	c.TrackAt(d, 0, 60, pass, now)
+
+	if _, ok := c.Lookup(b); ok || c.Evicted() != 1 {
+		t.Errorf("least recently used not evicted, Evicted() = %d", c.Evicted())
+	}
+	if cs := c.Conns(); len(cs) != 2 || cs[0].Tuple != d || cs[1].Tuple != a {
+		t.Errorf("Conns() = %+v", cs)
+	}
+}
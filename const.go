@@ -45,6 +45,35 @@ const (
 	EventEthernetFrame   Event = 10
 )
 
+func (e Event) String() string {
+	switch e {
+	case EventNetworkPacket:
+		return "WINDIVERT_EVENT_NETWORK_PACKET"
+	case EventFlowEstablished:
+		return "WINDIVERT_EVENT_FLOW_ESTABLISHED"
+	case EventFlowDeleted:
+		return "WINDIVERT_EVENT_FLOW_DELETED"
+	case EventSocketBind:
+		return "WINDIVERT_EVENT_SOCKET_BIND"
+	case EventSocketConnect:
+		return "WINDIVERT_EVENT_SOCKET_CONNECT"
+	case EventSocketListen:
+		return "WINDIVERT_EVENT_SOCKET_LISTEN"
+	case EventSocketAccept:
+		return "WINDIVERT_EVENT_SOCKET_ACCEPT"
+	case EventSocketClose:
+		return "WINDIVERT_EVENT_SOCKET_CLOSE"
+	case EventReflectOpen:
+		return "WINDIVERT_EVENT_REFLECT_OPEN"
+	case EventReflectClose:
+		return "WINDIVERT_EVENT_REFLECT_CLOSE"
+	case EventEthernetFrame:
+		return "WINDIVERT_EVENT_ETHERNET_FRAME"
+	default:
+		return ""
+	}
+}
+
 // ShutdownType represents WinDivert shutdown types
 type ShutdownType uint32
 
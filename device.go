@@ -1,142 +1,661 @@
 package windivert
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
-	"golang.org/x/sys/windows"
 
 	"github.com/sbilly/go-windivert2/internal/iana"
 	"github.com/sbilly/go-windivert2/internal/utils"
 )
 
-var (
-	ErrNoData          = windows.WSAEWOULDBLOCK
-	ErrHostUnreachable = windows.WSAEHOSTUNREACH
-)
-
-// Device represents a WinDivert handle
+// Device represents a WinDivert handle. The handle is replaced when the
+// device moves to another interface, the methods of Device always go to the
+// current one.
 type Device struct {
-	*Address
 	*io.PipeReader
 	*io.PipeWriter
 	*utils.AppFilter
 	*utils.IPFilter
-	*Handle
-	TCP    [65536]uint8
-	UDP    [65536]uint8
-	TCP6   [65536]uint8
-	UDP6   [65536]uint8
+	Conns  *ConnTrack
+	Flows  *FlowTracker
+	Apps   *AppRules
+	frags  fragVerdicts
+	policy atomic.Value
+	ctx    context.Context
+	cancel context.CancelFunc
 	active chan struct{}
 	event  chan struct{}
+
+	deviceLife
+	draining chan struct{}
+	flushed  chan struct{}
+
+	// mtu is selected again on every interface unless mtuOpt is set
+	mtu    atomic.Int64
+	mtuOpt int
+	outMu  sync.Mutex
+	out    io.Writer
+
+	// hmu guards hd, addr and iface, which change when the device moves to
+	// another interface
+	hmu     sync.RWMutex
+	hd      *Handle
+	addr    Address
+	iface   Interface
+	open    func(filter string, i *Interface, all bool, bypass []netip.Prefix) (*Handle, error)
+	filter  string
+	all     bool
+	bypass  *IPSet
+	subMu   sync.Mutex
+	ifSubs  map[int]func(InterfaceEvent)
+	dnsSubs map[int]DNSObserver
+	dnsN    atomic.Int32
+	nextSub int
+
+	stats  deviceStats
+	acct   atomic.Pointer[Accountant]
+	acctCh chan accountRecord
+
+	shMu     sync.Mutex
+	shaper   atomic.Pointer[Shaper]
+	shCancel context.CancelFunc
+}
+
+// DeviceOptions configures a Device
+type DeviceOptions struct {
+	// MTU is the largest packet written to the interface, larger packets
+	// passed to Write are fragmented, or answered with an ICMP fragmentation
+	// needed or packet too big message when they may not be. Zero means the
+	// MTU of the interface, or MTUDefault when it is not usable.
+	MTU int
+	// Interfaces lists the interfaces to choose from, nil means
+	// SystemInterfaces
+	Interfaces InterfaceSource
+	// Interface is the interface packets are diverted on and injected
+	// into, nil means the interface of the default route
+	Interface *Interface
+	// AllInterfaces diverts packets on every interface, packets written to
+	// the device are still injected into Interface
+	AllInterfaces bool
+	// FollowDefaultRoute moves the device to the interface of the default
+	// route whenever it changes, Interface must be nil
+	FollowDefaultRoute bool
+	// Bypass are the networks whose traffic is never diverted, they are
+	// left out by the filter of the handle and passed before the policy is
+	// asked. Nil means DefaultBypass, an empty slice bypasses nothing.
+	Bypass []netip.Prefix
+	// Proxies are the addresses of the proxy servers the diverted traffic
+	// is sent to, they are bypassed so the device never diverts its own
+	// traffic
+	Proxies []netip.Addr
+}
+
+// bypassSet returns the networks bypassed by the options
+func (o *DeviceOptions) bypassSet() *IPSet {
+	ps := o.Bypass
+	if ps == nil {
+		ps = DefaultBypass()
+	}
+	s := NewIPSet(VerdictPass, ps...)
+	for _, a := range o.Proxies {
+		a = a.Unmap()
+		s.Add(netip.PrefixFrom(a, a.BitLen()))
+	}
+	return s
+}
+
+// SelectInterface returns the interface chosen by the options
+func (o *DeviceOptions) SelectInterface() (Interface, error) {
+	if o.Interface != nil {
+		return *o.Interface, nil
+	}
+
+	src := o.Interfaces
+	if src == nil {
+		src = SystemInterfaces()
+	}
+	ifs, err := src.Interfaces()
+	if err != nil {
+		return Interface{}, err
+	}
+	return DefaultInterface(ifs)
+}
+
+// selectMTU returns the MTU of a device on interface i
+func (o *DeviceOptions) selectMTU(i *Interface) (int, error) {
+	switch {
+	case o.MTU == 0 && i.MTU >= MTUMin && i.MTU <= MTUMax:
+		return i.MTU, nil
+	case o.MTU == 0:
+		return MTUDefault, nil
+	case o.MTU < MTUMin || o.MTU > MTUMax:
+		return 0, fmt.Errorf("invalid mtu %d", o.MTU)
+	default:
+		return o.MTU, nil
+	}
+}
+
+const (
+	// MTUDefault is the MTU of a Device when none is set
+	MTUDefault = 1500
+	// MTUMin is the smallest MTU of a Device, the IPv6 minimum link MTU
+	MTUMin = 1280
+)
+
+// PacketTooBigError is returned by Write for a packet larger than the MTU
+// that may not be fragmented while no WriteTo runs to deliver the ICMP
+// message back to its sender
+type PacketTooBigError struct {
+	MTU int
+	// Message is the ICMP fragmentation needed or ICMPv6 packet too big
+	// message for the packet
+	Message []byte
+}
+
+func (e *PacketTooBigError) Error() string {
+	return fmt.Sprintf("packet exceeds mtu %d", e.MTU)
+}
+
+// deviceDrainTimeout bounds the time Close waits for written packets to be
+// sent
+const deviceDrainTimeout = time.Second
+
+// NewDevice is NewDeviceWithOptions with the default options
+func NewDevice(filter string) (*Device, error) {
+	return NewDeviceWithOptions(filter, nil)
 }
 
-func NewDevice(filter string) (dev *Device, err error) {
+// NewDeviceWithOptions opens a Device diverting the packets matching
+// filter, opts may be nil
+func NewDeviceWithOptions(filter string, opts *DeviceOptions) (dev *Device, err error) {
+	if opts == nil {
+		opts = &DeviceOptions{}
+	}
+
 	CloseWhenError := func(hd *Handle) {
 		if err != nil {
 			hd.Close()
 		}
 	}
 
-	ifIdx, subIfIdx, er := GetInterfaceIndex()
+	iface, er := opts.SelectInterface()
+	if er != nil {
+		err = fmt.Errorf("select interface error: %v", er)
+		return
+	}
+	mtu, er := opts.selectMTU(&iface)
 	if er != nil {
 		err = er
 		return
 	}
 
-	filter = fmt.Sprintf("ifIdx = %d and ", ifIdx) + filter
-	hd, er := Open(filter, LayerNetwork, PriorityDefault, FlagDefault)
+	bypass := opts.bypassSet()
+	hd, er := openDeviceHandle(filter, &iface, opts.AllInterfaces, bypass.Prefixes())
 	if er != nil {
-		err = fmt.Errorf("open handle error: %v", er)
+		err = er
 		return
 	}
 	defer CloseWhenError(hd)
 
-	if er := hd.SetParam(QueueLength, QueueLengthMax); er != nil {
-		err = fmt.Errorf("set handle parameter queue length error %v", er)
-		return
-	}
-	if er := hd.SetParam(QueueTime, QueueTimeMax); er != nil {
-		err = fmt.Errorf("set handle parameter queue time error %v", er)
-		return
-	}
-	if er := hd.SetParam(QueueSize, QueueSizeMax); er != nil {
-		err = fmt.Errorf("set handle parameter queue size error %v", er)
-		return
-	}
+	ctx, cancel := context.WithCancel(context.Background())
 
 	r, w := io.Pipe()
 	dev = &Device{
-		Address:    new(Address),
 		PipeReader: r,
 		PipeWriter: w,
 		AppFilter:  utils.NewAppFilter(),
 		IPFilter:   utils.NewIPFilter(),
-		Handle:     hd,
+		Conns:      NewConnTrack(),
+		Flows:      NewFlowTracker(IPHelperFlowSource()),
+		Apps:       NewAppRules(NewProcessCache(SystemProcessResolver())),
+		ctx:        ctx,
+		cancel:     cancel,
 		active:     make(chan struct{}),
 		event:      make(chan struct{}, 1),
+		deviceLife: newDeviceLife(),
+		draining:   make(chan struct{}),
+		flushed:    make(chan struct{}),
+		mtuOpt:     opts.MTU,
+		hd:         hd,
+		addr:       *NewInboundAddress(iface.Index, iface.SubIndex),
+		iface:      iface,
+		open:       openDeviceHandle,
+		filter:     filter,
+		all:        opts.AllInterfaces,
+		bypass:     bypass,
+		ifSubs:     make(map[int]func(InterfaceEvent)),
+		dnsSubs:    make(map[int]DNSObserver),
+		acctCh:     make(chan accountRecord, accountQueueLength),
 	}
 
+	dev.mtu.Store(int64(mtu))
+	dev.SetPolicy(nil)
+
+	if opts.FollowDefaultRoute && opts.Interface == nil {
+		src := opts.Interfaces
+		if src == nil {
+			src = SystemInterfaces()
+		}
+		iw := NewInterfaceWatcher(src)
+		iw.current, iw.known = iface, true
+		iw.Subscribe(func(ev InterfaceEvent) {
+			if err := dev.SwitchInterface(ev.New); err != nil {
+				dev.report(fmt.Errorf("switch interface error: %w", err))
+			}
+		})
+		go iw.Run(ctx, dev.report)
+	}
+
+	// without the flow layer lookups fall back to IP Helper
+	go func() {
+		if err := dev.Flows.Run(ctx); err != nil && ctx.Err() == nil {
+			dev.report(fmt.Errorf("flow tracker error: %w", err))
+		}
+	}()
 	go dev.writeLoop()
+	go dev.connLoop()
+	go dev.accountLoop()
 
-	nw := dev.Address.Network()
-	nw.InterfaceIndex = ifIdx
-	nw.SubInterfaceIndex = subIfIdx
+	dev.setState(DeviceRunning, nil)
 
 	return
 }
 
+// openDeviceHandle opens the handle of a device on interface i, leaving
+// out the traffic of the bypassed networks
+func openDeviceHandle(filter string, i *Interface, all bool, bypass []netip.Prefix) (*Handle, error) {
+	filter = "(" + filter + ")"
+	if !all {
+		filter = fmt.Sprintf("ifIdx = %d and %s", i.Index, filter)
+	}
+	if len(bypass) > 0 {
+		filter += " and not (" + BypassFilter(bypass) + ")"
+	}
+	// WinDivertOpen fails with a bare invalid parameter error otherwise
+	if n, err := FilterObjects(filter); err == nil && n > FilterObjectsMax {
+		return nil, fmt.Errorf("open handle error: %w: %d objects with %d bypassed networks, at most %d", ErrFilterTooLong, n, len(bypass), FilterObjectsMax)
+	}
+	hd, err := Open(filter, LayerNetwork, PriorityDefault, FlagDefault)
+	if err != nil {
+		return nil, fmt.Errorf("open handle error: %v", err)
+	}
+
+	if err := hd.SetParam(QueueLength, QueueLengthMax); err != nil {
+		hd.Close()
+		return nil, fmt.Errorf("set handle parameter queue length error %v", err)
+	}
+	if err := hd.SetParam(QueueTime, QueueTimeMax); err != nil {
+		hd.Close()
+		return nil, fmt.Errorf("set handle parameter queue time error %v", err)
+	}
+	if err := hd.SetParam(QueueSize, QueueSizeMax); err != nil {
+		hd.Close()
+		return nil, fmt.Errorf("set handle parameter queue size error %v", err)
+	}
+	return hd, nil
+}
+
+// handle returns the current handle
+func (d *Device) handle() *Handle {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.hd
+}
+
+// injector returns the current handle and the address packets written to
+// the device are injected with
+func (d *Device) injector() (*Handle, Address) {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.hd, d.addr
+}
+
+// Address returns the address packets written to the device are injected
+// with
+func (d *Device) Address() Address {
+	_, a := d.injector()
+	return a
+}
+
+// Recv receives a packet from the current handle. A Recv running while the
+// device moves to another interface fails once the handle it reads is shut
+// down.
+func (d *Device) Recv(packet []byte, addr *Address) (uint, error) {
+	return d.handle().Recv(packet, addr)
+}
+
+// RecvEx is Recv for a batch of packets
+func (d *Device) RecvEx(packets [][]byte, addrs []Address, flags uint64) (uint, uint, error) {
+	return d.handle().RecvEx(packets, addrs, flags)
+}
+
+// Send sends a packet through the current handle
+func (d *Device) Send(packet []byte, addr *Address) (uint, error) {
+	return d.SendEx([][]byte{packet}, []Address{*addr}, 0)
+}
+
+// SendEx sends a batch of packets through the current handle
+func (d *Device) SendEx(packets [][]byte, addrs []Address, flags uint64) (uint, error) {
+	hd := d.handle()
+	hd.Lock()
+	defer hd.Unlock()
+	return hd.SendEx(packets, addrs, flags)
+}
+
+// SetParam sets a parameter of the current handle. The handle opened when
+// the device moves has the parameters set by NewDevice.
+func (d *Device) SetParam(param Param, value uint64) error {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.hd.SetParam(param, value)
+}
+
+// GetParam returns a parameter of the current handle
+func (d *Device) GetParam(param Param) (uint64, error) {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.hd.GetParam(param)
+}
+
+// Shutdown shuts down the current handle, Close shuts it down and closes
+// the device
+func (d *Device) Shutdown(how ShutdownType) error {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.hd.Shutdown(how)
+}
+
+// SwitchInterface moves the device to interface i. A new handle is opened,
+// packets still queued on the old one are read by WriteTo until it is
+// closed after deviceDrainTimeout. The MTU is that of i unless one was set
+// with the options.
+func (d *Device) SwitchInterface(i Interface) error {
+	mtu, err := (&DeviceOptions{MTU: d.mtuOpt}).selectMTU(&i)
+	if err != nil {
+		return err
+	}
+
+	var hd *Handle
+	if !d.all {
+		h, err := d.open(d.filter, &i, false, d.bypass.Prefixes())
+		if err != nil {
+			return err
+		}
+		hd = h
+	}
+
+	d.hmu.Lock()
+	if d.State() >= DeviceDraining {
+		d.hmu.Unlock()
+		if hd != nil {
+			hd.Close()
+		}
+		return ErrDeviceClosed
+	}
+	// the subIfIdx learnt holds until the packets tell otherwise
+	if i.Index == d.iface.Index && i.SubIndex == 0 {
+		i.SubIndex = d.iface.SubIndex
+	}
+	old, ev := d.hd, InterfaceEvent{Old: d.iface, New: i}
+	if hd != nil {
+		d.hd = hd
+	}
+	d.addr = *NewInboundAddress(i.Index, i.SubIndex)
+	d.iface = i
+	d.mtu.Store(int64(mtu))
+	d.hmu.Unlock()
+
+	if hd != nil {
+		old.Shutdown(ShutdownRecv)
+		time.AfterFunc(deviceDrainTimeout, func() { old.Close() })
+	}
+
+	d.subMu.Lock()
+	subs := make([]func(InterfaceEvent), 0, len(d.ifSubs))
+	for _, fn := range d.ifSubs {
+		subs = append(subs, fn)
+	}
+	d.subMu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+	return nil
+}
+
+// learnSubIndex takes the subIfIdx of the interface the device is on from
+// the address of a packet received on it, IP Helper does not know it
+func (d *Device) learnSubIndex(a *Address) {
+	nw := a.Network()
+
+	d.hmu.Lock()
+	defer d.hmu.Unlock()
+	if d.iface.Index == nw.InterfaceIndex && d.iface.SubIndex != nw.SubInterfaceIndex {
+		d.iface.SubIndex = nw.SubInterfaceIndex
+		d.addr = *NewInboundAddress(d.iface.Index, d.iface.SubIndex)
+	}
+}
+
+// Bypass returns the networks whose traffic is never diverted. Networks
+// added are passed by the device at once and left out by the filter of the
+// next handle opened.
+func (d *Device) Bypass() *IPSet {
+	return d.bypass
+}
+
+// SubscribeInterface calls fn every time the device moves to another
+// interface until cancel is called. fn must not block.
+func (d *Device) SubscribeInterface(fn func(InterfaceEvent)) (cancel func()) {
+	d.subMu.Lock()
+	id := d.nextSub
+	d.nextSub++
+	d.ifSubs[id] = fn
+	d.subMu.Unlock()
+
+	return func() {
+		d.subMu.Lock()
+		delete(d.ifSubs, id)
+		d.subMu.Unlock()
+	}
+}
+
+// ObserveDNS passes o the DNS responses received by the device and those
+// written to it, from UDP port 53, until cancel is called. A DomainSet in
+// the policy learns the addresses of its domains this way. o must not
+// block.
+func (d *Device) ObserveDNS(o DNSObserver) (cancel func()) {
+	d.subMu.Lock()
+	id := d.nextSub
+	d.nextSub++
+	d.dnsSubs[id] = o
+	d.dnsN.Store(int32(len(d.dnsSubs)))
+	d.subMu.Unlock()
+
+	return func() {
+		d.subMu.Lock()
+		delete(d.dnsSubs, id)
+		d.dnsN.Store(int32(len(d.dnsSubs)))
+		d.subMu.Unlock()
+	}
+}
+
+// observeDNS passes packet b to the DNS observers when it is a DNS response
+func (d *Device) observeDNS(b []byte) {
+	if d.dnsN.Load() == 0 {
+		return
+	}
+	t, off, err := parseTransport(b)
+	if err != nil || t.Protocol != iana.ProtocolUDP || t.SrcPort != 53 || len(b) < off+8 {
+		return
+	}
+
+	d.subMu.Lock()
+	obs := make([]DNSObserver, 0, len(d.dnsSubs))
+	for _, o := range d.dnsSubs {
+		obs = append(obs, o)
+	}
+	d.subMu.Unlock()
+
+	// messages the observers cannot parse are not the device's concern
+	for _, o := range obs {
+		o.ObserveDNS(b[off+8:])
+	}
+}
+
+// Close sends the packets already written and closes the device
 func (d *Device) Close() error {
-	select {
-	case <-d.active:
+	return d.closeWith(ErrDeviceClosed)
+}
+
+// closeWith closes the device, err is what Err returns afterwards
+func (d *Device) closeWith(err error) error {
+	if !d.setState(DeviceDraining, nil) {
+		<-d.Done()
 		return nil
-	default:
-		close(d.active)
 	}
-	defer d.Handle.Close()
+
+	close(d.draining)
+	select {
+	case <-d.flushed:
+	case <-time.After(deviceDrainTimeout):
+	}
+
+	close(d.active)
+	d.cancel()
 
 	d.PipeReader.Close()
 	d.PipeWriter.Close()
 
-	if err := d.Handle.Shutdown(ShutdownBoth); err != nil {
-		return fmt.Errorf("shutdown handle error: %v", err)
+	defer d.setState(DeviceClosed, err)
+
+	hd, _ := d.injector()
+	if er := hd.Shutdown(ShutdownBoth); er != nil {
+		hd.Close()
+		return fmt.Errorf("shutdown handle error: %v", er)
 	}
 
-	if err := d.Handle.Close(); err != nil {
-		return fmt.Errorf("close handle error: %v", err)
+	if er := hd.Close(); er != nil {
+		return fmt.Errorf("close handle error: %v", er)
 	}
 
 	return nil
 }
 
+// fail reports err and closes the device with it
+func (d *Device) fail(err error) {
+	d.report(err)
+	go d.closeWith(err)
+}
+
+// batchSender sends batches of packets, it is a Handle but in tests
+type batchSender interface {
+	Lock()
+	Unlock()
+	SendEx(packets [][]byte, addrs []Address, flags uint64) (uint, error)
+}
+
+// send sends a batch of packets. Transient errors are reported and retried,
+// the batch is dropped when they persist. Other errors close the device.
+func (d *Device) send(hd batchSender, b []byte, a []Address) error {
+	delay := deviceRetryDelay
+	for i := 0; ; i++ {
+		hd.Lock()
+		_, err := hd.SendEx([][]byte{b}, a, 0)
+		hd.Unlock()
+
+		if err == nil {
+			return nil
+		}
+		// the handle is shut down once drained
+		select {
+		case <-d.active:
+			d.stats.sendErrors.Add(1)
+			return err
+		default:
+		}
+
+		if IsTransient(err) && i < deviceRetries && !errors.Is(err, ErrHostUnreachable) {
+			d.stats.sendRetries.Add(1)
+			d.report(err)
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		d.stats.sendErrors.Add(1)
+		switch {
+		case errors.Is(err, ErrHostUnreachable):
+			// retrying does not make the destination reachable
+			d.report(err)
+			return nil
+		case IsTransient(err):
+			d.report(fmt.Errorf("drop batch of %d packets: %w", len(a), err))
+			return nil
+		default:
+			d.fail(err)
+			return err
+		}
+	}
+}
+
+// WriteTo writes the diverted packets to w until the device is closed or
+// fails. It returns when w fails, after the other packets of the batch are
+// passed, the device stays open and WriteTo may be called again.
 func (d *Device) WriteTo(w io.Writer) (n int64, err error) {
 	a := make([]Address, BatchMax)
-	b := make([]byte, 1500*BatchMax)
+	// a batch of packets of the MTU, and a packet of any size
+	b := make([]byte, max(MTUMax, d.MTU()*BatchMax))
 
-	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5) | uint8(0x01<<3)
+	d.outMu.Lock()
+	d.out = w
+	d.outMu.Unlock()
+	defer func() {
+		d.outMu.Lock()
+		d.out = nil
+		d.outMu.Unlock()
+	}()
+
+	const f = AddressUDPChecksum | AddressTCPChecksum | AddressIPChecksum | AddressImpostor
 
 	for {
 		var (
 			nr, nx uint
 			er     error
+			// werr is the error of w, the packets diverted after it
+			// failed are dropped
+			werr error
 		)
 
-		nr32, nx32, er := d.Handle.RecvEx([][]byte{b}, a[:1], 0)
+		hd, tmpl := d.injector()
+		nr32, nx32, er := hd.RecvEx([][]byte{b}, a, 0)
 		nr = uint(nr32)
 		nx = uint(nx32)
 		if er != nil {
-			select {
-			case <-d.active:
+			switch {
+			case d.State() >= DeviceDraining:
+			case hd != d.handle():
+				// the device moved to another interface
+				continue
+			case IsTransient(er):
+				d.stats.recvErrors.Add(1)
+				d.report(er)
+				continue
 			default:
-				if er != ErrNoData {
-					err = fmt.Errorf("RecvEx in WriteTo error: %v", er)
-				}
+				d.stats.recvErrors.Add(1)
+				err = fmt.Errorf("RecvEx in WriteTo error: %w", er)
+				d.fail(err)
 			}
 			return
 		}
@@ -149,69 +668,111 @@ func (d *Device) WriteTo(w io.Writer) (n int64, err error) {
 
 		bb := b[:nr]
 		for i := uint(0); i < nx; i++ {
-			switch bb[0] >> 4 {
-			case ipv4.Version:
-				l := int(bb[2])<<8 | int(bb[3])
-
-				if d.CheckIPv4(bb) {
-					_, er := w.Write(bb[:l])
-					if er != nil {
-						select {
-						case <-d.active:
-						default:
-							err = fmt.Errorf("Write in WriteTo error: %v", er)
-						}
-
-						return
-					}
-
-					a[i].Flags |= f
+			l, ttl, er := batchPacket(bb)
+			if er != nil {
+				err = er
+				return
+			}
 
-					bb[8] = 0
-				}
+			if nw := a[i].Network(); nw.InterfaceIndex == tmpl.Network().InterfaceIndex && nw.SubInterfaceIndex != tmpl.Network().SubInterfaceIndex {
+				d.learnSubIndex(&a[i])
+			}
 
-				bb = bb[l:]
-			case ipv6.Version:
-				l := int(bb[4])<<8 | int(bb[5]) + ipv6.HeaderLen
+			out := a[i].Outbound()
+			d.stats.count(statReceived, bb[:l], out)
+			if !out {
+				d.observeDNS(bb[:l])
+			}
 
-				if d.CheckIPv6(bb) {
-					_, er := w.Write(bb[:l])
-					if er != nil {
-						select {
-						case <-d.active:
-						default:
-							err = fmt.Errorf("Write in WriteTo error: %v", er)
-						}
+			v := d.Verdict(bb[:l], &a[i])
+			// the shaper sends its copy when the packet may go
+			sr := ShapePass
+			switch v {
+			case VerdictDivert:
+				sr = d.shape(bb[:l], &a[i], shapeDivert)
+			case VerdictPass:
+				sr = d.shape(bb[:l], &a[i], shapeInject)
+			}
+			if sr == ShapeDropped {
+				d.stats.count(statDropped, bb[:l], out)
+			} else {
+				d.stats.verdict(v, bb[:l], out)
+			}
 
-						return
-					}
+			switch v {
+			case VerdictDivert:
+				if sr != ShapeDropped {
+					d.account(bb[:l], out)
+				}
+				if sr == ShapePass && werr == nil {
+					d.outMu.Lock()
+					_, werr = w.Write(bb[:l])
+					d.outMu.Unlock()
+				}
 
+				a[i].Flags |= f
+				bb[ttl] = 0
+			case VerdictReject:
+				d.reject(bb[:l], &a[i])
+
+				a[i].Flags |= f
+				bb[ttl] = 0
+			case VerdictDrop:
+				a[i].Flags |= f
+				bb[ttl] = 0
+			case VerdictPass:
+				if sr != ShapePass {
 					a[i].Flags |= f
-
-					bb[7] = 0
+					bb[ttl] = 0
 				}
+			}
 
-				bb = bb[l:]
+			bb = bb[l:]
+		}
+		bb = b[:nr]
+
+		if er := d.send(hd, bb, a[:nx]); er != nil {
+			select {
+			case <-d.active:
 			default:
-				err = errors.New("invalid ip version")
-				return
+				err = fmt.Errorf("SendEx in WriteTo error: %w", er)
 			}
+			return
 		}
 
-		d.Handle.Lock()
-		_, er = d.Handle.SendEx([][]byte{bb}, a[:nx], 0)
-		d.Handle.Unlock()
-		if er != nil && er != ErrHostUnreachable {
+		if werr != nil {
 			select {
 			case <-d.active:
 			default:
-				err = fmt.Errorf("SendEx in WriteTo error: %v", er)
+				err = fmt.Errorf("Write in WriteTo error: %v", werr)
 			}
 			return
 		}
 	}
 }
 
+// batchPacket returns the length of the first packet of a batch and the
+// offset of its TTL or hop limit
+func batchPacket(b []byte) (l, ttl int, err error) {
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		l, ttl = int(b[2])<<8|int(b[3]), 8
+	case ipv6.Version:
+		l, ttl = int(b[4])<<8|int(b[5]), 7
+		// the header is added to a set payload length only
+		if l != 0 {
+			l += ipv6.HeaderLen
+		}
+	default:
+		return 0, 0, errors.New("invalid ip version")
+	}
+	// large segments from offload may leave the length unset
+	if l == 0 || l > len(b) {
+		l = len(b)
+	}
+	return l, ttl, nil
+}
+
 const (
 	FIN = 1 << 0
 	SYN = 1 << 1
@@ -223,306 +784,566 @@ const (
 	CWR = 1 << 7
 )
 
-func (d *Device) CheckIPv4(b []byte) bool {
-	switch b[9] {
-	case iana.ProtocolTCP:
-		p := uint32(b[ipv4.HeaderLen])<<8 | uint32(b[ipv4.HeaderLen+1])
-		switch d.TCP[p] {
-		case 0:
-			if b[ipv4.HeaderLen+13]&SYN != SYN {
-				d.TCP[p] = 1
-				return false
-			}
-
-			if d.IPFilter.Lookup(net.IP(b[16:20])) {
-				d.TCP[p] = 2
-				return true
-			}
+// SetPolicy sets the policy taking the verdict on new connections and
+// packets of other protocols, nil restores DefaultPolicy. Connections
+// already tracked keep their verdict.
+func (d *Device) SetPolicy(p Policy) {
+	if p == nil {
+		p = d.DefaultPolicy()
+	}
+	d.policy.Store(policyBox{p})
+}
 
-			if d.CheckTCP4(b) {
-				d.TCP[p] = 2
-				return true
-			}
+// Policy returns the policy of the device
+func (d *Device) Policy() Policy {
+	return d.policy.Load().(policyBox).Policy
+}
 
-			d.TCP[p] = 1
-			return false
-		case 1:
-			if b[ipv4.HeaderLen+13]&FIN == FIN {
-				d.TCP[p] = 0
-			}
+// DefaultPolicy diverts packets to addresses in the IPFilter, packets of
+// processes in the AppFilter or matching the Apps rules, DNS queries, and
+// passes everything else. The bypassed networks, LAN DNS servers among
+// them, never reach the policy.
+func (d *Device) DefaultPolicy() Policy {
+	return Chain(
+		ipFilterPolicy{f: d.IPFilter, v: VerdictDivert},
+		NewAppSet(VerdictDivert, d.AppFilter, d.Apps),
+		NewPortSet(VerdictDivert, iana.ProtocolUDP, 53),
+		Default(VerdictPass),
+	)
+}
 
-			return false
-		case 2:
-			if b[ipv4.HeaderLen+13]&FIN == FIN {
-				d.TCP[p] = 0
-			}
+// policyBox keeps the concrete type stored in the atomic.Value the same
+type policyBox struct {
+	Policy
+}
 
-			return true
+// Verdict returns the verdict on a packet received with addr, addr may be
+// nil. TCP and UDP packets follow the verdict taken on their connection and
+// fragments other than the first the one taken on the first fragment. The
+// verdict is never VerdictNone.
+func (d *Device) Verdict(b []byte, addr *Address) Verdict {
+	if _, off, ok := fragKeyOf(b); ok && off != 0 {
+		if v, found := d.frags.Lookup(b); found {
+			return v
 		}
-	case iana.ProtocolUDP:
-		p := uint32(b[ipv4.HeaderLen])<<8 | uint32(b[ipv4.HeaderLen+1])
-
-		switch d.UDP[p] {
-		case 0:
-			fn := func() { d.UDP[p] = 0 }
+		c := &PolicyContext{Packet: b, Address: addr, Tuple: fragmentTuple(b), flows: d.Flows}
+		if d.bypass.Contains(c.Remote()) {
+			return VerdictPass
+		}
+		return d.decide(c)
+	}
 
-			if d.IPFilter.Lookup(net.IP(b[16:20])) {
-				d.UDP[p] = 2
-				time.AfterFunc(time.Minute, fn)
-				return true
-			}
+	v := d.verdict(b, addr)
+	d.frags.Store(b, v)
+	return v
+}
 
-			if d.CheckUDP4(b) {
-				d.UDP[p] = 2
-				time.AfterFunc(time.Minute, fn)
-				return true
-			}
+func (d *Device) verdict(b []byte, addr *Address) Verdict {
+	t, off, err := parseTransport(b)
+	if err != nil {
+		return VerdictPass
+	}
+	c := &PolicyContext{Packet: b, Address: addr, Tuple: t, flows: d.Flows}
+	if d.bypass.Contains(c.Remote()) {
+		return VerdictPass
+	}
 
-			if (uint32(b[ipv4.HeaderLen+2])<<8 | uint32(b[ipv4.HeaderLen+3])) == 53 {
-				return true
-			}
+	switch t.Protocol {
+	case iana.ProtocolTCP, iana.ProtocolUDP:
+	default:
+		return d.decide(c)
+	}
 
-			d.UDP[p] = 1
-			time.AfterFunc(time.Minute, fn)
+	flags := uint8(0)
+	if t.Protocol == iana.ProtocolTCP && len(b) > off+13 {
+		flags = b[off+13]
+	}
 
-			return false
-		case 1:
-			return false
-		case 2:
-			return true
+	// connections whose SYN was missed are left alone
+	return d.Conns.Track(t, flags, len(b), func() Verdict {
+		if t.Protocol == iana.ProtocolTCP && flags&SYN != SYN {
+			return VerdictPass
 		}
-	default:
-		return d.IPFilter.Lookup(net.IP(b[16:20]))
-	}
+		return d.decide(c)
+	})
+}
+
+func (d *Device) decide(c *PolicyContext) Verdict {
+	start := time.Now()
+	v := d.Policy().Verdict(c)
+	d.stats.observe(time.Since(start))
 
-	return false
+	if v != VerdictNone {
+		return v
+	}
+	return VerdictPass
 }
 
-func (d *Device) CheckTCP4(b []byte) bool {
-	rs, err := utils.GetTCPTable()
+// reject answers a packet with a TCP reset or a port unreachable message
+func (d *Device) reject(b []byte, addr *Address) {
+	var (
+		p   []byte
+		ra  *Address
+		err error
+	)
+	if t, _, er := parseTransport(b); er == nil && t.Protocol == iana.ProtocolTCP {
+		p, ra, err = RejectTCP(b, addr)
+	} else {
+		p, ra, err = NewPortUnreachable(b, addr)
+	}
 	if err != nil {
-		return false
+		return
 	}
 
-	p := uint32(b[ipv4.HeaderLen]) | uint32(b[ipv4.HeaderLen+1])<<8
+	hd := d.handle()
+	hd.Lock()
+	hd.SendEx([][]byte{p}, []Address{*ra}, 0)
+	hd.Unlock()
+}
 
-	for i := range rs {
-		if rs[i].LocalPort == p {
-			if *(*uint32)(unsafe.Pointer(&b[12])) == rs[i].LocalAddr {
-				return d.AppFilter.Lookup(rs[i].OwningPid)
-			}
+// fragmentTuple returns the addresses and protocol of a fragment
+func fragmentTuple(b []byte) (t FiveTuple) {
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		t.Protocol = b[9]
+		t.SrcAddr = netip.AddrFrom4([4]byte(b[12:16]))
+		t.DstAddr = netip.AddrFrom4([4]byte(b[16:20]))
+	case ipv6.Version:
+		if e, err := parseIPv6Ext(b); err == nil {
+			t.Protocol = e.proto
 		}
+		t.SrcAddr = netip.AddrFrom16([16]byte(b[8:24]))
+		t.DstAddr = netip.AddrFrom16([16]byte(b[24:40]))
 	}
+	return
+}
+
+// CheckIPv4 reports whether an IPv4 packet should be diverted
+func (d *Device) CheckIPv4(b []byte) bool {
+	return d.Verdict(b, nil) == VerdictDivert
+}
+
+// CheckIPv6 reports whether an IPv6 packet should be diverted
+func (d *Device) CheckIPv6(b []byte) bool {
+	return d.Verdict(b, nil) == VerdictDivert
+}
 
-	return false
+// CheckTCP4 reports whether the process owning the connection of an
+// outbound TCP packet is in the AppFilter or matches the Apps rules
+func (d *Device) CheckTCP4(b []byte) bool {
+	return d.checkApp(b)
 }
 
+// CheckUDP4 is CheckTCP4 for UDP
 func (d *Device) CheckUDP4(b []byte) bool {
-	rs, err := utils.GetUDPTable()
-	if err != nil {
-		return false
-	}
+	return d.checkApp(b)
+}
 
-	p := uint32(b[ipv4.HeaderLen]) | uint32(b[ipv4.HeaderLen+1])<<8
+// CheckTCP6 is CheckTCP4 for IPv6
+func (d *Device) CheckTCP6(b []byte) bool {
+	return d.checkApp(b)
+}
 
-	for i := range rs {
-		if rs[i].LocalPort == p {
-			if 0 == rs[i].LocalAddr || *(*uint32)(unsafe.Pointer(&b[12])) == rs[i].LocalAddr {
-				return d.AppFilter.Lookup(rs[i].OwningPid)
-			}
+// CheckUDP6 is CheckTCP4 for UDP over IPv6
+func (d *Device) CheckUDP6(b []byte) bool {
+	return d.checkApp(b)
+}
+
+func (d *Device) checkApp(b []byte) bool {
+	pid, ok := d.Flows.LookupPacket(b, true)
+	return ok && (d.AppFilter.Lookup(pid) || d.Apps.Lookup(pid))
+}
+
+// connLoop expires idle connections
+func (d *Device) connLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-d.active:
+			return
+		case <-t.C:
+			d.Conns.Advance()
 		}
 	}
-
-	return false
 }
 
-func (d *Device) CheckIPv6(b []byte) bool {
-	switch b[6] {
-	case iana.ProtocolTCP:
-		p := uint32(b[ipv6.HeaderLen])<<8 | uint32(b[ipv6.HeaderLen+1])
-		switch d.TCP6[p] {
-		case 0:
-			if b[ipv6.HeaderLen+13]&SYN != SYN {
-				d.TCP6[p] = 1
-				return false
-			}
+// writeLoop batches the packets written to the device, it sends what is
+// left when the device drains
+func (d *Device) writeLoop() {
+	defer close(d.flushed)
 
-			if d.IPFilter.Lookup(net.IP(b[24:40])) {
-				d.TCP6[p] = 2
-				return true
-			}
+	t := time.NewTicker(time.Millisecond)
+	defer t.Stop()
 
-			if d.CheckTCP6(b) {
-				d.TCP6[p] = 2
-				return true
-			}
+	const f = AddressUDPChecksum | AddressTCPChecksum | AddressIPChecksum
 
-			d.TCP6[p] = 1
-			return false
-		case 1:
-			if b[ipv6.HeaderLen+13]&FIN == FIN {
-				d.TCP6[p] = 0
-			}
+	a := make([]Address, BatchMax)
+	b := make([]byte, d.MTU()*BatchMax)
+	ls := make([]int, BatchMax)
 
-			return false
-		case 2:
-			if b[ipv6.HeaderLen+13]&FIN == FIN {
-				d.TCP6[p] = 0
-			}
+	n, m := 0, 0
+	// flush sends the batch through the handle of the interface the device
+	// is on now
+	flush := func() error {
+		hd, tmpl := d.injector()
+		tmpl.Flags |= f
+		for i := range a[:m] {
+			a[i] = tmpl
+		}
+
+		d.stats.batches.Add(1)
+		d.stats.batchPackets.Add(uint64(m))
 
-			return true
+		err := d.send(hd, b[:n], a[:m])
+		if err == nil {
+			off := 0
+			for _, l := range ls[:m] {
+				d.stats.count(statInjected, b[off:off+l], tmpl.Outbound())
+				off += l
+			}
 		}
-	case iana.ProtocolUDP:
-		p := uint32(b[ipv6.HeaderLen])<<8 | uint32(b[ipv6.HeaderLen+1])
 
-		switch d.UDP6[p] {
-		case 0:
-			fn := func() { d.UDP6[p] = 0 }
+		n, m = 0, 0
+		d.stats.writeQueue.Store(0)
+		return err
+	}
 
-			if d.IPFilter.Lookup(net.IP(b[24:40])) {
-				d.UDP6[p] = 2
-				time.AfterFunc(time.Minute, fn)
-				return true
+	for {
+		select {
+		case <-t.C:
+			if m > 0 {
+				if err := flush(); err != nil {
+					return
+				}
+			}
+		case <-d.event:
+			// a packet is read at once only when it fits
+			mtu := d.MTU()
+			if len(b)-n < mtu {
+				if err := flush(); err != nil {
+					return
+				}
+				// the device moved to an interface with a larger MTU
+				if len(b) < mtu {
+					b = make([]byte, mtu*BatchMax)
+				}
 			}
 
-			if d.CheckUDP6(b) {
-				d.UDP6[p] = 2
-				time.AfterFunc(time.Minute, fn)
-				return true
+			nr, err := d.PipeReader.Read(b[n:])
+			if err != nil {
+				if d.State() == DeviceRunning {
+					d.fail(fmt.Errorf("device writeLoop error: %w", err))
+				}
+
+				return
 			}
 
-			if (uint32(b[ipv6.HeaderLen+2])<<8 | uint32(b[ipv6.HeaderLen+3])) == 53 {
-				return true
+			d.observeDNS(b[n : n+nr])
+			_, tmpl := d.injector()
+			switch d.shape(b[n:n+nr], &tmpl, shapeWrite) {
+			case ShapeQueued:
+				d.account(b[n:n+nr], false)
+				continue
+			case ShapeDropped:
+				d.stats.count(statDropped, b[n:n+nr], tmpl.Outbound())
+				continue
 			}
+			d.account(b[n:n+nr], false)
 
-			d.UDP6[p] = 1
-			time.AfterFunc(time.Minute, fn)
-			return false
-		case 1:
-			return false
-		case 2:
-			return true
+			ls[m] = nr
+			n += nr
+			m++
+			d.stats.writeQueue.Store(int64(m))
+
+			if m == BatchMax {
+				if err := flush(); err != nil {
+					return
+				}
+			}
+		case <-d.draining:
+			if m > 0 {
+				flush()
+			}
+
+			return
 		}
-	default:
-		return d.IPFilter.Lookup(net.IP(b[24:40]))
 	}
+}
 
-	return false
+// Stats returns a snapshot of the counters of the device
+func (d *Device) Stats() DeviceStats {
+	s := d.stats.snapshot()
+	s.Conns = d.Conns.Len()
+	return s
 }
 
-func (d *Device) CheckTCP6(b []byte) bool {
-	rs, err := utils.GetTCP6Table()
-	if err != nil {
-		return false
+// SetAccountant accounts the packets diverted and written to the device to
+// a, nil stops accounting. The processes are looked up with Flows unless a
+// has a Lookup. Packets are accounted off the packet path, those arriving
+// while the queue is full are left out and counted as AccountDropped.
+func (d *Device) SetAccountant(a *Accountant) {
+	if a != nil {
+		a.mu.Lock()
+		if a.Lookup == nil {
+			a.Lookup = d.Flows.Lookup
+		}
+		a.mu.Unlock()
 	}
+	d.acct.Store(a)
+}
 
-	p := uint32(b[ipv6.HeaderLen]) | uint32(b[ipv6.HeaderLen+1])<<8
-	a := *(*[4]uint32)(unsafe.Pointer(&b[8]))
+// Accountant returns the accountant of the device, nil when not accounting
+func (d *Device) Accountant() *Accountant {
+	return d.acct.Load()
+}
 
-	for i := range rs {
-		if rs[i].LocalPort == p {
-			if a[0] == rs[i].LocalAddr[0] && a[1] == rs[i].LocalAddr[1] && a[2] == rs[i].LocalAddr[2] && a[3] == rs[i].LocalAddr[3] {
-				return d.AppFilter.Lookup(rs[i].OwningPid)
-			}
-		}
-	}
+// accountQueueLength bounds the packets waiting to be accounted
+const accountQueueLength = 4096
 
-	return false
+// accountRecord is a packet waiting to be accounted
+type accountRecord struct {
+	t        FiveTuple
+	outbound bool
+	size     int
+	at       time.Time
 }
 
-func (d *Device) CheckUDP6(b []byte) bool {
-	rs, err := utils.GetUDP6Table()
+// account queues packet b for the accountant, the process owning it may
+// take a snapshot to find
+func (d *Device) account(b []byte, outbound bool) {
+	if d.acct.Load() == nil {
+		return
+	}
+
+	t, _, err := parseTransport(b)
 	if err != nil {
-		return false
+		return
+	}
+	if !outbound {
+		t = t.Reverse()
 	}
 
-	p := uint32(b[ipv6.HeaderLen]) | uint32(b[ipv6.HeaderLen+1])<<8
-	a := *(*[4]uint32)(unsafe.Pointer(&b[0]))
+	select {
+	case d.acctCh <- accountRecord{t: t, outbound: outbound, size: len(b), at: time.Now()}:
+	default:
+		d.stats.accountDropped.Add(1)
+	}
+}
 
-	for i := range rs {
-		if rs[i].LocalPort == p {
-			if (0 == rs[i].LocalAddr[0] && 0 == rs[i].LocalAddr[1] && 0 == rs[i].LocalAddr[2] && 0 == rs[i].LocalAddr[3]) || (a[0] == rs[i].LocalAddr[0] && a[1] == rs[i].LocalAddr[1] && a[2] == rs[i].LocalAddr[2] && a[3] == rs[i].LocalAddr[3]) {
-				return d.AppFilter.Lookup(rs[i].OwningPid)
+// accountLoop records the queued packets with the accountant
+func (d *Device) accountLoop() {
+	for {
+		select {
+		case <-d.active:
+			return
+		case r := <-d.acctCh:
+			if a := d.acct.Load(); a != nil {
+				a.RecordAt(r.t, r.outbound, r.size, r.at)
 			}
 		}
 	}
+}
 
-	return false
+// SetShaper shapes the packets passed, diverted and written by the device
+// with s, nil stops shaping. The packets queued by s are sent as they may be
+// until the device is closed or another shaper is set, those left in the
+// previous shaper are dropped. Packets dropped by s are counted as dropped.
+func (d *Device) SetShaper(s *Shaper) {
+	d.shMu.Lock()
+	defer d.shMu.Unlock()
+
+	if d.shCancel != nil {
+		d.shCancel()
+		d.shCancel = nil
+	}
+	d.shaper.Store(s)
+	if s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(d.ctx)
+	d.shCancel = cancel
+	go s.Run(ctx, func(p *ShapedPacket) {
+		if err := d.sendShaped(p); err != nil {
+			d.report(fmt.Errorf("send shaped packet error: %w", err))
+		}
+	})
 }
 
-func (d *Device) writeLoop() {
-	t := time.NewTicker(time.Millisecond)
-	defer t.Stop()
+// shapeKind is where the device sends a shaped packet
+type shapeKind uint8
 
-	const f = uint8(0x01<<7) | uint8(0x01<<6) | uint8(0x01<<5)
+const (
+	// shapeInject packets are passed back to the handle they came from
+	shapeInject shapeKind = iota
+	// shapeDivert packets are written to the writer of WriteTo
+	shapeDivert
+	// shapeWrite packets are written to the device and injected into its
+	// interface
+	shapeWrite
+)
 
-	a := make([]Address, BatchMax)
-	b := make([]byte, 1500*BatchMax)
+// sendShaped sends a packet released by the shaper
+func (d *Device) sendShaped(p *ShapedPacket) error {
+	switch p.kind {
+	case shapeDivert:
+		d.outMu.Lock()
+		defer d.outMu.Unlock()
+		if d.out == nil {
+			return errors.New("no writer for diverted packet")
+		}
+		_, err := d.out.Write(p.Packet)
+		return err
+	case shapeWrite:
+		hd, tmpl := d.injector()
+		tmpl.Flags |= AddressUDPChecksum | AddressTCPChecksum | AddressIPChecksum
+		if err := d.send(hd, p.Packet, []Address{tmpl}); err != nil {
+			return err
+		}
+		d.stats.count(statInjected, p.Packet, tmpl.Outbound())
+		return nil
+	default:
+		return d.send(d.handle(), p.Packet, []Address{p.Address})
+	}
+}
 
-	for i := range a {
-		a[i] = *d.Address
-		a[i].Flags |= f
+// Shaper returns the shaper of the device, nil when not shaping
+func (d *Device) Shaper() *Shaper {
+	return d.shaper.Load()
+}
+
+// shape passes packet b to the shaper, the device sends it as kind says
+// when it is queued
+func (d *Device) shape(b []byte, addr *Address, kind shapeKind) ShapeResult {
+	s := d.shaper.Load()
+	if s == nil {
+		return ShapePass
 	}
 
-	n, m := 0, 0
-	for {
-		select {
-		case <-t.C:
-			if m > 0 {
-				d.Handle.Lock()
-				_, err := d.Handle.SendEx([][]byte{b[:n]}, a[:m], 0)
-				d.Handle.Unlock()
-				if err != nil {
-					select {
-					case <-d.active:
-					default:
-						panic(fmt.Errorf("device writeLoop error: %v", err))
-					}
+	c, err := NewPolicyContext(b, addr, d.Flows)
+	if err != nil {
+		c = &PolicyContext{Packet: b, Address: addr, flows: d.Flows}
+	}
+	return s.shape(c, kind)
+}
 
-					return
-				}
+// MetricsHandler returns a handler serving the stats of the device in the
+// Prometheus text exposition format
+func (d *Device) MetricsHandler() http.Handler {
+	return MetricsHandler(d.Stats)
+}
 
-				n, m = 0, 0
-			}
-		case <-d.event:
-			nr, err := d.PipeReader.Read(b[n:])
-			if err != nil {
-				select {
-				case <-d.active:
-				default:
-					panic(fmt.Errorf("device writeLoop error: %v", err))
-				}
+// Interface returns the interface packets are injected into
+func (d *Device) Interface() Interface {
+	d.hmu.RLock()
+	defer d.hmu.RUnlock()
+	return d.iface
+}
 
-				return
-			}
+// MTU returns the MTU of the device
+func (d *Device) MTU() int {
+	return int(d.mtu.Load())
+}
 
-			n += nr
-			m++
+// String returns the interface, state and MTU of the device on one line
+func (d *Device) String() string {
+	i := d.Interface()
+	return fmt.Sprintf("ifIdx=%d subIfIdx=%d name=%s state=%v mtu=%d", i.Index, i.SubIndex, i.Name, d.State(), d.MTU())
+}
 
-			if m == BatchMax {
-				d.Handle.Lock()
-				_, err := d.Handle.SendEx([][]byte{b[:n]}, a[:m], 0)
-				d.Handle.Unlock()
-				if err != nil {
-					select {
-					case <-d.active:
-					default:
-						panic(fmt.Errorf("device writeLoop error: %v", err))
-					}
+func (d *Device) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
 
-					return
-				}
+// Format implements fmt.Formatter, %v and %s print the device as String
+// does and %q quotes it
+func (d *Device) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v', 's':
+		io.WriteString(s, d.String())
+	case 'q':
+		io.WriteString(s, strconv.Quote(d.String()))
+	default:
+		fmt.Fprintf(s, "%%!%c(windivert.Device=%s)", verb, d.String())
+	}
+}
+
+type deviceJSON struct {
+	Interface Interface `json:"interface"`
+	State     string    `json:"state"`
+	MTU       int       `json:"mtu"`
+}
+
+func (d *Device) MarshalJSON() ([]byte, error) {
+	return json.Marshal(deviceJSON{Interface: d.Interface(), State: d.State().String(), MTU: d.MTU()})
+}
 
-				n, m = 0, 0
+// UnmarshalJSON fails, a device is opened with NewDevice
+func (d *Device) UnmarshalJSON(b []byte) error {
+	return errors.New("device cannot be unmarshaled")
+}
+
+// Write injects a packet. Packets larger than the MTU are fragmented when
+// they are IPv4 packets without the don't fragment bit. Others are dropped
+// and answered with an ICMP message written to the writer of WriteTo, IPv6
+// packets are never fragmented on the way (RFC 8200) and are always
+// answered with an ICMPv6 packet too big message.
+func (d *Device) Write(b []byte) (int, error) {
+	mtu := d.MTU()
+	if len(b) <= mtu {
+		return d.write(b)
+	}
+
+	if len(b) > 0 && b[0]>>4 == ipv4.Version {
+		frags, err := Fragment(b, mtu)
+		switch {
+		case err == nil:
+			for _, f := range frags {
+				if _, err := d.write(f); err != nil {
+					return 0, err
+				}
 			}
-		case <-d.active:
+			return len(b), nil
+		case !errors.Is(err, ErrFragmentNeeded):
+			return 0, err
 		}
 	}
+
+	return d.tooBig(b, mtu)
 }
 
-func (d *Device) Write(b []byte) (int, error) {
+// tooBig answers a packet exceeding mtu with an ICMP message
+func (d *Device) tooBig(b []byte, mtu int) (int, error) {
+	var (
+		p   []byte
+		err error
+	)
+	_, addr := d.injector()
+	if len(b) > 0 && b[0]>>4 == ipv6.Version {
+		p, _, err = NewICMPv6PacketTooBig(b, &addr, mtu)
+	} else {
+		p, _, err = NewICMPFragmentationNeeded(b, &addr, mtu)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	d.outMu.Lock()
+	defer d.outMu.Unlock()
+	if d.out == nil {
+		return 0, &PacketTooBigError{MTU: mtu, Message: p}
+	}
+	if _, err := d.out.Write(p); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (d *Device) write(b []byte) (int, error) {
 	select {
-	case <-d.active:
+	case <-d.draining:
 		return 0, io.EOF
 	case d.event <- struct{}{}:
 	}
@@ -0,0 +1,229 @@
+package windivert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+func TestBatchPacket(t *testing.T) {
+	p4 := testPacket(6, testSrc4, testDst4, ACK, 1, testPayload(100))
+	p6 := testPacket(17, testSrc6, testDst6, 0, 0, testPayload(100))
+
+	// offload leaves the length of large segments unset
+	lso4 := append(append([]byte{}, p4...), testPayload(2000)...)
+	lso4[2], lso4[3] = 0, 0
+	lso6 := append(append([]byte{}, p6...), testPayload(2000)...)
+	lso6[4], lso6[5] = 0, 0
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		l    int
+		ttl  int
+	}{
+		{"ipv4", append(append([]byte{}, p4...), p6...), len(p4), 8},
+		{"ipv6", append(append([]byte{}, p6...), p4...), len(p6), 7},
+		{"ipv4 lso", lso4, len(lso4), 8},
+		{"ipv6 lso", lso6, len(lso6), 7},
+		{"truncated", p6[:60], 60, 7},
+	} {
+		l, ttl, err := batchPacket(tt.b)
+		if err != nil || l != tt.l || ttl != tt.ttl {
+			t.Errorf("%s: batchPacket = %d, %d, %v, want %d, %d", tt.name, l, ttl, err, tt.l, tt.ttl)
+		}
+	}
+
+	if _, _, err := batchPacket([]byte{0x50, 0, 0, 0}); err == nil {
+		t.Error("invalid version accepted")
+	}
+}
+
+func TestDeviceLearnSubIndex(t *testing.T) {
+	d := &Device{addr: *NewInboundAddress(3, 0), iface: Interface{Index: 3}}
+
+	d.learnSubIndex(NewOutboundAddress(4, 2))
+	d.learnSubIndex(NewOutboundAddress(3, 1))
+	if _, a := d.injector(); d.Interface().SubIndex != 1 || a.Network().SubInterfaceIndex != 1 {
+		t.Errorf("subIfIdx = %d, injected with %v", d.Interface().SubIndex, &a)
+	}
+}
+
+func TestDeviceSwitchInterface(t *testing.T) {
+	// a device on all interfaces keeps its handle
+	d := &Device{
+		deviceLife: newDeviceLife(),
+		all:        true,
+		addr:       *NewInboundAddress(3, 0),
+		iface:      Interface{Index: 3, MTU: 1500},
+		ifSubs:     make(map[int]func(InterfaceEvent)),
+	}
+	d.mtu.Store(1500)
+	evs := []InterfaceEvent{}
+	d.SubscribeInterface(func(ev InterfaceEvent) { evs = append(evs, ev) })
+
+	d.learnSubIndex(NewInboundAddress(3, 1))
+	for _, tt := range []struct {
+		i      Interface
+		mtuOpt int
+		sub    uint32
+		mtu    int
+	}{
+		// the subIfIdx learnt is kept on the same interface
+		{Interface{Index: 3, MTU: 1500}, 0, 1, 1500},
+		{Interface{Index: 5, MTU: 9000}, 0, 0, 9000},
+		{Interface{Index: 6}, 0, 0, MTUDefault},
+		{Interface{Index: 7, SubIndex: 2, MTU: 9000}, 1400, 2, 1400},
+	} {
+		d.mtuOpt = tt.mtuOpt
+		if err := d.SwitchInterface(tt.i); err != nil {
+			t.Fatal(err)
+		}
+		_, a := d.injector()
+		if nw := a.Network(); nw.InterfaceIndex != tt.i.Index || nw.SubInterfaceIndex != tt.sub || d.MTU() != tt.mtu {
+			t.Errorf("on %d: injected with %v, MTU() = %d", tt.i.Index, &a, d.MTU())
+		}
+	}
+
+	if len(evs) != 4 || evs[0].New.SubIndex != 1 || evs[1].Old.Index != 3 {
+		t.Errorf("events = %+v", evs)
+	}
+	if a := d.Address(); a.Network().InterfaceIndex != 7 {
+		t.Errorf("Address() = %v", &a)
+	}
+}
+
+func TestDeviceSwitchHandle(t *testing.T) {
+	old, hd := &Handle{}, &Handle{}
+	d := &Device{
+		deviceLife: newDeviceLife(),
+		hd:         old,
+		addr:       *NewInboundAddress(3, 0),
+		iface:      Interface{Index: 3, MTU: 1500},
+		open: func(filter string, i *Interface, all bool, bypass []netip.Prefix) (*Handle, error) {
+			return hd, nil
+		},
+		bypass: NewIPSet(VerdictPass),
+		ifSubs: make(map[int]func(InterfaceEvent)),
+	}
+	if err := d.SwitchInterface(Interface{Index: 5, MTU: 1500}); err != nil {
+		t.Fatal(err)
+	}
+	if d.handle() != hd {
+		t.Fatal("handle not replaced")
+	}
+
+	// the old handle is held, the device must not wait for it
+	old.Lock()
+	defer old.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, nil)
+		d.Send(p, NewOutboundAddress(5, 0))
+		d.SetParam(QueueLength, QueueLengthMax)
+		d.Shutdown(ShutdownSend)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("methods of the device went to the old handle")
+	}
+
+	if a := d.Address(); a.Network().InterfaceIndex != 5 {
+		t.Errorf("Address() = %v", &a)
+	}
+}
+
+func TestDeviceWriteMTU(t *testing.T) {
+	udp4 := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	df4 := append([]byte(nil), udp4...)
+	df4[6] |= 0x40
+	setIPv4HeaderChecksum(df4)
+	udp6 := testPacket(iana.ProtocolUDP, testSrc6, testDst6, 0, 0, testPayload(3000))
+
+	for _, tt := range []struct {
+		name    string
+		b       []byte
+		writeTo bool
+		frags   int
+		icmp    []byte
+	}{
+		{"fits", testPacket(iana.ProtocolUDP, testSrc6, testDst6, 0, 0, testPayload(1000)), false, 1, nil},
+		{"ipv4 fragmented", udp4, false, 3, nil},
+		{"ipv4 don't fragment", df4, true, 0, []byte{ICMPDestinationUnreachable, ICMPCodeFragmentationNeeded}},
+		{"ipv4 don't fragment without WriteTo", df4, false, 0, []byte{ICMPDestinationUnreachable, ICMPCodeFragmentationNeeded}},
+		// IPv6 packets are only fragmented by their source
+		{"ipv6", udp6, true, 0, []byte{ICMPv6PacketTooBig, 0}},
+		{"ipv6 without WriteTo", udp6, false, 0, []byte{ICMPv6PacketTooBig, 0}},
+	} {
+		d := newTestDevice()
+		d.mtu.Store(1280)
+		d.addr = *NewInboundAddress(1, 0)
+		out := &bytes.Buffer{}
+		if tt.writeTo {
+			d.out = out
+		}
+
+		var written [][]byte
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range d.event {
+				p := make([]byte, MTUMax)
+				n, err := d.PipeReader.Read(p)
+				if err != nil {
+					return
+				}
+				written = append(written, p[:n])
+			}
+		}()
+
+		n, err := d.Write(tt.b)
+		d.PipeWriter.Close()
+		close(d.event)
+		<-done
+
+		if len(written) != tt.frags {
+			t.Errorf("%s: %d packets written", tt.name, len(written))
+		}
+		for _, p := range written {
+			if len(p) > 1280 {
+				t.Errorf("%s: %d bytes written", tt.name, len(p))
+			}
+		}
+
+		msg := out.Bytes()
+		var tb *PacketTooBigError
+		switch {
+		case tt.icmp == nil:
+			if err != nil || n != len(tt.b) {
+				t.Errorf("%s: Write = %d, %v", tt.name, n, err)
+			}
+		case tt.writeTo:
+			if err != nil || n != len(tt.b) {
+				t.Errorf("%s: Write = %d, %v", tt.name, n, err)
+			}
+		case errors.As(err, &tb) && tb.MTU == 1280:
+			msg = tb.Message
+		default:
+			t.Errorf("%s: Write = %d, %v, want a PacketTooBigError", tt.name, n, err)
+		}
+		if tt.icmp == nil {
+			continue
+		}
+
+		off := 20
+		if msg[0]>>4 == 6 {
+			off = 40
+		}
+		if len(msg) < off+8 || msg[off] != tt.icmp[0] || msg[off+1] != tt.icmp[1] || binary.BigEndian.Uint16(msg[off+6:]) != 1280 {
+			t.Errorf("%s: icmp message %x", tt.name, msg)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package windivert
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDeviceClosed is returned by Device.Err after Close
+var ErrDeviceClosed = errors.New("device closed")
+
+// DeviceState is a stage of the life of a Device
+type DeviceState int32
+
+const (
+	// DeviceStarting is a Device being set up
+	DeviceStarting DeviceState = iota
+	// DeviceRunning is a Device passing packets
+	DeviceRunning
+	// DeviceDraining is a Device sending the packets written before Close
+	DeviceDraining
+	// DeviceClosed is a Device whose handle is closed
+	DeviceClosed
+)
+
+func (s DeviceState) String() string {
+	switch s {
+	case DeviceStarting:
+		return "starting"
+	case DeviceRunning:
+		return "running"
+	case DeviceDraining:
+		return "draining"
+	case DeviceClosed:
+		return "closed"
+	default:
+		return ""
+	}
+}
+
+const (
+	// deviceErrorsLen is the number of errors buffered for Errors
+	deviceErrorsLen = 64
+	// deviceRetries is how many times a transient send error is retried
+	// before the batch is dropped
+	deviceRetries = 3
+	// deviceRetryDelay is the delay before the first retry, it doubles on
+	// every retry
+	deviceRetryDelay = time.Millisecond
+)
+
+// IsTransient reports whether err is an error WinDivert recovers from: the
+// destination of a reinjected packet is unreachable, no packet is queued or
+// the driver is out of buffers
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrHostUnreachable) || errors.Is(err, ErrNoData) {
+		return true
+	}
+	for _, e := range outOfBuffers {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceLife holds the state of a Device and its subscribers
+type deviceLife struct {
+	mu      sync.Mutex
+	state   DeviceState
+	err     error
+	done    chan struct{}
+	errs    chan error
+	subs    map[int]func(DeviceState)
+	nextSub int
+}
+
+func newDeviceLife() deviceLife {
+	return deviceLife{
+		done: make(chan struct{}),
+		errs: make(chan error, deviceErrorsLen),
+		subs: make(map[int]func(DeviceState)),
+	}
+}
+
+// State returns the current state
+func (l *deviceLife) State() DeviceState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// Done returns a channel closed when the device is closed
+func (l *deviceLife) Done() <-chan struct{} {
+	return l.done
+}
+
+// Err returns nil until Done is closed, then the error the device failed
+// with or ErrDeviceClosed when it was closed by Close
+func (l *deviceLife) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Errors returns a channel receiving the errors the device recovered from
+// and the one it failed with. Errors are dropped when the channel is full.
+func (l *deviceLife) Errors() <-chan error {
+	return l.errs
+}
+
+// SubscribeState calls fn on every state transition until cancel is
+// called. fn is called from the goroutine changing the state and must not
+// block.
+func (l *deviceLife) SubscribeState(fn func(DeviceState)) (cancel func()) {
+	l.mu.Lock()
+	id := l.nextSub
+	l.nextSub++
+	l.subs[id] = fn
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		delete(l.subs, id)
+		l.mu.Unlock()
+	}
+}
+
+// report passes err to Errors without blocking
+func (l *deviceLife) report(err error) {
+	select {
+	case l.errs <- err:
+	default:
+	}
+}
+
+// setState moves to s, states only move forward. Entering DeviceClosed
+// records err and closes Done.
+func (l *deviceLife) setState(s DeviceState, err error) bool {
+	l.mu.Lock()
+	if s <= l.state {
+		l.mu.Unlock()
+		return false
+	}
+	l.state = s
+	if s == DeviceClosed {
+		l.err = err
+		close(l.done)
+	}
+
+	subs := make([]func(DeviceState), 0, len(l.subs))
+	for _, fn := range l.subs {
+		subs = append(subs, fn)
+	}
+	l.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(s)
+	}
+	return true
+}
@@ -0,0 +1,181 @@
+package windivert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDevice returns a running device with no handle and no loops, for
+// the tests of its life
+func newTestDevice() *Device {
+	r, w := io.Pipe()
+	_, cancel := context.WithCancel(context.Background())
+	d := &Device{
+		PipeReader: r,
+		PipeWriter: w,
+		cancel:     cancel,
+		active:     make(chan struct{}),
+		event:      make(chan struct{}, 1),
+		deviceLife: newDeviceLife(),
+		draining:   make(chan struct{}),
+		flushed:    make(chan struct{}),
+	}
+	close(d.flushed)
+	d.setState(DeviceRunning, nil)
+	return d
+}
+
+// failingSender fails the first n batches with err
+type failingSender struct {
+	sync.Mutex
+	n     int
+	err   error
+	calls int
+	sent  int
+}
+
+func (s *failingSender) SendEx(packets [][]byte, addrs []Address, flags uint64) (uint, error) {
+	s.calls++
+	if s.calls <= s.n {
+		return 0, s.err
+	}
+	s.sent += len(addrs)
+	return uint(len(packets[0])), nil
+}
+
+func TestDeviceLifeStates(t *testing.T) {
+	l := newDeviceLife()
+	var got []DeviceState
+	cancel := l.SubscribeState(func(s DeviceState) { got = append(got, s) })
+
+	for _, tt := range []struct {
+		s    DeviceState
+		want bool
+	}{
+		{DeviceStarting, false},
+		{DeviceRunning, true},
+		{DeviceRunning, false},
+		{DeviceStarting, false},
+		{DeviceDraining, true},
+		{DeviceRunning, false},
+	} {
+		if ok := l.setState(tt.s, nil); ok != tt.want {
+			t.Errorf("setState(%v) = %v in state %v", tt.s, ok, l.State())
+		}
+	}
+	if l.State() != DeviceDraining || l.Err() != nil {
+		t.Errorf("state %v, Err() = %v", l.State(), l.Err())
+	}
+	select {
+	case <-l.Done():
+		t.Error("Done closed before the device closed")
+	default:
+	}
+
+	cancel()
+	failure := errors.New("failure")
+	if !l.setState(DeviceClosed, failure) || l.setState(DeviceClosed, ErrDeviceClosed) {
+		t.Error("closed other than once")
+	}
+	<-l.Done()
+	if l.Err() != failure {
+		t.Errorf("Err() = %v", l.Err())
+	}
+	if len(got) != 2 || got[0] != DeviceRunning || got[1] != DeviceDraining {
+		t.Errorf("subscriber saw %v", got)
+	}
+}
+
+func TestDeviceErr(t *testing.T) {
+	d := newTestDevice()
+	if d.Err() != nil {
+		t.Errorf("Err() = %v before Close", d.Err())
+	}
+	d.Close()
+	d.Close()
+	<-d.Done()
+	if d.Err() != ErrDeviceClosed || d.State() != DeviceClosed {
+		t.Errorf("Err() = %v in state %v after Close", d.Err(), d.State())
+	}
+
+	d = newTestDevice()
+	failure := errors.New("failure")
+	d.fail(failure)
+	<-d.Done()
+	if d.Err() != failure {
+		t.Errorf("Err() = %v after failing", d.Err())
+	}
+	if err := <-d.Errors(); err != failure {
+		t.Errorf("reported %v", err)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{ErrHostUnreachable, true},
+		{ErrNoData, true},
+		{outOfBuffers[0], true},
+		{fmt.Errorf("send: %w", outOfBuffers[len(outOfBuffers)-1]), true},
+		{fmt.Errorf("send: %w", ErrHostUnreachable), true},
+		{ErrDeviceClosed, false},
+		{errors.New("invalid parameter"), false},
+		{nil, false},
+	} {
+		if got := IsTransient(tt.err); got != tt.want {
+			t.Errorf("IsTransient(%v) = %v", tt.err, got)
+		}
+	}
+}
+
+func TestDeviceSendRetry(t *testing.T) {
+	failure := errors.New("failure")
+	for _, tt := range []struct {
+		name     string
+		n        int
+		err      error
+		calls    int
+		sent     int
+		reported int
+		fails    bool
+	}{
+		{"sent", 0, nil, 1, 1, 0, false},
+		{"out of buffers", 2, outOfBuffers[0], 3, 1, 2, false},
+		{"out of buffers until dropped", deviceRetries + 5, outOfBuffers[0], deviceRetries + 1, 0, deviceRetries + 1, false},
+		{"unreachable", 5, ErrHostUnreachable, 1, 0, 1, false},
+		{"failure", 5, failure, 1, 0, 1, true},
+	} {
+		d := newTestDevice()
+		s := &failingSender{n: tt.n, err: tt.err}
+
+		start := time.Now()
+		err := d.send(s, testPayload(40), make([]Address, 1))
+		if (err != nil) != tt.fails || s.calls != tt.calls || s.sent != tt.sent {
+			t.Errorf("%s: send = %v after %d calls, %d sent", tt.name, err, s.calls, s.sent)
+		}
+		// the delay doubles on every retry
+		if el := time.Since(start); tt.calls > 1 && el < deviceRetryDelay*(1<<(tt.calls-1)-1) {
+			t.Errorf("%s: retried within %v", tt.name, el)
+		}
+
+		if tt.fails {
+			<-d.Done()
+			if d.Err() != tt.err {
+				t.Errorf("%s: Err() = %v", tt.name, d.Err())
+			}
+		} else if d.State() != DeviceRunning {
+			t.Errorf("%s: state %v", tt.name, d.State())
+		}
+		if len(d.Errors()) != tt.reported {
+			t.Errorf("%s: %d errors reported", tt.name, len(d.Errors()))
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,323 @@
+package windivert
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (l Layer) MarshalText() ([]byte, error) {
+	if s := l.String(); s != "" {
+		return []byte(s), nil
+	}
+	return []byte(strconv.Itoa(int(l))), nil
+}
+
+func (l *Layer) UnmarshalText(b []byte) error {
+	for v := LayerNetwork; v <= LayerReflect; v++ {
+		if v.String() == string(b) {
+			*l = v
+			return nil
+		}
+	}
+
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid layer %q", b)
+	}
+	*l = Layer(n)
+	return nil
+}
+
+func (e Event) MarshalText() ([]byte, error) {
+	if s := e.String(); s != "" {
+		return []byte(s), nil
+	}
+	return []byte(strconv.Itoa(int(e))), nil
+}
+
+func (e *Event) UnmarshalText(b []byte) error {
+	for v := EventNetworkPacket; v <= EventEthernetFrame; v++ {
+		if v.String() == string(b) {
+			*e = v
+			return nil
+		}
+	}
+
+	n, err := strconv.Atoi(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid event %q", b)
+	}
+	*e = Event(n)
+	return nil
+}
+
+func (f AddressFlags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *AddressFlags) UnmarshalText(b []byte) error {
+	*f = 0
+	if len(b) == 0 {
+		return nil
+	}
+
+next:
+	for _, s := range strings.Split(string(b), "|") {
+		for i, name := range addressFlagNames {
+			if name == s {
+				*f |= 0x01 << i
+				continue next
+			}
+		}
+		return fmt.Errorf("invalid address flag %q", s)
+	}
+	return nil
+}
+
+var openFlagNames = [...]string{
+	"WINDIVERT_FLAG_SNIFF",
+	"WINDIVERT_FLAG_DROP",
+	"WINDIVERT_FLAG_DEBUG",
+	"WINDIVERT_FLAG_RECV_ONLY",
+	"WINDIVERT_FLAG_SEND_ONLY",
+	"WINDIVERT_FLAG_NO_INSTALL",
+	"WINDIVERT_FLAG_FRAGMENTS",
+}
+
+// formatOpenFlags returns the names of the WinDivertOpen flags in flags
+func formatOpenFlags(flags uint64) string {
+	s := []string{}
+	for i, name := range openFlagNames {
+		if flags&(1<<i) != 0 {
+			s = append(s, name)
+			flags &^= 1 << i
+		}
+	}
+	if flags != 0 {
+		s = append(s, "0x"+strconv.FormatUint(flags, 16))
+	}
+	return strings.Join(s, "|")
+}
+
+// parseOpenFlags is the inverse of formatOpenFlags
+func parseOpenFlags(str string) (uint64, error) {
+	flags := uint64(0)
+	if str == "" {
+		return flags, nil
+	}
+
+next:
+	for _, s := range strings.Split(str, "|") {
+		for i, name := range openFlagNames {
+			if name == s {
+				flags |= 1 << i
+				continue next
+			}
+		}
+		v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+		if err != nil || !strings.HasPrefix(s, "0x") {
+			return 0, fmt.Errorf("invalid flag %q", s)
+		}
+		flags |= v
+	}
+	return flags, nil
+}
+
+// String returns the address on one line with the layer specific fields
+// named after the WinDivert filter fields
+func (a *Address) String() string {
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "timestamp=%d time=%v layer=%v event=%v", a.Timestamp, a.Time().Format(time.RFC3339Nano), a.Layer(), a.Event())
+	if a.Flags != 0 {
+		fmt.Fprintf(b, " flags=%v", a.Flags)
+	}
+
+	switch a.Layer() {
+	case LayerNetwork, LayerNetworkForward:
+		nw := a.Network()
+		fmt.Fprintf(b, " ifIdx=%d subIfIdx=%d", nw.InterfaceIndex, nw.SubInterfaceIndex)
+	case LayerFlow, LayerSocket:
+		local, _ := a.LocalAddrPort()
+		remote, _ := a.RemoteAddrPort()
+		s := a.Socket()
+		fmt.Fprintf(b, " processId=%d endpointId=%d parentEndpointId=%d protocol=%d local=%v remote=%v", s.ProcessID, s.EndpointID, s.ParentEndpointID, s.Protocol, local, remote)
+	case LayerReflect:
+		r := a.Reflect()
+		fmt.Fprintf(b, " processId=%d reflectLayer=%v priority=%d reflectTimestamp=%d reflectTime=%v", r.ProcessID, r.Layer(), r.Priority, r.TimeStamp, r.Time().Format(time.RFC3339Nano))
+		if r.Flags != 0 {
+			fmt.Fprintf(b, " reflectFlags=%v", formatOpenFlags(r.Flags))
+		}
+	}
+
+	return b.String()
+}
+
+func (a *Address) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Format implements fmt.Formatter, %v and %s print the address as String
+// does and %q quotes it
+func (a *Address) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v', 's':
+		io.WriteString(s, a.String())
+	case 'q':
+		io.WriteString(s, strconv.Quote(a.String()))
+	default:
+		fmt.Fprintf(s, "%%!%c(windivert.Address=%s)", verb, a.String())
+	}
+}
+
+type networkJSON struct {
+	InterfaceIndex    uint32 `json:"ifIdx"`
+	SubInterfaceIndex uint32 `json:"subIfIdx"`
+}
+
+type flowJSON struct {
+	EndpointID       uint64         `json:"endpointId"`
+	ParentEndpointID uint64         `json:"parentEndpointId"`
+	ProcessID        uint32         `json:"processId"`
+	Local            netip.AddrPort `json:"local"`
+	Remote           netip.AddrPort `json:"remote"`
+	Protocol         uint8          `json:"protocol"`
+}
+
+// The time fields are informational, unmarshaling only reads the raw
+// timestamps
+type reflectJSON struct {
+	TimeStamp int64     `json:"timestamp"`
+	Time      time.Time `json:"time"`
+	ProcessID uint32    `json:"processId"`
+	Layer     Layer     `json:"layer"`
+	Flags     string    `json:"flags"`
+	Priority  int16     `json:"priority"`
+}
+
+type addressJSON struct {
+	Timestamp int64        `json:"timestamp"`
+	Time      time.Time    `json:"time"`
+	Layer     Layer        `json:"layer"`
+	Event     Event        `json:"event"`
+	Flags     AddressFlags `json:"flags"`
+	Network   *networkJSON `json:"network,omitempty"`
+	Ethernet  *networkJSON `json:"ethernet,omitempty"`
+	Flow      *flowJSON    `json:"flow,omitempty"`
+	Socket    *flowJSON    `json:"socket,omitempty"`
+	Reflect   *reflectJSON `json:"reflect,omitempty"`
+}
+
+func (a *Address) MarshalJSON() ([]byte, error) {
+	v := addressJSON{
+		Timestamp: a.Timestamp,
+		Time:      a.Time(),
+		Layer:     a.Layer(),
+		Event:     a.Event(),
+		Flags:     a.Flags,
+	}
+
+	switch a.Layer() {
+	case LayerNetwork, LayerNetworkForward:
+		if a.Event() == EventEthernetFrame {
+			e := a.Ethernet()
+			v.Ethernet = &networkJSON{InterfaceIndex: e.InterfaceIndex, SubInterfaceIndex: e.SubInterfaceIndex}
+			break
+		}
+		nw := a.Network()
+		v.Network = &networkJSON{InterfaceIndex: nw.InterfaceIndex, SubInterfaceIndex: nw.SubInterfaceIndex}
+	case LayerFlow, LayerSocket:
+		s := a.Socket()
+		f := &flowJSON{
+			EndpointID:       s.EndpointID,
+			ParentEndpointID: s.ParentEndpointID,
+			ProcessID:        s.ProcessID,
+			Protocol:         s.Protocol,
+		}
+		f.Local, _ = a.LocalAddrPort()
+		f.Remote, _ = a.RemoteAddrPort()
+		if a.Layer() == LayerFlow {
+			v.Flow = f
+		} else {
+			v.Socket = f
+		}
+	case LayerReflect:
+		r := a.Reflect()
+		v.Reflect = &reflectJSON{
+			TimeStamp: r.TimeStamp,
+			Time:      r.Time(),
+			ProcessID: r.ProcessID,
+			Layer:     r.Layer(),
+			Flags:     formatOpenFlags(r.Flags),
+			Priority:  r.Priority,
+		}
+	}
+
+	return json.Marshal(v)
+}
+
+func (a *Address) UnmarshalJSON(b []byte) error {
+	v := addressJSON{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	*a = Address{}
+	a.Timestamp = v.Timestamp
+	a.SetLayer(v.Layer)
+	a.SetEvent(v.Event)
+	a.Flags = v.Flags
+
+	switch {
+	case v.Network != nil:
+		nw := a.Network()
+		nw.InterfaceIndex, nw.SubInterfaceIndex = v.Network.InterfaceIndex, v.Network.SubInterfaceIndex
+	case v.Ethernet != nil:
+		e := a.Ethernet()
+		e.InterfaceIndex, e.SubInterfaceIndex = v.Ethernet.InterfaceIndex, v.Ethernet.SubInterfaceIndex
+	case v.Flow != nil || v.Socket != nil:
+		f := v.Flow
+		if f == nil {
+			f = v.Socket
+		}
+		s := a.Socket()
+		s.EndpointID = f.EndpointID
+		s.ParentEndpointID = f.ParentEndpointID
+		s.ProcessID = f.ProcessID
+		s.Protocol = f.Protocol
+		s.SetLocalAddrPort(f.Local)
+		s.SetRemoteAddrPort(f.Remote)
+	case v.Reflect != nil:
+		flags, err := parseOpenFlags(v.Reflect.Flags)
+		if err != nil {
+			return err
+		}
+		r := a.Reflect()
+		r.TimeStamp = v.Reflect.TimeStamp
+		r.ProcessID = v.Reflect.ProcessID
+		r.layer = uint32(v.Reflect.Layer)
+		r.Flags = flags
+		r.Priority = v.Reflect.Priority
+	}
+
+	return nil
+}
+
+// PacketRecord is a packet together with its address in a form that can be
+// stored as JSON and injected again with Send
+type PacketRecord struct {
+	Address Address `json:"address"`
+	Packet  []byte  `json:"packet"`
+}
+
+func (r PacketRecord) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Address *Address `json:"address"`
+		Packet  []byte   `json:"packet"`
+	}{&r.Address, r.Packet})
+}
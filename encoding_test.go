@@ -0,0 +1,92 @@
+package windivert
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestAddressJSON(t *testing.T) {
+	nw := NewOutboundAddress(7, 2)
+	nw.Timestamp = 12345
+
+	flow := &Address{}
+	flow.SetLayer(LayerFlow)
+	flow.SetEvent(EventFlowEstablished)
+	flow.Flow().SetLocalAddrPort(netip.MustParseAddrPort("10.0.0.1:1234"))
+	flow.Flow().SetRemoteAddrPort(netip.MustParseAddrPort("1.1.1.1:443"))
+	flow.Flow().ProcessID = 42
+	flow.Flow().Protocol = 6
+
+	reflect := &Address{}
+	reflect.SetLayer(LayerReflect)
+	reflect.SetEvent(EventReflectOpen)
+	reflect.Reflect().Flags = FlagSniff | FlagRecvOnly
+	reflect.Reflect().Priority = -3
+
+	for _, a := range []*Address{nw, flow, reflect} {
+		b, err := json.Marshal(a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Address
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != *a {
+			t.Errorf("%s: round trip = %v", b, &got)
+		}
+	}
+}
+
+func TestPacketRecordJSON(t *testing.T) {
+	a := NewInboundAddress(3, 1)
+	r := PacketRecord{Address: *a, Packet: []byte{0x45, 0, 0, 20}}
+
+	// marshaled by value
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"network":{"ifIdx":3,"subIfIdx":1}`) {
+		t.Errorf("address not marshaled by Address.MarshalJSON: %s", b)
+	}
+
+	var got PacketRecord
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Address != r.Address || string(got.Packet) != string(r.Packet) {
+		t.Errorf("round trip = %+v", got)
+	}
+}
+
+func TestAddressFormat(t *testing.T) {
+	a := NewInboundAddress(3, 1)
+	if s := fmt.Sprintf("%v", a); !strings.Contains(s, "ifIdx=3 subIfIdx=1") {
+		t.Errorf("%%v = %s", s)
+	}
+	if s := fmt.Sprintf("%q", a); !strings.HasPrefix(s, `"`) {
+		t.Errorf("%%q = %s", s)
+	}
+}
+
+func TestDeviceFormat(t *testing.T) {
+	d := &Device{addr: *NewInboundAddress(3, 1), iface: Interface{Index: 3, SubIndex: 1, Name: "eth0"}}
+	d.mtu.Store(1500)
+
+	s := fmt.Sprint(d)
+	if strings.Contains(s, "timestamp=") || !strings.Contains(s, "name=eth0") {
+		t.Errorf("Sprint = %s", s)
+	}
+
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), `"timestamp"`) || !strings.Contains(string(b), `"mtu":1500`) {
+		t.Errorf("Marshal = %s", b)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "syscall"
+
+var (
+	ErrNoData          = syscall.EWOULDBLOCK
+	ErrHostUnreachable = syscall.EHOSTUNREACH
+)
+
+// outOfBuffers are the errors of running out of buffers
+var outOfBuffers = []error{
+	syscall.ENOBUFS,
+	syscall.ENOMEM,
+}
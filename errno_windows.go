@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import "golang.org/x/sys/windows"
+
+var (
+	ErrNoData          = windows.WSAEWOULDBLOCK
+	ErrHostUnreachable = windows.WSAEHOSTUNREACH
+)
+
+// outOfBuffers are the errors of the driver running out of buffers
+var outOfBuffers = []error{
+	windows.ERROR_INSUFFICIENT_BUFFER,
+	windows.ERROR_NO_SYSTEM_RESOURCES,
+	windows.ERROR_NOT_ENOUGH_MEMORY,
+}
@@ -1,3 +1,6 @@
+//go:build windows
+// +build windows
+
 package windivert
 
 /*
@@ -10,10 +13,7 @@ HANDLE getLastError() {
 */
 import "C"
 
-import (
-	"fmt"
-	"syscall"
-)
+import "fmt"
 
 // getLastError returns the last error that occurred
 func getLastError() error {
@@ -23,8 +23,3 @@ func getLastError() error {
 	}
 	return fmt.Errorf("windivert error: %d", uint32(code))
 }
-
-var (
-	ErrNoData          = syscall.WSAEWOULDBLOCK
-	ErrHostUnreachable = syscall.WSAEHOSTUNREACH
-)
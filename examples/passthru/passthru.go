@@ -24,12 +24,13 @@ func main() {
 
 	// 数据包处理循环
 	packet := make([]byte, 1500)
+	addr := new(windivert.Address)
 	for {
 		select {
 		case <-sigCh:
 			return
 		default:
-			n, addr, err := handle.Recv(packet)
+			n, err := handle.Recv(packet, addr)
 			if err != nil {
 				fmt.Printf("Error receiving packet: %v\n", err)
 				continue
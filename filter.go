@@ -0,0 +1,538 @@
+package windivert
+
+import (
+	"errors"
+	"math/bits"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// FiltersOverlap reports whether a packet may match both filters. Filters
+// are compared term by term: fields compared with numbers or addresses are
+// taken as ranges, protocols, IP versions and directions exclude each
+// other, and anything else is taken as possibly true. It errs on the side
+// of overlap, filters it cannot parse, like compiled objects, overlap with
+// everything.
+func FiltersOverlap(a, b string) bool {
+	fa, err := parseFilterDNF(a)
+	if err != nil {
+		return true
+	}
+	fb, err := parseFilterDNF(b)
+	if err != nil {
+		return true
+	}
+
+	for _, ca := range fa {
+		if !filterSatisfiable(ca) {
+			continue
+		}
+		for _, cb := range fb {
+			if filterSatisfiable(append(append([]filterTerm{}, ca...), cb...)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var errFilterSyntax = errors.New("invalid filter")
+
+// FilterObjectsMax is the number of objects WinDivert compiles a filter
+// into at most, WINDIVERT_FILTER_MAXLEN
+const FilterObjectsMax = 256
+
+// ErrFilterTooLong is returned for a filter exceeding FilterObjectsMax
+var ErrFilterTooLong = errors.New("filter exceeds the objects WinDivert compiles")
+
+// FilterObjects estimates the objects WinDivert compiles filter into, one
+// per test of a field or constant. The filter is not checked otherwise.
+func FilterObjects(filter string) (int, error) {
+	toks, err := tokenizeFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i, t := range toks {
+		switch t {
+		case "(", ")", "?", ":", "!", "not", "and", "or", "&&", "||":
+			continue
+		}
+		if _, ok := filterNegOps[t]; ok || t == "=" {
+			continue
+		}
+		// values follow the fields they are compared with
+		if i > 0 && (filterNegOps[toks[i-1]] != "" || toks[i-1] == "=") {
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+// filterDNFMax bounds the conjunctions a filter is expanded to
+const filterDNFMax = 256
+
+// filterTerm compares a field with a value, a bare field is a comparison
+// with zero
+type filterTerm struct {
+	field string
+	op    string
+	val   string
+}
+
+var filterNegOps = map[string]string{
+	"==": "!=",
+	"!=": "==",
+	"<":  ">=",
+	">=": "<",
+	">":  "<=",
+	"<=": ">",
+}
+
+func (t filterTerm) negate() filterTerm {
+	t.op = filterNegOps[t.op]
+	return t
+}
+
+type filterNode struct {
+	// kind is one of "term", "and", "or", "not", "true" and "false"
+	kind string
+	term filterTerm
+	subs []*filterNode
+}
+
+type filterParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// expr is or ('?' expr ':' expr)?
+func (p *filterParser) expr() (*filterNode, error) {
+	c, err := p.or()
+	if err != nil || p.peek() != "?" {
+		return c, err
+	}
+	p.next()
+	a, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.next() != ":" {
+		return nil, errFilterSyntax
+	}
+	b, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	return &filterNode{kind: "or", subs: []*filterNode{
+		{kind: "and", subs: []*filterNode{c, a}},
+		{kind: "and", subs: []*filterNode{{kind: "not", subs: []*filterNode{c}}, b}},
+	}}, nil
+}
+
+func (p *filterParser) or() (*filterNode, error) {
+	return p.binary("or", "||", p.and)
+}
+
+func (p *filterParser) and() (*filterNode, error) {
+	return p.binary("and", "&&", p.unary)
+}
+
+func (p *filterParser) binary(kind, sym string, sub func() (*filterNode, error)) (*filterNode, error) {
+	n, err := sub()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == kind || p.peek() == sym {
+		p.next()
+		m, err := sub()
+		if err != nil {
+			return nil, err
+		}
+		n = &filterNode{kind: kind, subs: []*filterNode{n, m}}
+	}
+	return n, nil
+}
+
+func (p *filterParser) unary() (*filterNode, error) {
+	switch t := p.next(); t {
+	case "not", "!":
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNode{kind: "not", subs: []*filterNode{n}}, nil
+	case "(":
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errFilterSyntax
+		}
+		return n, nil
+	case "true", "false":
+		return &filterNode{kind: t}, nil
+	case "", ")", "?", ":", "and", "or", "&&", "||":
+		return nil, errFilterSyntax
+	default:
+		if _, ok := filterNegOps[p.peek()]; !ok && p.peek() != "=" {
+			return &filterNode{kind: "term", term: filterTerm{field: t, op: "!=", val: "0"}}, nil
+		}
+		op := p.next()
+		if op == "=" {
+			op = "=="
+		}
+		v := p.next()
+		if v == "" {
+			return nil, errFilterSyntax
+		}
+		return &filterNode{kind: "term", term: filterTerm{field: t, op: op, val: v}}, nil
+	}
+}
+
+// tokenizeFilter splits a filter into tokens, lower cased as WinDivert
+// ignores case
+func tokenizeFilter(s string) ([]string, error) {
+	toks := []string{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		// values follow comparisons, IPv6 addresses hold colons
+		value := len(toks) > 0 && (filterNegOps[toks[len(toks)-1]] != "" || toks[len(toks)-1] == "=")
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '?' || c == ':' && !value:
+			toks = append(toks, string(c))
+			i++
+		case strings.HasPrefix(s[i:], "&&") || strings.HasPrefix(s[i:], "||") ||
+			strings.HasPrefix(s[i:], "==") || strings.HasPrefix(s[i:], "!=") ||
+			strings.HasPrefix(s[i:], "<=") || strings.HasPrefix(s[i:], ">="):
+			toks = append(toks, s[i:i+2])
+			i += 2
+		case c == '!' || c == '<' || c == '>' || c == '=':
+			toks = append(toks, string(c))
+			i++
+		default:
+			j := i
+			for j < len(s) && filterWordByte(s[j], value) {
+				if s[j] == '[' {
+					for j < len(s) && s[j] != ']' {
+						j++
+					}
+				}
+				j++
+			}
+			if j == i {
+				return nil, errFilterSyntax
+			}
+			toks = append(toks, strings.ToLower(s[i:j]))
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// filterWordByte reports whether c continues a field name, or a value when
+// value is set, which may be an IPv6 address
+func filterWordByte(c byte, value bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	case c == '_' || c == '.' || c == '[' || c == '-':
+		return true
+	case c == ':':
+		return value
+	}
+	return false
+}
+
+// parseFilterDNF parses a filter into a disjunction of conjunctions
+func parseFilterDNF(s string) ([][]filterTerm, error) {
+	toks, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{toks: toks}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(toks) {
+		return nil, errFilterSyntax
+	}
+	return filterDNF(n, false)
+}
+
+// filterDNF expands n, negated when neg is set
+func filterDNF(n *filterNode, neg bool) ([][]filterTerm, error) {
+	kind := n.kind
+	if neg {
+		switch kind {
+		case "and":
+			kind = "or"
+		case "or":
+			kind = "and"
+		case "true":
+			kind = "false"
+		case "false":
+			kind = "true"
+		}
+	}
+
+	switch kind {
+	case "true":
+		return [][]filterTerm{{}}, nil
+	case "false":
+		return nil, nil
+	case "term":
+		if neg {
+			return [][]filterTerm{{n.term.negate()}}, nil
+		}
+		return [][]filterTerm{{n.term}}, nil
+	case "not":
+		return filterDNF(n.subs[0], !neg)
+	case "or":
+		out := [][]filterTerm{}
+		for _, sub := range n.subs {
+			d, err := filterDNF(sub, neg)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, d...)
+			if len(out) > filterDNFMax {
+				return nil, errFilterSyntax
+			}
+		}
+		return out, nil
+	case "and":
+		out := [][]filterTerm{{}}
+		for _, sub := range n.subs {
+			d, err := filterDNF(sub, neg)
+			if err != nil {
+				return nil, err
+			}
+			if len(out)*len(d) > filterDNFMax {
+				return nil, errFilterSyntax
+			}
+			prod := make([][]filterTerm, 0, len(out)*len(d))
+			for _, a := range out {
+				for _, b := range d {
+					prod = append(prod, append(append([]filterTerm{}, a...), b...))
+				}
+			}
+			out = prod
+		}
+		return out, nil
+	}
+	return nil, errFilterSyntax
+}
+
+// filterUint is a 128-bit field value
+type filterUint struct {
+	hi, lo uint64
+}
+
+var filterUintMax = filterUint{^uint64(0), ^uint64(0)}
+
+func (a filterUint) cmp(b filterUint) int {
+	switch {
+	case a.hi < b.hi || a.hi == b.hi && a.lo < b.lo:
+		return -1
+	case a == b:
+		return 0
+	default:
+		return 1
+	}
+}
+
+func (a filterUint) inc() filterUint {
+	lo, c := bits.Add64(a.lo, 1, 0)
+	return filterUint{a.hi + c, lo}
+}
+
+func (a filterUint) dec() filterUint {
+	lo, b := bits.Sub64(a.lo, 1, 0)
+	return filterUint{a.hi - b, lo}
+}
+
+// parseFilterValue parses a number or an address, ok is false for symbolic
+// values
+func parseFilterValue(s string) (filterUint, bool) {
+	if n, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return filterUint{0, n}, true
+	}
+	if a, err := netip.ParseAddr(s); err == nil {
+		if a.Is4() {
+			b := a.As4()
+			return filterUint{0, uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])}, true
+		}
+		b := a.As16()
+		var v filterUint
+		for i := 0; i < 8; i++ {
+			v.hi = v.hi<<8 | uint64(b[i])
+			v.lo = v.lo<<8 | uint64(b[8+i])
+		}
+		return v, true
+	}
+	return filterUint{}, false
+}
+
+// filterRange is what a conjunction allows for a field
+type filterRange struct {
+	lo, hi filterUint
+	ne     []filterUint
+	sym    string
+	nesym  []string
+}
+
+// filterExclusive are fields of which at most one is true
+var filterExclusive = [][]string{
+	{"tcp", "udp", "icmp", "icmpv6"},
+	{"ip", "ipv6"},
+	{"inbound", "outbound"},
+}
+
+// filterBoolean are the fields that are 0 or 1
+var filterBoolean = map[string]bool{}
+
+func init() {
+	for _, g := range filterExclusive {
+		for _, f := range g {
+			filterBoolean[f] = true
+		}
+	}
+	for _, f := range []string{"loopback", "impostor", "fragment", "sniffed"} {
+		filterBoolean[f] = true
+	}
+}
+
+// filterSatisfiable reports whether a conjunction may be true
+func filterSatisfiable(c []filterTerm) bool {
+	rs := map[string]*filterRange{}
+	get := func(f string) *filterRange {
+		r, ok := rs[f]
+		if !ok {
+			r = &filterRange{hi: filterUintMax}
+			if filterBoolean[f] {
+				r.hi = filterUint{0, 1}
+			}
+			rs[f] = r
+		}
+		return r
+	}
+
+	for _, t := range c {
+		// fields of a header imply its protocol
+		if i := strings.IndexByte(t.field, '.'); i > 0 {
+			if p := t.field[:i]; filterBoolean[p] {
+				r := get(p)
+				if r.lo.cmp(filterUint{0, 1}) < 0 {
+					r.lo = filterUint{0, 1}
+				}
+			}
+		}
+
+		r := get(t.field)
+		v, ok := parseFilterValue(t.val)
+		if !ok {
+			switch t.op {
+			case "==":
+				if r.sym != "" && r.sym != t.val {
+					return false
+				}
+				r.sym = t.val
+			case "!=":
+				r.nesym = append(r.nesym, t.val)
+			}
+			continue
+		}
+
+		switch t.op {
+		case "==":
+			if r.lo.cmp(v) < 0 {
+				r.lo = v
+			}
+			if r.hi.cmp(v) > 0 {
+				r.hi = v
+			}
+		case "!=":
+			r.ne = append(r.ne, v)
+		case "<":
+			if v == (filterUint{}) {
+				return false
+			}
+			if r.hi.cmp(v.dec()) > 0 {
+				r.hi = v.dec()
+			}
+		case "<=":
+			if r.hi.cmp(v) > 0 {
+				r.hi = v
+			}
+		case ">":
+			if v == filterUintMax {
+				return false
+			}
+			if r.lo.cmp(v.inc()) < 0 {
+				r.lo = v.inc()
+			}
+		case ">=":
+			if r.lo.cmp(v) < 0 {
+				r.lo = v
+			}
+		}
+	}
+
+	for _, r := range rs {
+		for _, s := range r.nesym {
+			if s == r.sym {
+				return false
+			}
+		}
+		for changed := true; changed; {
+			if r.lo.cmp(r.hi) > 0 {
+				return false
+			}
+			changed = false
+			for _, v := range r.ne {
+				switch {
+				case v == r.lo && v == r.hi:
+					return false
+				case v == r.lo:
+					r.lo, changed = r.lo.inc(), true
+				case v == r.hi:
+					r.hi, changed = r.hi.dec(), true
+				}
+			}
+		}
+	}
+
+	for _, g := range filterExclusive {
+		n := 0
+		for _, f := range g {
+			if r, ok := rs[f]; ok && r.lo.cmp(filterUint{}) > 0 {
+				n++
+			}
+		}
+		if n > 1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package windivert
+
+import "testing"
+
+func TestFiltersOverlap(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"true", "true", true},
+		{"false", "true", false},
+		{"tcp", "udp", false},
+		{"tcp", "tcp.DstPort == 80", true},
+		{"udp", "tcp.DstPort == 80", false},
+		{"tcp.DstPort == 80", "tcp.DstPort == 443", false},
+		{"tcp.DstPort == 80", "tcp.DstPort = 80", true},
+		{"tcp.DstPort = 80", "tcp.DstPort = 443", false},
+		{"ip.DstAddr = 255.255.255.255", "ip.DstAddr = 10.0.0.1", false},
+		{"tcp.DstPort < 1024", "tcp.DstPort >= 1024", false},
+		{"tcp.DstPort <= 1024", "tcp.DstPort >= 1024", true},
+		{"tcp.DstPort > 1024 and tcp.DstPort < 1026", "tcp.DstPort != 1025", false},
+		{"outbound and tcp", "inbound", false},
+		{"outbound and tcp", "not outbound", false},
+		{"outbound and tcp", "!inbound && tcp", true},
+		{"ip", "ipv6.DstAddr == ::1", false},
+		{"ip.DstAddr >= 10.0.0.0 and ip.DstAddr <= 10.255.255.255", "ip.DstAddr == 10.1.2.3", true},
+		{"ip.DstAddr >= 10.0.0.0 and ip.DstAddr <= 10.255.255.255", "ip.DstAddr == 192.168.1.1", false},
+		{"ipv6.DstAddr >= fe80:: and ipv6.DstAddr <= febf:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "ipv6.DstAddr == 2001:db8::1", false},
+		{"tcp.DstPort == 80 or udp.DstPort == 53", "udp", true},
+		{"tcp.DstPort == 80 or udp.DstPort == 53", "icmp", false},
+		{"(tcp ? tcp.DstPort == 80 : udp)", "tcp.DstPort == 443", false},
+		{"(tcp ? tcp.DstPort == 80 : udp)", "udp.DstPort == 443", true},
+		{"not (tcp or udp)", "tcp.DstPort == 80", false},
+		{"ifIdx == 3", "ifIdx == 4", false},
+		{"ifIdx == 3", "ifIdx == 0x3", true},
+		{"layer == NETWORK", "layer == FLOW", false},
+		{"TCP.DSTPORT == 80", "tcp.DstPort == 443", false},
+		{"packet[0] == 0x45", "packet[0] == 0x60", false},
+		{"processId == 4", "tcp", true},
+		// cannot be parsed, taken as overlapping
+		{"@#$", "false", true},
+		{"tcp and", "udp", true},
+	}
+	for i, tt := range cases {
+		// filters that cannot be parsed overlap with everything, only the
+		// last cases are meant not to parse
+		if i < len(cases)-2 {
+			for _, f := range []string{tt.a, tt.b} {
+				if _, err := parseFilterDNF(f); err != nil {
+					t.Errorf("parse %q: %v", f, err)
+				}
+			}
+		}
+		if got := FiltersOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("FiltersOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+		if got := FiltersOverlap(tt.b, tt.a); got != tt.want {
+			t.Errorf("FiltersOverlap(%q, %q) = %v, want %v", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestHandleInventoryConflicts(t *testing.T) {
+	v := NewHandleInventory()
+	n := 0
+	v.Subscribe(func(HandleEvent) { n++ })
+
+	a := Address{}
+	a.SetLayer(LayerReflect)
+	a.SetEvent(EventReflectOpen)
+	r := a.Reflect()
+	r.ProcessID = 99
+	r.Priority = 10
+	r.TimeStamp = 5
+	// the filter is taken as is where it cannot be formatted
+	v.Process(&a, []byte("tcp.DstPort == 80\x00junk"))
+
+	for _, tt := range []struct {
+		priority int16
+		filter   string
+		want     int
+	}{
+		{0, "tcp", 1},
+		{10, "true", 1},
+		{11, "tcp", 0},
+		{0, "udp", 0},
+		{0, "tcp.DstPort == 443", 0},
+	} {
+		if hs := v.Conflicts(LayerNetwork, tt.priority, tt.filter); len(hs) != tt.want {
+			t.Errorf("Conflicts(%d, %q) = %v", tt.priority, tt.filter, hs)
+		}
+	}
+	if hs := v.Conflicts(LayerFlow, 0, "true"); len(hs) != 0 {
+		t.Errorf("Conflicts on another layer = %v", hs)
+	}
+
+	a.SetEvent(EventReflectClose)
+	v.Process(&a, nil)
+	if len(v.Handles()) != 0 || n != 2 {
+		t.Errorf("Handles() = %v after %d events", v.Handles(), n)
+	}
+}
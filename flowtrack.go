@@ -0,0 +1,400 @@
+package windivert
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// FlowEntry is a connection, or a bound endpoint, and the process owning it.
+// Tuple.Src is the local and Tuple.Dst the remote endpoint, the remote
+// endpoint is left zero when it is not known.
+type FlowEntry struct {
+	Tuple      FiveTuple
+	ProcessID  uint32
+	EndpointID uint64
+	Timestamp  int64
+}
+
+// FlowEvent is passed to the subscribers of a FlowTracker
+type FlowEvent struct {
+	// Event is EventFlowEstablished or EventFlowDeleted
+	Event Event
+	FlowEntry
+}
+
+// FlowSource lists the connections that already exist, so that a
+// FlowTracker can attribute connections made before it started
+type FlowSource interface {
+	Flows() ([]FlowEntry, error)
+}
+
+// localKey identifies a local endpoint
+type localKey struct {
+	proto uint8
+	ap    netip.AddrPort
+}
+
+type localRef struct {
+	pid uint32
+	n   int
+}
+
+// flowSet indexes flows by tuple and by local endpoint
+type flowSet struct {
+	flows  map[FiveTuple]FlowEntry
+	locals map[localKey]*localRef
+}
+
+func newFlowSet() flowSet {
+	return flowSet{
+		flows:  make(map[FiveTuple]FlowEntry),
+		locals: make(map[localKey]*localRef),
+	}
+}
+
+func (s *flowSet) add(e FlowEntry) {
+	if _, ok := s.flows[e.Tuple]; ok {
+		s.remove(e.Tuple)
+	}
+	s.flows[e.Tuple] = e
+
+	k := localKey{proto: e.Tuple.Protocol, ap: e.Tuple.Src()}
+	if r, ok := s.locals[k]; ok {
+		r.pid = e.ProcessID
+		r.n++
+		return
+	}
+	s.locals[k] = &localRef{pid: e.ProcessID, n: 1}
+}
+
+func (s *flowSet) remove(t FiveTuple) (FlowEntry, bool) {
+	e, ok := s.flows[t]
+	if !ok {
+		return e, false
+	}
+	delete(s.flows, t)
+
+	k := localKey{proto: t.Protocol, ap: t.Src()}
+	if r, ok := s.locals[k]; ok {
+		if r.n--; r.n == 0 {
+			delete(s.locals, k)
+		}
+	}
+	return e, true
+}
+
+// lookup tries the exact tuple, then the local endpoint and then the local
+// port bound to the unspecified address
+func (s *flowSet) lookup(t FiveTuple) (uint32, bool) {
+	if e, ok := s.flows[t]; ok {
+		return e.ProcessID, true
+	}
+	if r, ok := s.locals[localKey{proto: t.Protocol, ap: t.Src()}]; ok {
+		return r.pid, true
+	}
+
+	unspec := netip.IPv4Unspecified()
+	if t.SrcAddr.Is6() {
+		unspec = netip.IPv6Unspecified()
+	}
+	if r, ok := s.locals[localKey{proto: t.Protocol, ap: netip.AddrPortFrom(unspec, t.SrcPort)}]; ok {
+		return r.pid, true
+	}
+	return 0, false
+}
+
+const (
+	// FlowRefreshIntervalDefault is the least time between two snapshots
+	// taken on lookup misses
+	FlowRefreshIntervalDefault = time.Second
+	// FlowMissTimeoutDefault is how long a connection no process was found
+	// for is not looked up again
+	FlowMissTimeoutDefault = 2 * time.Second
+
+	// flowMissesMax bounds the remembered misses before expired ones are
+	// purged
+	flowMissesMax = 4096
+)
+
+// FlowTracker maps connections to the processes owning them. It is fed
+// with the events of a LayerFlow handle by Run, or with recorded events by
+// Process, and falls back to the snapshots of a FlowSource for connections
+// it has not seen established.
+type FlowTracker struct {
+	// Source lists existing connections, no fallback is made when nil
+	Source FlowSource
+	// RefreshInterval and MissTimeout throttle the snapshots taken on
+	// lookup misses
+	RefreshInterval time.Duration
+	MissTimeout     time.Duration
+
+	mu       sync.RWMutex
+	live     flowSet
+	snapshot flowSet
+	subs     map[int]func(FlowEvent)
+	nextSub  int
+
+	// rmu guards the misses and the refresh in flight
+	rmu        sync.Mutex
+	misses     map[FiveTuple]time.Time
+	refreshing chan struct{}
+	refreshed  time.Time
+}
+
+// NewFlowTracker creates a tracker falling back to src
+func NewFlowTracker(src FlowSource) *FlowTracker {
+	return &FlowTracker{
+		Source:          src,
+		RefreshInterval: FlowRefreshIntervalDefault,
+		MissTimeout:     FlowMissTimeoutDefault,
+		live:            newFlowSet(),
+		snapshot:        newFlowSet(),
+		subs:            make(map[int]func(FlowEvent)),
+		misses:          make(map[FiveTuple]time.Time),
+	}
+}
+
+// Len returns the number of established flows
+func (t *FlowTracker) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.live.flows)
+}
+
+// Flows returns the established flows
+func (t *FlowTracker) Flows() []FlowEntry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	es := make([]FlowEntry, 0, len(t.live.flows))
+	for _, e := range t.live.flows {
+		es = append(es, e)
+	}
+	return es
+}
+
+// Subscribe calls fn for every flow established or deleted until cancel is
+// called. fn is called from the goroutine feeding the tracker and must not
+// block.
+func (t *FlowTracker) Subscribe(fn func(FlowEvent)) (cancel func()) {
+	t.mu.Lock()
+	id := t.nextSub
+	t.nextSub++
+	t.subs[id] = fn
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.subs, id)
+		t.mu.Unlock()
+	}
+}
+
+// Process feeds a flow layer address to the tracker, other addresses are
+// ignored
+func (t *FlowTracker) Process(addr *Address) {
+	if addr.Layer() != LayerFlow {
+		return
+	}
+
+	local, _ := addr.LocalAddrPort()
+	remote, _ := addr.RemoteAddrPort()
+	f := addr.Flow()
+
+	ev := FlowEvent{
+		Event: addr.Event(),
+		FlowEntry: FlowEntry{
+			Tuple: FiveTuple{
+				Protocol: f.Protocol,
+				SrcAddr:  local.Addr(),
+				DstAddr:  remote.Addr(),
+				SrcPort:  local.Port(),
+				DstPort:  remote.Port(),
+			},
+			ProcessID:  f.ProcessID,
+			EndpointID: f.EndpointID,
+			Timestamp:  addr.Timestamp,
+		},
+	}
+
+	t.mu.Lock()
+	switch ev.Event {
+	case EventFlowEstablished:
+		t.live.add(ev.FlowEntry)
+		t.snapshot.remove(ev.Tuple)
+	case EventFlowDeleted:
+		if e, ok := t.live.remove(ev.Tuple); ok {
+			ev.FlowEntry = e
+		}
+		t.snapshot.remove(ev.Tuple)
+	default:
+		t.mu.Unlock()
+		return
+	}
+	subs := make([]func(FlowEvent), 0, len(t.subs))
+	for _, fn := range t.subs {
+		subs = append(subs, fn)
+	}
+	t.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
+// Replay feeds recorded flow layer addresses in order
+func (t *FlowTracker) Replay(addrs []Address) {
+	for i := range addrs {
+		t.Process(&addrs[i])
+	}
+}
+
+// Lookup returns the process owning the connection t, t.Src being the
+// local endpoint. When the connection is not tracked the snapshot of Source
+// is refreshed, at most once per RefreshInterval and with lookups missing
+// at the same time waiting for the same snapshot. A connection still not
+// found is not looked up again for MissTimeout.
+func (t *FlowTracker) Lookup(ft FiveTuple) (uint32, bool) {
+	if pid, ok := t.lookup(ft); ok || t.Source == nil {
+		return pid, ok
+	}
+
+	now := time.Now()
+	t.rmu.Lock()
+	expire, missed := t.misses[ft]
+	t.rmu.Unlock()
+	if missed && now.Before(expire) {
+		return 0, false
+	}
+
+	t.refresh(now)
+
+	pid, ok := t.lookup(ft)
+	if !ok {
+		t.miss(ft, now)
+	}
+	return pid, ok
+}
+
+func (t *FlowTracker) lookup(ft FiveTuple) (uint32, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if pid, ok := t.live.lookup(ft); ok {
+		return pid, true
+	}
+	return t.snapshot.lookup(ft)
+}
+
+// refresh takes a snapshot unless one was taken within RefreshInterval, or
+// waits for the one being taken
+func (t *FlowTracker) refresh(now time.Time) {
+	t.rmu.Lock()
+	if ch := t.refreshing; ch != nil {
+		t.rmu.Unlock()
+		<-ch
+		return
+	}
+	if now.Sub(t.refreshed) < t.RefreshInterval {
+		t.rmu.Unlock()
+		return
+	}
+	ch := make(chan struct{})
+	t.refreshing = ch
+	t.rmu.Unlock()
+
+	// a failed snapshot is not retried before the interval either
+	t.Refresh()
+
+	t.rmu.Lock()
+	t.refreshing, t.refreshed = nil, time.Now()
+	t.rmu.Unlock()
+	close(ch)
+}
+
+// miss remembers that no process owns ft
+func (t *FlowTracker) miss(ft FiveTuple, now time.Time) {
+	t.rmu.Lock()
+	defer t.rmu.Unlock()
+
+	if len(t.misses) >= flowMissesMax {
+		for k, expire := range t.misses {
+			if now.After(expire) {
+				delete(t.misses, k)
+			}
+		}
+	}
+	if len(t.misses) < flowMissesMax {
+		t.misses[ft] = now.Add(t.MissTimeout)
+	}
+}
+
+// LookupPacket returns the process owning the connection of a packet
+func (t *FlowTracker) LookupPacket(b []byte, outbound bool) (uint32, bool) {
+	ft, err := ParseFiveTuple(b)
+	if err != nil {
+		return 0, false
+	}
+	if !outbound {
+		ft = ft.Reverse()
+	}
+	return t.Lookup(ft)
+}
+
+// Refresh replaces the snapshot with a new one taken from Source
+func (t *FlowTracker) Refresh() error {
+	if t.Source == nil {
+		return nil
+	}
+
+	es, err := t.Source.Flows()
+	if err != nil {
+		return err
+	}
+
+	s := newFlowSet()
+	for _, e := range es {
+		s.add(e)
+	}
+
+	t.mu.Lock()
+	t.snapshot = s
+	t.mu.Unlock()
+	return nil
+}
+
+// Run opens a flow layer handle and feeds its events to the tracker until
+// ctx is done
+func (t *FlowTracker) Run(ctx context.Context) error {
+	hd, err := Open("true", LayerFlow, PriorityDefault, FlagSniff|FlagRecvOnly)
+	if err != nil {
+		return fmt.Errorf("open flow handle error: %v", err)
+	}
+	defer hd.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hd.Shutdown(ShutdownBoth)
+		case <-done:
+		}
+	}()
+
+	// flow events carry no packet, the buffer only has to be non empty
+	b := [][]byte{make([]byte, 1)}
+	a := make([]Address, 1)
+	for {
+		if _, _, err := hd.RecvEx(b, a, 0); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("recv error: %v", err)
+		}
+		t.Process(&a[0])
+	}
+}
@@ -0,0 +1,136 @@
+package windivert
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingFlowSource counts the snapshots taken
+type countingFlowSource struct {
+	entries []FlowEntry
+	n       atomic.Int32
+	delay   time.Duration
+}
+
+func (s *countingFlowSource) Flows() ([]FlowEntry, error) {
+	s.n.Add(1)
+	time.Sleep(s.delay)
+	return s.entries, nil
+}
+
+func flowAddress(ev Event, pid uint32, local, remote string) Address {
+	a := Address{}
+	a.SetLayer(LayerFlow)
+	a.SetEvent(ev)
+	f := a.Flow()
+	f.ProcessID = pid
+	f.Protocol = 6
+	f.SetLocalAddrPort(netip.MustParseAddrPort(local))
+	f.SetRemoteAddrPort(netip.MustParseAddrPort(remote))
+	return a
+}
+
+func testTuple(proto uint8, local, remote string) FiveTuple {
+	l, r := netip.MustParseAddrPort(local), netip.MustParseAddrPort(remote)
+	return FiveTuple{Protocol: proto, SrcAddr: l.Addr(), DstAddr: r.Addr(), SrcPort: l.Port(), DstPort: r.Port()}
+}
+
+func TestFlowTracker(t *testing.T) {
+	src := &countingFlowSource{entries: []FlowEntry{
+		{Tuple: FiveTuple{Protocol: 17, SrcAddr: netip.IPv4Unspecified(), SrcPort: 5353}, ProcessID: 9},
+	}}
+	tr := NewFlowTracker(src)
+
+	var evs []FlowEvent
+	cancel := tr.Subscribe(func(e FlowEvent) { evs = append(evs, e) })
+	tr.Replay([]Address{
+		flowAddress(EventFlowEstablished, 42, "10.0.0.1:1234", "1.1.1.1:443"),
+		flowAddress(EventFlowEstablished, 43, "10.0.0.1:1235", "1.1.1.1:443"),
+		flowAddress(EventFlowDeleted, 0, "10.0.0.1:1235", "1.1.1.1:443"),
+	})
+	cancel()
+
+	if len(evs) != 3 || evs[2].ProcessID != 43 {
+		t.Fatalf("events = %v", evs)
+	}
+	if tr.Len() != 1 {
+		t.Errorf("Len() = %d", tr.Len())
+	}
+
+	for _, tt := range []struct {
+		name  string
+		tuple FiveTuple
+		pid   uint32
+		ok    bool
+		snaps int32
+	}{
+		{"live", testTuple(6, "10.0.0.1:1234", "1.1.1.1:443"), 42, true, 0},
+		{"snapshot bound to any", testTuple(17, "192.168.1.2:5353", "224.0.0.251:5353"), 9, true, 1},
+		{"deleted", testTuple(6, "10.0.0.1:1235", "1.1.1.1:443"), 0, false, 1},
+		{"reversed", testTuple(6, "1.1.1.1:443", "10.0.0.1:1234"), 0, false, 1},
+	} {
+		pid, ok := tr.Lookup(tt.tuple)
+		if pid != tt.pid || ok != tt.ok {
+			t.Errorf("%s: Lookup = %d, %v", tt.name, pid, ok)
+		}
+		if n := src.n.Load(); n != tt.snaps {
+			t.Errorf("%s: %d snapshots, want %d", tt.name, n, tt.snaps)
+		}
+	}
+}
+
+func TestFlowTrackerThrottle(t *testing.T) {
+	src := &countingFlowSource{delay: 10 * time.Millisecond}
+	tr := NewFlowTracker(src)
+	tr.RefreshInterval = time.Hour
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tr.Lookup(FiveTuple{Protocol: 17, SrcAddr: netip.MustParseAddr("10.0.0.1"), SrcPort: uint16(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	if n := src.n.Load(); n != 1 {
+		t.Errorf("%d snapshots for concurrent misses", n)
+	}
+	for i := 0; i < 50; i++ {
+		tr.Lookup(FiveTuple{Protocol: 17, SrcAddr: netip.MustParseAddr("10.0.0.1"), SrcPort: uint16(i)})
+	}
+	if n := src.n.Load(); n != 1 {
+		t.Errorf("%d snapshots within the interval", n)
+	}
+}
+
+func TestFlowTrackerMissTimeout(t *testing.T) {
+	src := &countingFlowSource{}
+	tr := NewFlowTracker(src)
+	tr.RefreshInterval = 0
+	ft := testTuple(6, "10.0.0.1:1234", "1.1.1.1:443")
+
+	tr.Lookup(ft)
+	tr.Lookup(ft)
+	if n := src.n.Load(); n != 1 {
+		t.Fatalf("%d snapshots, the miss was not remembered", n)
+	}
+
+	// a flow established since is found at once
+	a := flowAddress(EventFlowEstablished, 7, "10.0.0.1:1234", "1.1.1.1:443")
+	tr.Process(&a)
+	if pid, ok := tr.Lookup(ft); !ok || pid != 7 {
+		t.Errorf("Lookup = %d, %v", pid, ok)
+	}
+
+	tr.MissTimeout = 0
+	tr.Lookup(testTuple(6, "10.0.0.1:1", "1.1.1.1:443"))
+	tr.Lookup(testTuple(6, "10.0.0.1:1", "1.1.1.1:443"))
+	if n := src.n.Load(); n != 3 {
+		t.Errorf("%d snapshots without a miss timeout, want 3", n)
+	}
+}
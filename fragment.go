@@ -0,0 +1,518 @@
+package windivert
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+var (
+	ErrFragmentOverlap  = errors.New("overlapping fragment")
+	ErrFragmentTooLarge = errors.New("reassembled packet too large")
+	ErrFragmentLimit    = errors.New("fragment memory limit exceeded")
+	ErrFragmentNeeded   = errors.New("packet exceeds mtu and must not be fragmented")
+)
+
+const (
+	// FragmentTimeoutDefault is how long an incomplete datagram is kept
+	FragmentTimeoutDefault = 30 * time.Second
+	// FragmentMemoryDefault bounds the bytes held by incomplete datagrams
+	FragmentMemoryDefault = 4 << 20
+)
+
+// fragKey identifies the fragments of one datagram. proto is zero for
+// IPv6, where it is not part of the key.
+type fragKey struct {
+	src   netip.Addr
+	dst   netip.Addr
+	id    uint32
+	proto uint8
+}
+
+// fragKeyOf returns the key and fragment offset of a fragment and whether
+// it is a fragment at all
+func fragKeyOf(b []byte) (k fragKey, off int, ok bool) {
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		if len(b) < ipv4.HeaderLen {
+			return
+		}
+		f := int(b[6])<<8 | int(b[7])
+		if f&0x3fff == 0 {
+			return
+		}
+		k = fragKey{
+			src:   netip.AddrFrom4([4]byte(b[12:16])),
+			dst:   netip.AddrFrom4([4]byte(b[16:20])),
+			id:    uint32(b[4])<<8 | uint32(b[5]),
+			proto: b[9],
+		}
+		return k, (f & 0x1fff) << 3, true
+	case ipv6.Version:
+		e, err := parseIPv6Ext(b)
+		if err != nil || e.frag == 0 {
+			return
+		}
+		k = fragKey{
+			src: netip.AddrFrom16([16]byte(b[8:24])),
+			dst: netip.AddrFrom16([16]byte(b[24:40])),
+			id:  binary.BigEndian.Uint32(b[e.frag+4:]),
+		}
+		return k, (int(b[e.frag+2])<<8 | int(b[e.frag+3])) &^ 7, true
+	}
+	return
+}
+
+type fragment struct {
+	off  int
+	end  int
+	data []byte
+}
+
+// fragQueue holds the fragments of one datagram
+type fragQueue struct {
+	key    fragKey
+	elem   *list.Element
+	expire time.Time
+	// header is the unfragmentable part of the first fragment and nh the
+	// offset of the next header field to restore to proto (IPv6 only)
+	header []byte
+	nh     int
+	proto  uint8
+	frags  []fragment
+	total  int
+	recv   int
+	// bad is set once an overlap is seen, the datagram is then discarded
+	// together with any fragment arriving until it expires (RFC 5722)
+	bad bool
+}
+
+// Reassembler reassembles IPv4 and IPv6 fragments as delivered by a handle
+// opened with FlagFragments
+type Reassembler struct {
+	// Timeout is how long an incomplete datagram is kept
+	Timeout time.Duration
+	// MaxBytes bounds the payload bytes held across incomplete datagrams
+	MaxBytes int
+
+	mu     sync.Mutex
+	queues map[fragKey]*fragQueue
+	order  *list.List
+	size   int
+}
+
+// NewReassembler creates a reassembler with default limits
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		Timeout:  FragmentTimeoutDefault,
+		MaxBytes: FragmentMemoryDefault,
+		queues:   make(map[fragKey]*fragQueue),
+		order:    list.New(),
+	}
+}
+
+// Pending returns the number of incomplete datagrams
+func (r *Reassembler) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queues)
+}
+
+// Process feeds a packet to the reassembler. Packets that are not fragments
+// are returned unchanged. A fragment is retained and nil is returned until
+// the datagram is complete, then the reassembled packet is returned.
+func (r *Reassembler) Process(b []byte) ([]byte, error) {
+	return r.ProcessAt(b, time.Now())
+}
+
+// ProcessAt is like Process but uses now as the current time
+func (r *Reassembler) ProcessAt(b []byte, now time.Time) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, ErrInvalidPacket
+	}
+
+	var (
+		k       fragKey
+		hdr     []byte
+		payload []byte
+		nh      = -1
+		proto   uint8
+		off     int
+		more    bool
+		max     int
+	)
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		if len(b) < ipv4.HeaderLen {
+			return nil, ErrInvalidPacket
+		}
+		hl := int(b[0]&0x0f) << 2
+		tl := int(b[2])<<8 | int(b[3])
+		if hl < ipv4.HeaderLen || tl < hl || len(b) < tl {
+			return nil, ErrInvalidPacket
+		}
+
+		f := int(b[6])<<8 | int(b[7])
+		off, more = (f&0x1fff)<<3, f&0x2000 != 0
+		if off == 0 && !more {
+			return b, nil
+		}
+
+		k, _, _ = fragKeyOf(b)
+		hdr, payload, max = b[:hl], b[hl:tl], 0xffff-hl
+	case ipv6.Version:
+		e, err := parseIPv6Ext(b)
+		if err != nil {
+			return nil, err
+		}
+		if e.frag == 0 {
+			return b, nil
+		}
+
+		fo := int(b[e.frag+2])<<8 | int(b[e.frag+3])
+		off, more = fo&^7, fo&1 != 0
+
+		k, _, _ = fragKeyOf(b)
+		hdr, nh, proto = b[:e.frag], e.fragNH, b[e.frag]
+		payload, max = b[e.frag+8:ipv6.HeaderLen+(int(b[4])<<8|int(b[5]))], 0xffff-(e.frag-ipv6.HeaderLen)
+	default:
+		return nil, ErrInvalidPacket
+	}
+
+	end := off + len(payload)
+	if end > max {
+		return nil, ErrFragmentTooLarge
+	}
+	if more && len(payload)&7 != 0 {
+		return nil, ErrInvalidPacket
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.expire(now)
+
+	q, ok := r.queues[k]
+	if !ok {
+		q = &fragQueue{key: k, expire: now.Add(r.Timeout), total: -1}
+		q.elem = r.order.PushBack(q)
+		r.queues[k] = q
+	}
+
+	if q.bad {
+		return nil, ErrFragmentOverlap
+	}
+
+	if !more {
+		if q.total >= 0 && q.total != end {
+			r.drop(q)
+			return nil, ErrInvalidPacket
+		}
+		if n := len(q.frags); n > 0 && q.frags[n-1].end > end {
+			r.drop(q)
+			return nil, ErrInvalidPacket
+		}
+		q.total = end
+	} else if q.total >= 0 && end > q.total {
+		r.drop(q)
+		return nil, ErrInvalidPacket
+	}
+
+	i := sort.Search(len(q.frags), func(i int) bool { return q.frags[i].end > off })
+	if i < len(q.frags) && q.frags[i].off < end {
+		if q.frags[i].off == off && q.frags[i].end == end {
+			// exact duplicate, usually a retransmission
+			return nil, nil
+		}
+		r.release(q)
+		q.bad = true
+		return nil, ErrFragmentOverlap
+	}
+
+	for r.size+len(payload) > r.MaxBytes {
+		e := r.order.Front()
+		if e == nil || e.Value.(*fragQueue) == q {
+			r.drop(q)
+			return nil, ErrFragmentLimit
+		}
+		r.drop(e.Value.(*fragQueue))
+	}
+
+	q.frags = append(q.frags, fragment{})
+	copy(q.frags[i+1:], q.frags[i:])
+	q.frags[i] = fragment{off: off, end: end, data: append([]byte(nil), payload...)}
+	q.recv += len(payload)
+	r.size += len(payload)
+
+	if off == 0 {
+		q.header, q.nh, q.proto = append([]byte(nil), hdr...), nh, proto
+	}
+
+	if q.header == nil || q.recv != q.total {
+		return nil, nil
+	}
+
+	out := make([]byte, len(q.header)+q.total)
+	copy(out, q.header)
+	for _, f := range q.frags {
+		copy(out[len(q.header)+f.off:], f.data)
+	}
+	r.drop(q)
+
+	if q.nh < 0 {
+		binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+		out[6] &= 0x40
+		out[7] = 0
+		setIPv4HeaderChecksum(out)
+	} else {
+		out[q.nh] = q.proto
+		binary.BigEndian.PutUint16(out[4:], uint16(len(out)-ipv6.HeaderLen))
+	}
+
+	return out, nil
+}
+
+// expire drops datagrams whose timeout elapsed
+func (r *Reassembler) expire(now time.Time) {
+	for e := r.order.Front(); e != nil; e = r.order.Front() {
+		q := e.Value.(*fragQueue)
+		if now.Before(q.expire) {
+			return
+		}
+		r.drop(q)
+	}
+}
+
+// release frees the fragments held by q
+func (r *Reassembler) release(q *fragQueue) {
+	for _, f := range q.frags {
+		r.size -= len(f.data)
+	}
+	q.frags, q.header = nil, nil
+}
+
+// drop removes q from the reassembler
+func (r *Reassembler) drop(q *fragQueue) {
+	r.release(q)
+	r.order.Remove(q.elem)
+	delete(r.queues, q.key)
+}
+
+// fragmentID is the identification used for IPv6 fragments
+var fragmentID = rand.Uint32()
+
+// Fragment splits an IP packet into fragments of at most mtu bytes. Packets
+// that fit are returned as is. IPv4 packets with the don't fragment bit set
+// return ErrFragmentNeeded.
+func Fragment(b []byte, mtu int) ([][]byte, error) {
+	if len(b) == 0 {
+		return nil, ErrInvalidPacket
+	}
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		return fragmentIPv4(b, mtu)
+	case ipv6.Version:
+		return fragmentIPv6(b, mtu)
+	default:
+		return nil, ErrInvalidPacket
+	}
+}
+
+func fragmentIPv4(b []byte, mtu int) ([][]byte, error) {
+	if len(b) < ipv4.HeaderLen {
+		return nil, ErrInvalidPacket
+	}
+	hl := int(b[0]&0x0f) << 2
+	tl := int(b[2])<<8 | int(b[3])
+	if hl < ipv4.HeaderLen || tl < hl || len(b) < tl {
+		return nil, ErrInvalidPacket
+	}
+	if tl <= mtu {
+		return [][]byte{b[:tl]}, nil
+	}
+
+	f := int(b[6])<<8 | int(b[7])
+	if f&0x4000 != 0 {
+		return nil, ErrFragmentNeeded
+	}
+	base, more := (f&0x1fff)<<3, f&0x2000 != 0
+
+	// only options with the copied flag are repeated in later fragments
+	opts := b[ipv4.HeaderLen:hl]
+	copied := make([]byte, 0, len(opts))
+	for i := 0; i < len(opts) && opts[i] != 0; {
+		if opts[i] == 1 {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) || opts[i+1] < 2 || i+int(opts[i+1]) > len(opts) {
+			return nil, ErrInvalidPacket
+		}
+		if opts[i]&0x80 != 0 {
+			copied = append(copied, opts[i:i+int(opts[i+1])]...)
+		}
+		i += int(opts[i+1])
+	}
+	for len(copied)&3 != 0 {
+		copied = append(copied, 0)
+	}
+
+	payload := b[hl:tl]
+	frags := [][]byte{}
+	for off := 0; off < len(payload); {
+		h := b[:hl]
+		if off != 0 {
+			h = append(append(make([]byte, 0, ipv4.HeaderLen+len(copied)), b[:ipv4.HeaderLen]...), copied...)
+		}
+
+		n := (mtu - len(h)) &^ 7
+		if n <= 0 {
+			return nil, fmt.Errorf("mtu %v too small", mtu)
+		}
+		last := off+n >= len(payload)
+		if last {
+			n = len(payload) - off
+		}
+
+		p := make([]byte, len(h)+n)
+		copy(p, h)
+		copy(p[len(h):], payload[off:off+n])
+
+		fo := (base + off) >> 3
+		if !last || more {
+			fo |= 0x2000
+		}
+		p[0] = p[0]&0xf0 | byte(len(h)>>2)
+		binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+		binary.BigEndian.PutUint16(p[6:], uint16(fo))
+		setIPv4HeaderChecksum(p)
+
+		frags = append(frags, p)
+		off += n
+	}
+
+	return frags, nil
+}
+
+func fragmentIPv6(b []byte, mtu int) ([][]byte, error) {
+	e, err := parseIPv6Ext(b)
+	if err != nil {
+		return nil, err
+	}
+	tl := ipv6.HeaderLen + (int(b[4])<<8 | int(b[5]))
+	if tl <= mtu {
+		return [][]byte{b[:tl]}, nil
+	}
+	if e.frag != 0 {
+		return nil, errors.New("packet is already fragmented")
+	}
+
+	n := (mtu - e.unfrag - 8) &^ 7
+	if n <= 0 {
+		return nil, fmt.Errorf("mtu %v too small", mtu)
+	}
+
+	id := atomic.AddUint32(&fragmentID, 1)
+	proto := b[e.unfragNH]
+	payload := b[e.unfrag:tl]
+
+	frags := [][]byte{}
+	for off := 0; off < len(payload); off += n {
+		l := n
+		if off+l > len(payload) {
+			l = len(payload) - off
+		}
+
+		p := make([]byte, e.unfrag+8+l)
+		copy(p, b[:e.unfrag])
+		p[e.unfragNH] = iana.ProtocolIPv6Frag
+		binary.BigEndian.PutUint16(p[4:], uint16(len(p)-ipv6.HeaderLen))
+
+		fh := p[e.unfrag:]
+		fo := off
+		if off+l < len(payload) {
+			fo |= 1
+		}
+		fh[0], fh[1] = proto, 0
+		binary.BigEndian.PutUint16(fh[2:], uint16(fo))
+		binary.BigEndian.PutUint32(fh[4:], id)
+		copy(fh[8:], payload[off:off+l])
+
+		frags = append(frags, p)
+	}
+
+	return frags, nil
+}
+
+// fragVerdicts remembers the verdict taken on the first fragment of a
+// datagram so that later fragments, which carry no transport header, follow
+// it
+type fragVerdicts struct {
+	sync.Mutex
+	m map[fragKey]fragVerdict
+}
+
+type fragVerdict struct {
+	v      Verdict
+	expire time.Time
+}
+
+// fragVerdictsMax bounds the remembered verdicts before expired ones are
+// purged
+const fragVerdictsMax = 4096
+
+// Store records the verdict for the datagram of fragment b
+func (v *fragVerdicts) Store(b []byte, verdict Verdict) {
+	k, _, isFrag := fragKeyOf(b)
+	if !isFrag {
+		return
+	}
+
+	now := time.Now()
+
+	v.Lock()
+	defer v.Unlock()
+
+	if v.m == nil {
+		v.m = make(map[fragKey]fragVerdict)
+	}
+	if len(v.m) >= fragVerdictsMax {
+		for k, e := range v.m {
+			if now.After(e.expire) {
+				delete(v.m, k)
+			}
+		}
+	}
+	v.m[k] = fragVerdict{v: verdict, expire: now.Add(FragmentTimeoutDefault)}
+}
+
+// Lookup returns the verdict recorded for the datagram of fragment b
+func (v *fragVerdicts) Lookup(b []byte) (Verdict, bool) {
+	k, _, isFrag := fragKeyOf(b)
+	if !isFrag {
+		return VerdictNone, false
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	e, found := v.m[k]
+	if !found || time.Now().After(e.expire) {
+		return VerdictNone, false
+	}
+	return e.v, true
+}
@@ -0,0 +1,155 @@
+package windivert
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+var (
+	testSrc4 = netip.MustParseAddrPort("10.0.0.1:40000")
+	testDst4 = netip.MustParseAddrPort("93.184.216.34:443")
+	testSrc6 = netip.MustParseAddrPort("[2001:db8::1]:40000")
+	testDst6 = netip.MustParseAddrPort("[2001:db8::2]:443")
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		mtu  int
+	}{
+		{"ipv4", testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000)), 1280},
+		{"ipv4 small mtu", testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000)), 576},
+		{"ipv6", testPacket(iana.ProtocolUDP, testSrc6, testDst6, 0, 0, testPayload(3000)), 1280},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, err := Fragment(tt.b, tt.mtu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fs) < 2 {
+				t.Fatalf("got %d fragments", len(fs))
+			}
+
+			r := NewReassembler()
+			var out []byte
+			// out of order
+			for i := len(fs) - 1; i >= 0; i-- {
+				if len(fs[i]) > tt.mtu {
+					t.Fatalf("fragment %d is %d bytes", i, len(fs[i]))
+				}
+				if out != nil {
+					t.Fatal("reassembled before the last fragment")
+				}
+				if out, err = r.Process(fs[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(out, tt.b) {
+				t.Errorf("reassembled packet differs from the original")
+			}
+			if r.Pending() != 0 {
+				t.Errorf("Pending() = %d", r.Pending())
+			}
+		})
+	}
+}
+
+func TestFragmentFits(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(100))
+	fs, err := Fragment(b, 1500)
+	if err != nil || len(fs) != 1 || !bytes.Equal(fs[0], b) {
+		t.Errorf("Fragment = %d fragments, %v", len(fs), err)
+	}
+
+	out, err := NewReassembler().Process(b)
+	if err != nil || !bytes.Equal(out, b) {
+		t.Errorf("Process of a whole packet = %v", err)
+	}
+}
+
+func TestFragmentDontFragment(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	b[6] |= 0x40
+	if _, err := Fragment(b, 1500); err != ErrFragmentNeeded {
+		t.Errorf("Fragment = %v, want ErrFragmentNeeded", err)
+	}
+}
+
+func TestFragmentOverlap(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	fs, _ := Fragment(b, 1280)
+	other, _ := Fragment(b, 1000)
+
+	r := NewReassembler()
+	if _, err := r.Process(fs[0]); err != nil {
+		t.Fatal(err)
+	}
+	// a duplicate is ignored
+	if out, err := r.Process(fs[0]); out != nil || err != nil {
+		t.Fatalf("duplicate = %v", err)
+	}
+	if _, err := r.Process(other[1]); err != ErrFragmentOverlap {
+		t.Fatalf("overlap = %v", err)
+	}
+	// the datagram stays poisoned
+	if _, err := r.Process(fs[1]); err != ErrFragmentOverlap {
+		t.Errorf("after overlap = %v", err)
+	}
+}
+
+func TestFragmentTimeout(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	fs, _ := Fragment(b, 1280)
+
+	now := time.Unix(0, 0)
+	r := NewReassembler()
+	r.ProcessAt(fs[0], now)
+	if r.Pending() != 1 {
+		t.Fatalf("Pending() = %d", r.Pending())
+	}
+
+	now = now.Add(r.Timeout + time.Second)
+	out, err := r.ProcessAt(fs[1], now)
+	if out != nil || err != nil {
+		t.Fatalf("after timeout = %v", err)
+	}
+	if r.Pending() != 1 {
+		t.Errorf("Pending() = %d, the expired datagram was kept", r.Pending())
+	}
+}
+
+func TestFragmentLimit(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	fs, _ := Fragment(b, 1280)
+
+	r := NewReassembler()
+	r.MaxBytes = 100
+	if _, err := r.Process(fs[0]); err != ErrFragmentLimit {
+		t.Errorf("Process = %v, want ErrFragmentLimit", err)
+	}
+}
+
+func TestFragVerdicts(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	fs, _ := Fragment(b, 1280)
+
+	var v fragVerdicts
+	if _, ok := v.Lookup(fs[1]); ok {
+		t.Fatal("verdict before Store")
+	}
+	v.Store(fs[0], VerdictDrop)
+	if got, ok := v.Lookup(fs[2]); !ok || got != VerdictDrop {
+		t.Errorf("Lookup = %v, %v", got, ok)
+	}
+
+	// whole packets are not remembered
+	v.Store(b, VerdictDivert)
+	if _, ok := v.Lookup(b); ok {
+		t.Error("verdict for a whole packet")
+	}
+}
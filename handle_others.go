@@ -0,0 +1,58 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import (
+	"errors"
+	"sync"
+)
+
+var errHandleUnsupported = errors.New("windivert handles are only supported on windows")
+
+// Handle is a WinDivert handle, none can be opened off Windows
+type Handle struct {
+	sync.Mutex
+}
+
+// Open fails, there is no WinDivert driver
+func Open(filter string, layer Layer, priority int16, flags uint64) (*Handle, error) {
+	return nil, errHandleUnsupported
+}
+
+func (h *Handle) Close() error {
+	return errHandleUnsupported
+}
+
+func (h *Handle) Recv(packet []byte, addr *Address) (uint, error) {
+	return 0, errHandleUnsupported
+}
+
+func (h *Handle) RecvEx(packets [][]byte, addrs []Address, flags uint64) (uint, uint, error) {
+	return 0, 0, errHandleUnsupported
+}
+
+func (h *Handle) Send(packet []byte, addr *Address) (uint, error) {
+	return 0, errHandleUnsupported
+}
+
+func (h *Handle) SendEx(packets [][]byte, addrs []Address, flags uint64) (uint, error) {
+	return 0, errHandleUnsupported
+}
+
+func (h *Handle) SetParam(param Param, value uint64) error {
+	return errHandleUnsupported
+}
+
+func (h *Handle) GetParam(param Param) (uint64, error) {
+	return 0, errHandleUnsupported
+}
+
+func (h *Handle) Shutdown(how ShutdownType) error {
+	return errHandleUnsupported
+}
+
+// FormatFilter fails, filters are formatted by the WinDivert library
+func FormatFilter(filter string, layer Layer) (string, error) {
+	return "", errHandleUnsupported
+}
@@ -0,0 +1,85 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// xxHash64 primes
+const (
+	hashPrime1 uint64 = 0x9E3779B185EBCA87
+	hashPrime2 uint64 = 0xC2B2AE3D27D4EB4F
+	hashPrime3 uint64 = 0x165667B19E3779F9
+	hashPrime4 uint64 = 0x85EBCA77C2B2AE63
+)
+
+func hashRound(acc, v uint64) uint64 {
+	acc += v * hashPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * hashPrime1
+}
+
+func hashMerge(acc, v uint64) uint64 {
+	acc ^= hashRound(0, v)
+	return acc*hashPrime1 + hashPrime4
+}
+
+// packetHash is an xxHash64 derived state over 64-bit words
+type packetHash struct {
+	v1, v2, v3, v4 uint64
+}
+
+func newPacketHash(seed uint64) packetHash {
+	return packetHash{
+		v1: seed + hashPrime1 + hashPrime2,
+		v2: seed + hashPrime2,
+		v3: seed,
+		v4: seed - hashPrime1,
+	}
+}
+
+func (h *packetHash) sum() uint64 {
+	s := bits.RotateLeft64(h.v1, 1) + bits.RotateLeft64(h.v2, 7) + bits.RotateLeft64(h.v3, 12) + bits.RotateLeft64(h.v4, 18)
+	s = hashMerge(s, h.v1)
+	s = hashMerge(s, h.v2)
+	s = hashMerge(s, h.v3)
+	s = hashMerge(s, h.v4)
+
+	s ^= s >> 33
+	s *= hashPrime2
+	s ^= s >> 29
+	s *= hashPrime3
+	s ^= s >> 32
+	return s
+}
+
+// HashPacketSymmetric calculates a 64-bit hash of the 5-tuple of a packet
+// that is the same for both directions of a flow, so that a connection can
+// be sharded to one worker. It is not compatible with HashPacket.
+func HashPacketSymmetric(b []byte, seed uint64) (uint64, error) {
+	t, err := ParseFiveTuple(b)
+	if err != nil {
+		return 0, err
+	}
+	return HashTupleSymmetric(t, seed), nil
+}
+
+// HashTupleSymmetric is HashPacketSymmetric for an already parsed tuple
+func HashTupleSymmetric(t FiveTuple, seed uint64) uint64 {
+	lo, hi := t.Src(), t.Dst()
+	if c := lo.Addr().Compare(hi.Addr()); c > 0 || c == 0 && lo.Port() > hi.Port() {
+		lo, hi = hi, lo
+	}
+
+	le := binary.LittleEndian
+	a, b := lo.Addr().As16(), hi.Addr().As16()
+
+	h := newPacketHash(seed)
+	h.v1 = hashRound(h.v1, le.Uint64(a[0:]))
+	h.v2 = hashRound(h.v2, le.Uint64(a[8:]))
+	h.v3 = hashRound(h.v3, le.Uint64(b[0:]))
+	h.v4 = hashRound(h.v4, le.Uint64(b[8:]))
+	h.v1 = hashRound(h.v1, uint64(lo.Port())|uint64(hi.Port())<<16|uint64(t.Protocol)<<32)
+
+	return h.sum()
+}
@@ -0,0 +1,55 @@
+package windivert
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+func TestHashPacketSymmetric(t *testing.T) {
+	for _, tt := range []struct {
+		src, dst netip.AddrPort
+		proto    uint8
+	}{
+		{testSrc4, testDst4, iana.ProtocolTCP},
+		{testSrc6, testDst6, iana.ProtocolUDP},
+		{netip.MustParseAddrPort("10.0.0.1:1"), netip.MustParseAddrPort("10.0.0.1:2"), iana.ProtocolUDP},
+	} {
+		fwd := testPacket(tt.proto, tt.src, tt.dst, ACK, 1, nil)
+		rev := testPacket(tt.proto, tt.dst, tt.src, ACK, 1, nil)
+
+		h1, err := HashPacketSymmetric(fwd, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h2, _ := HashPacketSymmetric(rev, 7)
+		if h1 != h2 {
+			t.Errorf("%v -> %v: %x != %x", tt.src, tt.dst, h1, h2)
+		}
+
+		tp, _ := ParseFiveTuple(fwd)
+		if h := HashTupleSymmetric(tp, 7); h != h1 {
+			t.Errorf("HashTupleSymmetric = %x, want %x", h, h1)
+		}
+	}
+}
+
+// TestHashTupleSymmetricValues pins the values of HashTupleSymmetric, workers
+// sharding on it in different processes must agree
+func TestHashTupleSymmetricValues(t *testing.T) {
+	for _, tt := range []struct {
+		src, dst netip.AddrPort
+		proto    uint8
+		seed     uint64
+		want     uint64
+	}{
+		{testSrc4, testDst4, iana.ProtocolTCP, 0, 0x960e0e9d8fe9e4cf},
+		{testSrc6, testDst6, iana.ProtocolUDP, 0x1234, 0x4d8d6dd8cb8d55ac},
+	} {
+		tu := FiveTuple{Protocol: tt.proto, SrcAddr: tt.src.Addr(), DstAddr: tt.dst.Addr(), SrcPort: tt.src.Port(), DstPort: tt.dst.Port()}
+		if got := HashTupleSymmetric(tu, tt.seed); got != tt.want {
+			t.Errorf("%v -> %v: HashTupleSymmetric = %#x, want %#x", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// ErrICMPNotAllowed is returned when no ICMP error may be sent in response to
+// a packet, e.g. an ICMP error itself, a non-first fragment or a packet
+// sent from or to a multicast or broadcast address (RFC 1122, RFC 4443)
+var ErrICMPNotAllowed = errors.New("icmp error not allowed for packet")
+
+// ICMP types
+const (
+	ICMPDestinationUnreachable = 3
+	ICMPTimeExceeded           = 11
+)
+
+// ICMP destination unreachable codes
+const (
+	ICMPCodeNetUnreachable      = 0
+	ICMPCodeHostUnreachable     = 1
+	ICMPCodeProtoUnreachable    = 2
+	ICMPCodePortUnreachable     = 3
+	ICMPCodeFragmentationNeeded = 4
+	ICMPCodeAdminProhibited     = 13
+)
+
+// ICMPv6 types
+const (
+	ICMPv6DestinationUnreachable = 1
+	ICMPv6PacketTooBig           = 2
+	ICMPv6TimeExceeded           = 3
+)
+
+// ICMPv6 destination unreachable codes
+const (
+	ICMPv6CodeNoRoute            = 0
+	ICMPv6CodeAdminProhibited    = 1
+	ICMPv6CodeAddressUnreachable = 3
+	ICMPv6CodePortUnreachable    = 4
+)
+
+const (
+	// icmpQuoteData is the data quoted after the IPv4 header (RFC 792)
+	icmpQuoteData = 8
+	// icmpv6QuoteMax keeps ICMPv6 errors within the IPv6 minimum MTU
+	icmpv6QuoteMax = 1280 - ipv6.HeaderLen - 8
+)
+
+// NewICMPUnreachable builds an ICMP destination unreachable message with
+// code for an IPv4 packet
+func NewICMPUnreachable(b []byte, addr *Address, code uint8) ([]byte, *Address, error) {
+	return newICMPError(b, addr, ICMPDestinationUnreachable, code, 0)
+}
+
+// NewICMPFragmentationNeeded builds an ICMP fragmentation needed message
+// advertising mtu for an IPv4 packet
+func NewICMPFragmentationNeeded(b []byte, addr *Address, mtu int) ([]byte, *Address, error) {
+	return newICMPError(b, addr, ICMPDestinationUnreachable, ICMPCodeFragmentationNeeded, uint32(mtu)&0xffff)
+}
+
+// NewICMPv6Unreachable builds an ICMPv6 destination unreachable message with
+// code for an IPv6 packet
+func NewICMPv6Unreachable(b []byte, addr *Address, code uint8) ([]byte, *Address, error) {
+	return newICMPv6Error(b, addr, ICMPv6DestinationUnreachable, code, 0)
+}
+
+// NewICMPv6PacketTooBig builds an ICMPv6 packet too big message advertising
+// mtu for an IPv6 packet
+func NewICMPv6PacketTooBig(b []byte, addr *Address, mtu int) ([]byte, *Address, error) {
+	return newICMPv6Error(b, addr, ICMPv6PacketTooBig, 0, uint32(mtu))
+}
+
+// NewICMPTimeExceeded builds an ICMP or ICMPv6 time exceeded in transit
+// message depending on the IP version of the packet
+func NewICMPTimeExceeded(b []byte, addr *Address) ([]byte, *Address, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		return newICMPError(b, addr, ICMPTimeExceeded, 0, 0)
+	case ipv6.Version:
+		return newICMPv6Error(b, addr, ICMPv6TimeExceeded, 0, 0)
+	default:
+		return nil, nil, ErrInvalidPacket
+	}
+}
+
+// NewAdminProhibited builds a communication administratively prohibited
+// message for an IPv4 or IPv6 packet
+func NewAdminProhibited(b []byte, addr *Address) ([]byte, *Address, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		return NewICMPUnreachable(b, addr, ICMPCodeAdminProhibited)
+	case ipv6.Version:
+		return NewICMPv6Unreachable(b, addr, ICMPv6CodeAdminProhibited)
+	default:
+		return nil, nil, ErrInvalidPacket
+	}
+}
+
+// NewPortUnreachable builds a port unreachable message for an IPv4 or IPv6
+// packet
+func NewPortUnreachable(b []byte, addr *Address) ([]byte, *Address, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		return NewICMPUnreachable(b, addr, ICMPCodePortUnreachable)
+	case ipv6.Version:
+		return NewICMPv6Unreachable(b, addr, ICMPv6CodePortUnreachable)
+	default:
+		return nil, nil, ErrInvalidPacket
+	}
+}
+
+// replyAddress returns the address to inject a response to a packet
+// received with addr: the direction is reversed on the network layer and
+// the checksums are marked as valid
+func replyAddress(addr *Address) *Address {
+	a := *addr
+	if a.Layer() == LayerNetwork {
+		if a.Outbound() {
+			a.UnsetOutbound()
+		} else {
+			a.SetOutbound()
+		}
+	}
+	a.UnsetSniffed()
+	a.SetIPChecksum()
+	a.SetTCPChecksum()
+	a.SetUDPChecksum()
+	return &a
+}
+
+// icmpErrorAllowed reports whether an ICMP error may be sent for the packet
+// with the given tuple
+func icmpErrorAllowed(src, dst netip.Addr) bool {
+	broadcast := netip.AddrFrom4([4]byte{255, 255, 255, 255})
+	if !src.IsValid() || src.IsUnspecified() || src.IsMulticast() || src == broadcast {
+		return false
+	}
+	return !dst.IsMulticast() && dst != broadcast
+}
+
+func newICMPError(b []byte, addr *Address, typ, code uint8, rest uint32) ([]byte, *Address, error) {
+	if len(b) == 0 || b[0]>>4 != ipv4.Version {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	if _, fo, ok := fragKeyOf(b); ok && fo != 0 {
+		return nil, nil, ErrICMPNotAllowed
+	}
+
+	t, off, err := parseTransport(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !icmpErrorAllowed(t.SrcAddr, t.DstAddr) {
+		return nil, nil, ErrICMPNotAllowed
+	}
+	if t.Protocol == iana.ProtocolICMP {
+		if len(b) <= off {
+			return nil, nil, ErrInvalidPacket
+		}
+		// never respond to an error message
+		switch b[off] {
+		case ICMPDestinationUnreachable, 4, 5, ICMPTimeExceeded, 12:
+			return nil, nil, ErrICMPNotAllowed
+		}
+	}
+
+	q := b[:min(len(b), ipPacketLen(b), int(b[0]&0x0f)<<2+icmpQuoteData)]
+
+	p := make([]byte, ipv4.HeaderLen+8+len(q))
+	p[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+	binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+	p[8] = 64
+	p[9] = iana.ProtocolICMP
+	copy(p[12:16], b[16:20])
+	copy(p[16:20], b[12:16])
+	setIPv4HeaderChecksum(p)
+
+	m := p[ipv4.HeaderLen:]
+	m[0], m[1] = typ, code
+	binary.BigEndian.PutUint32(m[4:], rest)
+	copy(m[8:], q)
+	c := checksumFold(checksumAdd(0, m))
+	m[2], m[3] = byte(c>>8), byte(c)
+
+	return p, replyAddress(addr), nil
+}
+
+func newICMPv6Error(b []byte, addr *Address, typ, code uint8, rest uint32) ([]byte, *Address, error) {
+	if len(b) == 0 || b[0]>>4 != ipv6.Version {
+		return nil, nil, ErrInvalidPacket
+	}
+
+	if _, fo, ok := fragKeyOf(b); ok && fo != 0 {
+		return nil, nil, ErrICMPNotAllowed
+	}
+
+	t, off, err := parseTransport(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !icmpErrorAllowed(t.SrcAddr, t.DstAddr) {
+		return nil, nil, ErrICMPNotAllowed
+	}
+	if t.Protocol == iana.ProtocolIPv6ICMP {
+		if len(b) <= off {
+			return nil, nil, ErrInvalidPacket
+		}
+		// types below 128 are error messages
+		if b[off] < 128 {
+			return nil, nil, ErrICMPNotAllowed
+		}
+	}
+
+	q := b[:min(len(b), ipPacketLen(b), icmpv6QuoteMax)]
+
+	p := make([]byte, ipv6.HeaderLen+8+len(q))
+	p[0] = ipv6.Version << 4
+	binary.BigEndian.PutUint16(p[4:], uint16(len(p)-ipv6.HeaderLen))
+	p[6] = iana.ProtocolIPv6ICMP
+	p[7] = 64
+	copy(p[8:24], b[24:40])
+	copy(p[24:40], b[8:24])
+
+	m := p[ipv6.HeaderLen:]
+	m[0], m[1] = typ, code
+	binary.BigEndian.PutUint32(m[4:], rest)
+	copy(m[8:], q)
+	setTransportChecksum(p, ipv6.HeaderLen)
+
+	return p, replyAddress(addr), nil
+}
@@ -0,0 +1,105 @@
+package windivert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+func TestICMPError(t *testing.T) {
+	tcp4 := testPacket(iana.ProtocolTCP, testSrc4, testDst4, SYN, 1, testPayload(1000))
+	udp6 := testPacket(iana.ProtocolUDP, testSrc6, testDst6, 0, 0, testPayload(2000))
+
+	for _, tt := range []struct {
+		name      string
+		build     func(b []byte, addr *Address) ([]byte, *Address, error)
+		b         []byte
+		typ, code uint8
+		rest      uint32
+		quote     int
+	}{
+		{"admin prohibited", NewAdminProhibited, tcp4, ICMPDestinationUnreachable, ICMPCodeAdminProhibited, 0, 28},
+		{"port unreachable", NewPortUnreachable, tcp4, ICMPDestinationUnreachable, ICMPCodePortUnreachable, 0, 28},
+		{"time exceeded", NewICMPTimeExceeded, tcp4, ICMPTimeExceeded, 0, 0, 28},
+		{"fragmentation needed", func(b []byte, addr *Address) ([]byte, *Address, error) {
+			return NewICMPFragmentationNeeded(b, addr, 1400)
+		}, tcp4, ICMPDestinationUnreachable, ICMPCodeFragmentationNeeded, 1400, 28},
+		{"admin prohibited v6", NewAdminProhibited, udp6, ICMPv6DestinationUnreachable, ICMPv6CodeAdminProhibited, 0, 1232},
+		{"port unreachable v6", NewPortUnreachable, udp6, ICMPv6DestinationUnreachable, ICMPv6CodePortUnreachable, 0, 1232},
+		{"time exceeded v6", NewICMPTimeExceeded, udp6, ICMPv6TimeExceeded, 0, 0, 1232},
+		{"packet too big", func(b []byte, addr *Address) ([]byte, *Address, error) {
+			return NewICMPv6PacketTooBig(b, addr, 1280)
+		}, udp6, ICMPv6PacketTooBig, 0, 1280, 1232},
+	} {
+		addr := &Address{}
+		addr.SetOutbound()
+		p, ra, err := tt.build(tt.b, addr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		src, dst, off := p[12:16], p[16:20], 20
+		osrc, odst := tt.b[12:16], tt.b[16:20]
+		sum := uint32(0)
+		if p[0]>>4 == 6 {
+			src, dst, off = p[8:24], p[24:40], 40
+			osrc, odst = tt.b[8:24], tt.b[24:40]
+			sum = pseudoHeaderSum(p, off, iana.ProtocolIPv6ICMP)
+		} else if checksumFold(checksumAdd(0, p[:20])) != 0 {
+			t.Errorf("%s: invalid IP header checksum", tt.name)
+		}
+		if !bytes.Equal(src, odst) || !bytes.Equal(dst, osrc) {
+			t.Errorf("%s: %x > %x, addresses not swapped", tt.name, src, dst)
+		}
+
+		m := p[off:]
+		if checksumFold(checksumAdd(sum, m)) != 0 {
+			t.Errorf("%s: invalid ICMP checksum", tt.name)
+		}
+		if m[0] != tt.typ || m[1] != tt.code || binary.BigEndian.Uint32(m[4:]) != tt.rest {
+			t.Errorf("%s: type %d code %d rest %d", tt.name, m[0], m[1], binary.BigEndian.Uint32(m[4:]))
+		}
+		if len(m)-8 != tt.quote || !bytes.Equal(m[8:], tt.b[:tt.quote]) {
+			t.Errorf("%s: quoted %d bytes, want %d", tt.name, len(m)-8, tt.quote)
+		}
+
+		if ra.Outbound() || !ra.IPChecksum() || !ra.TCPChecksum() || !ra.UDPChecksum() {
+			t.Errorf("%s: reply address %+v", tt.name, ra)
+		}
+	}
+}
+
+func TestICMPErrorNotAllowed(t *testing.T) {
+	b := testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, testPayload(3000))
+	fs, _ := Fragment(b, 1280)
+	reply, _, _ := NewPortUnreachable(b, &Address{})
+	echo := testPacket(iana.ProtocolIPv6ICMP, testSrc6, testDst6, 0, 0, []byte{128, 0, 0, 0, 0, 0, 0, 0})
+	reply6, _, _ := NewPortUnreachable(echo, &Address{})
+	port := netip.MustParseAddrPort
+
+	for _, tt := range []struct {
+		name string
+		b    []byte
+		err  error
+	}{
+		{"icmp error", reply, ErrICMPNotAllowed},
+		{"icmpv6 error", reply6, ErrICMPNotAllowed},
+		{"first fragment", fs[0], nil},
+		{"later fragment", fs[1], ErrICMPNotAllowed},
+		{"broadcast source", testPacket(iana.ProtocolUDP, port("255.255.255.255:68"), testDst4, 0, 0, nil), ErrICMPNotAllowed},
+		{"broadcast destination", testPacket(iana.ProtocolUDP, testSrc4, port("255.255.255.255:67"), 0, 0, nil), ErrICMPNotAllowed},
+		{"multicast source", testPacket(iana.ProtocolUDP, port("224.0.0.1:5353"), testDst4, 0, 0, nil), ErrICMPNotAllowed},
+		{"multicast destination", testPacket(iana.ProtocolUDP, testSrc4, port("224.0.0.251:5353"), 0, 0, nil), ErrICMPNotAllowed},
+		{"multicast destination v6", testPacket(iana.ProtocolUDP, testSrc6, port("[ff02::fb]:5353"), 0, 0, nil), ErrICMPNotAllowed},
+		{"unspecified source v6", testPacket(iana.ProtocolUDP, port("[::]:546"), testDst6, 0, 0, nil), ErrICMPNotAllowed},
+		{"echo request v6", echo, nil},
+	} {
+		if _, _, err := NewPortUnreachable(tt.b, &Address{}); err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
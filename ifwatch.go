@@ -0,0 +1,140 @@
+package windivert
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// InterfaceWatchIntervalDefault is how often an InterfaceWatcher polls when
+// it gets no route change notifications
+const InterfaceWatchIntervalDefault = 5 * time.Second
+
+// InterfaceEvent reports a change of the default interface
+type InterfaceEvent struct {
+	Old Interface
+	New Interface
+}
+
+// InterfaceWatcher follows the interface of the default route
+type InterfaceWatcher struct {
+	Source   InterfaceSource
+	Interval time.Duration
+
+	mu      sync.Mutex
+	current Interface
+	known   bool
+	subs    map[int]func(InterfaceEvent)
+	nextSub int
+}
+
+// NewInterfaceWatcher creates a watcher listing interfaces from src
+func NewInterfaceWatcher(src InterfaceSource) *InterfaceWatcher {
+	return &InterfaceWatcher{
+		Source:   src,
+		Interval: InterfaceWatchIntervalDefault,
+		subs:     make(map[int]func(InterfaceEvent)),
+	}
+}
+
+// Current returns the interface of the default route as last seen
+func (w *InterfaceWatcher) Current() (Interface, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current, w.known
+}
+
+// Subscribe calls fn every time the default interface changes until cancel
+// is called. fn is called from the goroutine running Check and must not
+// block.
+func (w *InterfaceWatcher) Subscribe(fn func(InterfaceEvent)) (cancel func()) {
+	w.mu.Lock()
+	id := w.nextSub
+	w.nextSub++
+	w.subs[id] = fn
+	w.mu.Unlock()
+
+	return func() {
+		w.mu.Lock()
+		delete(w.subs, id)
+		w.mu.Unlock()
+	}
+}
+
+// Check lists the interfaces and notifies the subscribers when the default
+// interface is another one than last time. The first check only records
+// it. Losing the default route is not a change, the last interface is kept
+// until another one takes over.
+func (w *InterfaceWatcher) Check() (bool, error) {
+	ifs, err := w.Source.Interfaces()
+	if err != nil {
+		return false, err
+	}
+	i, err := DefaultInterface(ifs)
+	if err == ErrNoInterface {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	w.mu.Lock()
+	if !w.known {
+		w.current, w.known = i, true
+		w.mu.Unlock()
+		return false, nil
+	}
+	if w.current.Index == i.Index {
+		w.current = i
+		w.mu.Unlock()
+		return false, nil
+	}
+
+	ev := InterfaceEvent{Old: w.current, New: i}
+	w.current = i
+	subs := make([]func(InterfaceEvent), 0, len(w.subs))
+	for _, fn := range w.subs {
+		subs = append(subs, fn)
+	}
+	w.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+	return true, nil
+}
+
+// Run checks the interfaces when the routing table changes and every
+// Interval until ctx is done. Errors of Check are passed to onError, which
+// may be nil.
+func (w *InterfaceWatcher) Run(ctx context.Context, onError func(error)) {
+	changed := make(chan struct{}, 1)
+	if cancel, err := notifyRouteChange(func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}); err == nil {
+		defer cancel()
+	}
+
+	interval := w.Interval
+	if interval <= 0 {
+		interval = InterfaceWatchIntervalDefault
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		if _, err := w.Check(); err != nil && onError != nil {
+			onError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		case <-changed:
+		}
+	}
+}
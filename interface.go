@@ -1,12 +1,186 @@
 package windivert
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
 	"time"
 )
 
+// ErrNoInterface is returned when no interface matches
+var ErrNoInterface = errors.New("no matching interface")
+
+// Interface is a network adapter as seen by WinDivert
+type Interface struct {
+	// Index is the ifIdx of the adapter
+	Index uint32 `json:"index"`
+	// SubIndex is the subIfIdx of the adapter, IP Helper does not know it
+	// and a Device learns it from the packets it receives
+	SubIndex    uint32 `json:"subIndex"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MTU         int    `json:"mtu"`
+	Up          bool   `json:"up"`
+	Loopback    bool   `json:"loopback,omitempty"`
+	// Addrs are the unicast addresses of the adapter with their on-link
+	// prefix length
+	Addrs []netip.Prefix `json:"addrs"`
+	// Gateways are the gateways configured on the adapter
+	Gateways []netip.Addr `json:"gateways,omitempty"`
+	// Routes are the default routes through the adapter in the routing
+	// table, the halves of split default routes included
+	Routes []Route `json:"routes,omitempty"`
+	// Metric4 and Metric6 are the IPv4 and IPv6 interface metrics, lower
+	// is preferred
+	Metric4 uint32 `json:"metric4,omitempty"`
+	Metric6 uint32 `json:"metric6,omitempty"`
+}
+
+// Route is a route to the whole address space or half of it, VPNs split
+// the default route into 0.0.0.0/1 and 128.0.0.0/1 to take precedence over
+// it without replacing it
+type Route struct {
+	Prefix netip.Prefix `json:"prefix"`
+	// NextHop is unspecified for on-link routes
+	NextHop netip.Addr `json:"nextHop"`
+	// Metric is the route metric, the interface metric is added to it
+	Metric uint32 `json:"metric"`
+}
+
+// defaultRoute returns how the adapter routes the whole address space of
+// family ipv6: split tells whether by both halves of a split default
+// route, which is preferred to any default route being more specific, and
+// metric is the least route and interface metric. Without routes the
+// gateways tell whether there is a default route.
+func (i *Interface) defaultRoute(ipv6 bool) (ok, split bool, metric uint32) {
+	im := i.Metric4
+	if ipv6 {
+		im = i.Metric6
+	}
+
+	if len(i.Routes) == 0 {
+		for _, g := range i.Gateways {
+			if g.Unmap().Is6() == ipv6 {
+				return true, false, im
+			}
+		}
+		return false, false, 0
+	}
+
+	var (
+		halves [2]bool
+		hm     [2]uint32
+	)
+	for _, r := range i.Routes {
+		p := r.Prefix.Masked()
+		if p.Addr().Is6() != ipv6 {
+			continue
+		}
+		switch p.Bits() {
+		case 0:
+			if !ok || r.Metric+im < metric {
+				ok, metric = true, r.Metric+im
+			}
+		case 1:
+			h := p.Addr().AsSlice()[0] >> 7
+			if !halves[h] || r.Metric < hm[h] {
+				halves[h], hm[h] = true, r.Metric
+			}
+		}
+	}
+	if halves[0] && halves[1] {
+		m := hm[0]
+		if hm[1] > m {
+			m = hm[1]
+		}
+		return true, true, m + im
+	}
+	return ok, false, metric
+}
+
+// DefaultRoute reports whether the whole address space of family ipv6 is
+// routed through the adapter, by a default route or a split one
+func (i *Interface) DefaultRoute(ipv6 bool) bool {
+	ok, _, _ := i.defaultRoute(ipv6)
+	return ok
+}
+
+// InterfaceSource lists the interfaces of the system
+type InterfaceSource interface {
+	Interfaces() ([]Interface, error)
+}
+
+// FakeInterfaceSource is an InterfaceSource serving fixed interfaces, for
+// tests
+type FakeInterfaceSource struct {
+	Ifaces []Interface
+}
+
+// LoadInterfaces reads a fixture, a JSON array of interfaces
+func LoadInterfaces(r io.Reader) (*FakeInterfaceSource, error) {
+	s := &FakeInterfaceSource{}
+	if err := json.NewDecoder(r).Decode(&s.Ifaces); err != nil {
+		return nil, fmt.Errorf("decode interfaces error: %v", err)
+	}
+	return s, nil
+}
+
+func (s *FakeInterfaceSource) Interfaces() ([]Interface, error) {
+	return append([]Interface(nil), s.Ifaces...), nil
+}
+
+// DefaultInterface returns the interface of the preferred default route:
+// an adapter that is up, not a loopback and has a default route, IPv4
+// routes before IPv6 ones, split default routes before others as they are
+// more specific, and lower route and interface metrics first
+func DefaultInterface(ifs []Interface) (Interface, error) {
+	type cand struct {
+		i      Interface
+		split  bool
+		metric uint32
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		cands := []cand{}
+		for _, i := range ifs {
+			if !i.Up || i.Loopback {
+				continue
+			}
+			if ok, split, metric := i.defaultRoute(ipv6); ok {
+				cands = append(cands, cand{i, split, metric})
+			}
+		}
+		if len(cands) == 0 {
+			continue
+		}
+
+		sort.SliceStable(cands, func(a, b int) bool {
+			if cands[a].split != cands[b].split {
+				return cands[a].split
+			}
+			return cands[a].metric < cands[b].metric
+		})
+		return cands[0].i, nil
+	}
+	return Interface{}, ErrNoInterface
+}
+
+// FindInterface returns the interface with the given index, or named name
+// when index is zero
+func FindInterface(ifs []Interface, index uint32, name string) (Interface, error) {
+	for _, i := range ifs {
+		if index != 0 && i.Index == index || index == 0 && i.Name == name {
+			return i, nil
+		}
+	}
+	return Interface{}, ErrNoInterface
+}
+
 func DialIPv4(wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -29,6 +203,9 @@ func DialIPv6(wg *sync.WaitGroup) {
 	conn.Close()
 }
 
+// GetInterfaceIndex finds the interface of the default route by dialing
+// public DNS servers and sniffing the packet sent, it needs connectivity.
+// SystemInterfaces and DefaultInterface work offline.
 func GetInterfaceIndex() (uint32, uint32, error) {
 	var filter = "not loopback and outbound and (ip.DstAddr = 8.8.8.8 or ipv6.DstAddr = 2001:4860:4860::8888) and tcp.DstPort = 53"
 	hd, err := Open(filter, LayerNetwork, PriorityDefault, FlagSniff)
@@ -45,10 +222,10 @@ func GetInterfaceIndex() (uint32, uint32, error) {
 	wg.Add(1)
 	go DialIPv6(wg)
 
-	a := new(Address)
+	a := make([]Address, 1)
 	b := make([]byte, 1500)
 
-	if _, err := hd.Recv(b, a); err != nil {
+	if _, _, err := hd.RecvEx([][]byte{b}, a, 0); err != nil {
 		return 0, 0, err
 	}
 
@@ -62,6 +239,6 @@ func GetInterfaceIndex() (uint32, uint32, error) {
 
 	wg.Wait()
 
-	nw := a.Network()
+	nw := a[0].Network()
 	return nw.InterfaceIndex, nw.SubInterfaceIndex, nil
 }
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "errors"
+
+// SystemInterfaces returns the interfaces of the system
+func SystemInterfaces() InterfaceSource {
+	return emptyInterfaces{}
+}
+
+// emptyInterfaces has no interfaces, there is no IP Helper to ask
+type emptyInterfaces struct{}
+
+func (emptyInterfaces) Interfaces() ([]Interface, error) {
+	return nil, errors.New("interface discovery is only supported on windows")
+}
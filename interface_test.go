@@ -0,0 +1,71 @@
+package windivert
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestDefaultInterface(t *testing.T) {
+	route := func(prefix, hop string, metric uint32) Route {
+		return Route{Prefix: netip.MustParsePrefix(prefix), NextHop: netip.MustParseAddr(hop), Metric: metric}
+	}
+	eth := Interface{Index: 1, Name: "eth", Up: true, Metric4: 25, Metric6: 25,
+		Routes: []Route{route("0.0.0.0/0", "192.168.1.1", 0), route("::/0", "fe80::1", 0)}}
+	wifi := Interface{Index: 2, Name: "wifi", Up: true, Metric4: 35,
+		Routes: []Route{route("0.0.0.0/0", "192.168.2.1", 0)}}
+	// a low interface metric does not make up for a high route metric
+	slow := Interface{Index: 3, Name: "slow", Up: true, Metric4: 1,
+		Routes: []Route{route("0.0.0.0/0", "10.1.1.1", 100)}}
+	vpn := Interface{Index: 4, Name: "vpn", Up: true, Metric4: 50,
+		Routes: []Route{route("0.0.0.0/1", "0.0.0.0", 0), route("128.0.0.0/1", "0.0.0.0", 0)}}
+	halfVPN := Interface{Index: 5, Name: "half", Up: true, Metric4: 1,
+		Routes: []Route{route("0.0.0.0/1", "0.0.0.0", 0)}}
+	v6 := Interface{Index: 6, Name: "v6", Up: true, Metric6: 5,
+		Routes: []Route{route("::/1", "::", 0), route("8000::/1", "::", 0)}}
+	gw := Interface{Index: 7, Name: "gw", Up: true, Metric4: 10, Gateways: []netip.Addr{netip.MustParseAddr("10.0.0.1")}}
+	down := Interface{Index: 8, Name: "down", Metric4: 1, Routes: []Route{route("0.0.0.0/0", "10.2.2.2", 0)}}
+
+	for _, tt := range []struct {
+		ifs  []Interface
+		want string
+	}{
+		{[]Interface{wifi, eth}, "eth"},
+		{[]Interface{slow, wifi}, "wifi"},
+		{[]Interface{eth, vpn}, "vpn"},
+		{[]Interface{halfVPN, wifi}, "wifi"},
+		{[]Interface{down, wifi}, "wifi"},
+		// gateways tell without routes
+		{[]Interface{gw, wifi}, "gw"},
+		{[]Interface{v6}, "v6"},
+		{[]Interface{v6, slow}, "slow"},
+		{[]Interface{halfVPN, down}, ""},
+	} {
+		i, err := DefaultInterface(tt.ifs)
+		if tt.want == "" {
+			if err != ErrNoInterface {
+				t.Errorf("DefaultInterface = %v, %v", i.Name, err)
+			}
+			continue
+		}
+		if err != nil || i.Name != tt.want {
+			names := []string{}
+			for _, i := range tt.ifs {
+				names = append(names, i.Name)
+			}
+			t.Errorf("DefaultInterface(%s) = %s, %v, want %s", strings.Join(names, ", "), i.Name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadInterfaces(t *testing.T) {
+	s, err := LoadInterfaces(strings.NewReader(`[{"index": 4, "name": "vpn", "up": true,
+		"routes": [{"prefix": "0.0.0.0/1", "nextHop": "0.0.0.0"}, {"prefix": "128.0.0.0/1", "nextHop": "0.0.0.0", "metric": 5}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifs, _ := s.Interfaces()
+	if len(ifs) != 1 || !ifs[0].DefaultRoute(false) || ifs[0].DefaultRoute(true) {
+		t.Errorf("Interfaces() = %+v", ifs)
+	}
+}
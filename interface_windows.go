@@ -0,0 +1,183 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"fmt"
+	"net/netip"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// GetAdaptersAddresses flags
+const (
+	gaaFlagSkipAnycast     = 0x02
+	gaaFlagSkipMulticast   = 0x04
+	gaaFlagSkipDNSServer   = 0x08
+	gaaFlagIncludeGateways = 0x80
+)
+
+var (
+	modiphlpapi = windows.NewLazySystemDLL("iphlpapi.dll")
+
+	procGetIpForwardTable2 = modiphlpapi.NewProc("GetIpForwardTable2")
+	procFreeMibTable       = modiphlpapi.NewProc("FreeMibTable")
+)
+
+// sockaddrInet is SOCKADDR_INET
+type sockaddrInet struct {
+	Family uint16
+	Port   uint16
+	Data   [24]byte
+}
+
+func (sa *sockaddrInet) addr() (netip.Addr, bool) {
+	switch sa.Family {
+	case windows.AF_INET:
+		return netip.AddrFrom4([4]byte(sa.Data[:4])), true
+	case windows.AF_INET6:
+		return netip.AddrFrom16([16]byte(sa.Data[4:20])), true
+	}
+	return netip.Addr{}, false
+}
+
+// mibIPForwardRow2 is MIB_IPFORWARD_ROW2
+type mibIPForwardRow2 struct {
+	InterfaceLuid        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    sockaddrInet
+	PrefixLength         uint8
+	_                    [3]byte
+	NextHop              sockaddrInet
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             uint8
+	AutoconfigureAddress uint8
+	Publish              uint8
+	Immortal             uint8
+	Age                  uint32
+	Origin               uint32
+}
+
+// ipHelperInterfaces lists the adapters known to IP Helper
+type ipHelperInterfaces struct{}
+
+// SystemInterfaces returns the interfaces of the system. The routes of an
+// adapter are its default routes in the routing table, no packet is sent.
+func SystemInterfaces() InterfaceSource {
+	return ipHelperInterfaces{}
+}
+
+func (ipHelperInterfaces) Interfaces() ([]Interface, error) {
+	const flags = gaaFlagSkipAnycast | gaaFlagSkipMulticast | gaaFlagSkipDNSServer | gaaFlagIncludeGateways
+
+	size := uint32(15 << 10)
+	for {
+		b := make([]byte, size)
+		aa := (*windows.IpAdapterAddresses)(unsafe.Pointer(&b[0]))
+		err := windows.GetAdaptersAddresses(windows.AF_UNSPEC, flags, 0, aa, &size)
+		if err == windows.ERROR_BUFFER_OVERFLOW {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get adapters addresses error: %v", err)
+		}
+
+		routes, err := defaultRoutes()
+		if err != nil {
+			return nil, err
+		}
+
+		ifs := []Interface{}
+		for ; aa != nil; aa = aa.Next {
+			i := adapterInterface(aa)
+			i.Routes = routes[i.Index]
+			if aa.Ipv6IfIndex != 0 && aa.Ipv6IfIndex != i.Index {
+				i.Routes = append(i.Routes, routes[aa.Ipv6IfIndex]...)
+			}
+			ifs = append(ifs, i)
+		}
+		return ifs, nil
+	}
+}
+
+// defaultRoutes returns the routes to the whole address space or half of
+// it by interface index
+func defaultRoutes() (map[uint32][]Route, error) {
+	var table unsafe.Pointer
+	if r, _, _ := procGetIpForwardTable2.Call(windows.AF_UNSPEC, uintptr(unsafe.Pointer(&table))); r != 0 {
+		return nil, fmt.Errorf("get ip forward table error: %v", windows.Errno(r))
+	}
+	defer procFreeMibTable.Call(uintptr(table))
+
+	// MIB_IPFORWARD_TABLE2 is the number of rows followed by the rows,
+	// aligned as the LUID they begin with
+	n := *(*uint32)(table)
+	rows := unsafe.Slice((*mibIPForwardRow2)(unsafe.Add(table, 8)), n)
+
+	routes := make(map[uint32][]Route)
+	for i := range rows {
+		row := &rows[i]
+		if row.PrefixLength > 1 {
+			continue
+		}
+		dst, ok := row.DestinationPrefix.addr()
+		if !ok {
+			continue
+		}
+		hop, _ := row.NextHop.addr()
+		routes[row.InterfaceIndex] = append(routes[row.InterfaceIndex], Route{
+			Prefix:  netip.PrefixFrom(dst, int(row.PrefixLength)),
+			NextHop: hop,
+			Metric:  row.Metric,
+		})
+	}
+	return routes, nil
+}
+
+func adapterInterface(aa *windows.IpAdapterAddresses) Interface {
+	i := Interface{
+		Index:       aa.IfIndex,
+		Name:        windows.UTF16PtrToString(aa.FriendlyName),
+		Description: windows.UTF16PtrToString(aa.Description),
+		MTU:         int(aa.Mtu),
+		Up:          aa.OperStatus == windows.IfOperStatusUp,
+		Loopback:    aa.IfType == windows.IF_TYPE_SOFTWARE_LOOPBACK,
+		Addrs:       []netip.Prefix{},
+		Metric4:     aa.Ipv4Metric,
+		Metric6:     aa.Ipv6Metric,
+	}
+	// adapters without IPv4 have no IPv4 index
+	if i.Index == 0 {
+		i.Index = aa.Ipv6IfIndex
+	}
+	// the MTU is -1 when not known
+	if aa.Mtu == ^uint32(0) {
+		i.MTU = 0
+	}
+
+	for u := aa.FirstUnicastAddress; u != nil; u = u.Next {
+		if a, ok := socketAddr(&u.Address); ok {
+			i.Addrs = append(i.Addrs, netip.PrefixFrom(a, int(u.OnLinkPrefixLength)))
+		}
+	}
+	for g := aa.FirstGatewayAddress; g != nil; g = g.Next {
+		if a, ok := socketAddr(&g.Address); ok {
+			i.Gateways = append(i.Gateways, a)
+		}
+	}
+	return i
+}
+
+func socketAddr(sa *windows.SocketAddress) (netip.Addr, bool) {
+	if sa.Sockaddr == nil {
+		return netip.Addr{}, false
+	}
+	a, ok := netip.AddrFromSlice(sa.IP())
+	return a.Unmap(), ok
+}
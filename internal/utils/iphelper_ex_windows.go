@@ -0,0 +1,195 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procGetExtendedTcpTable         = modiphlpapi.NewProc("GetExtendedTcpTable")
+	procGetExtendedUdpTable         = modiphlpapi.NewProc("GetExtendedUdpTable")
+	procGetOwnerModuleFromTcpEntry  = modiphlpapi.NewProc("GetOwnerModuleFromTcpEntry")
+	procGetOwnerModuleFromTcp6Entry = modiphlpapi.NewProc("GetOwnerModuleFromTcp6Entry")
+	procGetOwnerModuleFromUdpEntry  = modiphlpapi.NewProc("GetOwnerModuleFromUdpEntry")
+	procGetOwnerModuleFromUdp6Entry = modiphlpapi.NewProc("GetOwnerModuleFromUdp6Entry")
+)
+
+const (
+	tcpTableOwnerModuleAll = 8
+	udpTableOwnerModule    = 2
+
+	tcpipOwnerModuleInfoBasic = 0
+)
+
+// TCPRowOwnerModule represents a MIB_TCPROW_OWNER_MODULE entry
+type TCPRowOwnerModule struct {
+	State            uint32
+	LocalAddr        uint32
+	LocalPort        uint32
+	RemoteAddr       uint32
+	RemotePort       uint32
+	OwningPid        uint32
+	CreateTimestamp  int64
+	OwningModuleInfo [16]uint64
+}
+
+// TCP6RowOwnerModule represents a MIB_TCP6ROW_OWNER_MODULE entry
+type TCP6RowOwnerModule struct {
+	LocalAddr        [16]byte
+	LocalScopeId     uint32
+	LocalPort        uint32
+	RemoteAddr       [16]byte
+	RemoteScopeId    uint32
+	RemotePort       uint32
+	State            uint32
+	OwningPid        uint32
+	CreateTimestamp  int64
+	OwningModuleInfo [16]uint64
+}
+
+// UDPRowOwnerModule represents a MIB_UDPROW_OWNER_MODULE entry. The padding
+// is explicit as LARGE_INTEGER is 8 byte aligned on 386 too.
+type UDPRowOwnerModule struct {
+	LocalAddr        uint32
+	LocalPort        uint32
+	OwningPid        uint32
+	_                uint32
+	CreateTimestamp  int64
+	Flags            int32
+	_                uint32
+	OwningModuleInfo [16]uint64
+}
+
+// UDP6RowOwnerModule represents a MIB_UDP6ROW_OWNER_MODULE entry
+type UDP6RowOwnerModule struct {
+	LocalAddr        [16]byte
+	LocalScopeId     uint32
+	LocalPort        uint32
+	OwningPid        uint32
+	_                uint32
+	CreateTimestamp  int64
+	Flags            int32
+	_                uint32
+	OwningModuleInfo [16]uint64
+}
+
+// getExtendedTable calls GetExtendedTcpTable or GetExtendedUdpTable until
+// the buffer is large enough for the table, which may grow between calls
+func getExtendedTable(proc *syscall.LazyProc, af, class uint32) ([]byte, error) {
+	size := uint32(4096)
+	for {
+		b := make([]byte, size)
+		r1, _, _ := proc.Call(
+			uintptr(unsafe.Pointer(&b[0])),
+			uintptr(unsafe.Pointer(&size)),
+			0,
+			uintptr(af),
+			uintptr(class),
+			0,
+		)
+		switch syscall.Errno(r1) {
+		case 0:
+			return b, nil
+		case syscall.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return nil, syscall.Errno(r1)
+		}
+	}
+}
+
+// tableRows copies the rows of a table, the rows follow the entry count
+// aligned to 8 bytes
+func tableRows[T any](b []byte) []T {
+	n := *(*uint32)(unsafe.Pointer(&b[0]))
+	if n == 0 {
+		return nil
+	}
+	rows := make([]T, n)
+	copy(rows, unsafe.Slice((*T)(unsafe.Pointer(&b[8])), n))
+	return rows
+}
+
+// GetExtendedTCPTable retrieves the IPv4 TCP table with owner modules
+func GetExtendedTCPTable() ([]TCPRowOwnerModule, error) {
+	b, err := getExtendedTable(procGetExtendedTcpTable, windows.AF_INET, tcpTableOwnerModuleAll)
+	if err != nil {
+		return nil, err
+	}
+	return tableRows[TCPRowOwnerModule](b), nil
+}
+
+// GetExtendedTCP6Table retrieves the IPv6 TCP table with owner modules
+func GetExtendedTCP6Table() ([]TCP6RowOwnerModule, error) {
+	b, err := getExtendedTable(procGetExtendedTcpTable, windows.AF_INET6, tcpTableOwnerModuleAll)
+	if err != nil {
+		return nil, err
+	}
+	return tableRows[TCP6RowOwnerModule](b), nil
+}
+
+// GetExtendedUDPTable retrieves the IPv4 UDP table with owner modules
+func GetExtendedUDPTable() ([]UDPRowOwnerModule, error) {
+	b, err := getExtendedTable(procGetExtendedUdpTable, windows.AF_INET, udpTableOwnerModule)
+	if err != nil {
+		return nil, err
+	}
+	return tableRows[UDPRowOwnerModule](b), nil
+}
+
+// GetExtendedUDP6Table retrieves the IPv6 UDP table with owner modules
+func GetExtendedUDP6Table() ([]UDP6RowOwnerModule, error) {
+	b, err := getExtendedTable(procGetExtendedUdpTable, windows.AF_INET6, udpTableOwnerModule)
+	if err != nil {
+		return nil, err
+	}
+	return tableRows[UDP6RowOwnerModule](b), nil
+}
+
+// ownerModule returns the name and path of the module owning a row
+func ownerModule(proc *syscall.LazyProc, row unsafe.Pointer) (string, string, error) {
+	size := uint32(1024)
+	for {
+		b := make([]byte, size)
+		r1, _, _ := proc.Call(
+			uintptr(row),
+			tcpipOwnerModuleInfoBasic,
+			uintptr(unsafe.Pointer(&b[0])),
+			uintptr(unsafe.Pointer(&size)),
+		)
+		switch syscall.Errno(r1) {
+		case 0:
+			info := (*[2]*uint16)(unsafe.Pointer(&b[0]))
+			return windows.UTF16PtrToString(info[0]), windows.UTF16PtrToString(info[1]), nil
+		case syscall.ERROR_INSUFFICIENT_BUFFER:
+			continue
+		default:
+			return "", "", syscall.Errno(r1)
+		}
+	}
+}
+
+// Module returns the name and path of the module owning the connection
+func (r *TCPRowOwnerModule) Module() (string, string, error) {
+	return ownerModule(procGetOwnerModuleFromTcpEntry, unsafe.Pointer(r))
+}
+
+// Module returns the name and path of the module owning the connection
+func (r *TCP6RowOwnerModule) Module() (string, string, error) {
+	return ownerModule(procGetOwnerModuleFromTcp6Entry, unsafe.Pointer(r))
+}
+
+// Module returns the name and path of the module owning the endpoint
+func (r *UDPRowOwnerModule) Module() (string, string, error) {
+	return ownerModule(procGetOwnerModuleFromUdpEntry, unsafe.Pointer(r))
+}
+
+// Module returns the name and path of the module owning the endpoint
+func (r *UDP6RowOwnerModule) Module() (string, string, error) {
+	return ownerModule(procGetOwnerModuleFromUdp6Entry, unsafe.Pointer(r))
+}
@@ -0,0 +1,73 @@
+//go:build windows
+// +build windows
+
+package utils
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	procNotifyRouteChange2     = modiphlpapi.NewProc("NotifyRouteChange2")
+	procCancelMibChangeNotify2 = modiphlpapi.NewProc("CancelMibChangeNotify2")
+
+	// callbacks are never freed, all registrations share one
+	routeCallback = syscall.NewCallback(routeChanged)
+
+	routeMu   sync.Mutex
+	routeFns  = make(map[uintptr]func())
+	routeNext uintptr
+)
+
+func routeChanged(ctx, row, typ uintptr) uintptr {
+	routeMu.Lock()
+	fn := routeFns[ctx]
+	routeMu.Unlock()
+
+	if fn != nil {
+		fn()
+	}
+	return 0
+}
+
+// NotifyRouteChange calls fn whenever an IPv4 or IPv6 route is added,
+// deleted or changed until cancel is called. fn is called from a system
+// thread and must not block.
+func NotifyRouteChange(fn func()) (cancel func() error, err error) {
+	routeMu.Lock()
+	routeNext++
+	id := routeNext
+	routeFns[id] = fn
+	routeMu.Unlock()
+
+	forget := func() {
+		routeMu.Lock()
+		delete(routeFns, id)
+		routeMu.Unlock()
+	}
+
+	var h windows.Handle
+	r1, _, _ := procNotifyRouteChange2.Call(
+		windows.AF_UNSPEC,
+		routeCallback,
+		id,
+		0,
+		uintptr(unsafe.Pointer(&h)),
+	)
+	if r1 != 0 {
+		forget()
+		return nil, syscall.Errno(r1)
+	}
+
+	return func() error {
+		defer forget()
+		if r1, _, _ := procCancelMibChangeNotify2.Call(uintptr(h)); r1 != 0 {
+			return syscall.Errno(r1)
+		}
+		return nil
+	}, nil
+}
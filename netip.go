@@ -0,0 +1,192 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// addrFromHost converts an address in WinDivert's host order format, the
+// 128-bit address stored as four little endian words least significant
+// first, to netip.Addr. IPv4 addresses are stored IPv4-mapped and are
+// unmapped unless ipv6 is set.
+func addrFromHost(b [16]uint8, ipv6 bool) netip.Addr {
+	var a [16]byte
+	for i := range a {
+		a[i] = b[15-i]
+	}
+
+	addr := netip.AddrFrom16(a)
+	if !ipv6 {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+// addrToHost converts addr to WinDivert's host order format
+func addrToHost(addr netip.Addr) (b [16]uint8) {
+	a := addr.As16()
+	for i := range b {
+		b[i] = a[15-i]
+	}
+	return
+}
+
+// netAddr converts an endpoint of protocol proto to a net.Addr
+func netAddr(proto uint8, ap netip.AddrPort) net.Addr {
+	switch proto {
+	case iana.ProtocolTCP:
+		return net.TCPAddrFromAddrPort(ap)
+	case iana.ProtocolUDP:
+		return net.UDPAddrFromAddrPort(ap)
+	default:
+		return &net.IPAddr{IP: net.IP(ap.Addr().AsSlice())}
+	}
+}
+
+// LocalAddrPort returns the local endpoint. IPv4-mapped addresses are
+// unmapped, use Address.LocalAddrPort to honour the IPv6 flag.
+func (s *Socket) LocalAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(addrFromHost(s.LocalAddress, false), s.LocalPort)
+}
+
+// RemoteAddrPort returns the remote endpoint. IPv4-mapped addresses are
+// unmapped, use Address.RemoteAddrPort to honour the IPv6 flag.
+func (s *Socket) RemoteAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(addrFromHost(s.RemoteAddress, false), s.RemotePort)
+}
+
+// SetLocalAddrPort sets the local endpoint
+func (s *Socket) SetLocalAddrPort(ap netip.AddrPort) {
+	s.LocalAddress, s.LocalPort = addrToHost(ap.Addr()), ap.Port()
+}
+
+// SetRemoteAddrPort sets the remote endpoint
+func (s *Socket) SetRemoteAddrPort(ap netip.AddrPort) {
+	s.RemoteAddress, s.RemotePort = addrToHost(ap.Addr()), ap.Port()
+}
+
+// LocalAddr returns the local endpoint as a net.Addr
+func (s *Socket) LocalAddr() net.Addr {
+	return netAddr(s.Protocol, s.LocalAddrPort())
+}
+
+// RemoteAddr returns the remote endpoint as a net.Addr
+func (s *Socket) RemoteAddr() net.Addr {
+	return netAddr(s.Protocol, s.RemoteAddrPort())
+}
+
+// LocalAddrPort returns the local endpoint. IPv4-mapped addresses are
+// unmapped, use Address.LocalAddrPort to honour the IPv6 flag.
+func (f *Flow) LocalAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(addrFromHost(f.LocalAddress, false), f.LocalPort)
+}
+
+// RemoteAddrPort returns the remote endpoint. IPv4-mapped addresses are
+// unmapped, use Address.RemoteAddrPort to honour the IPv6 flag.
+func (f *Flow) RemoteAddrPort() netip.AddrPort {
+	return netip.AddrPortFrom(addrFromHost(f.RemoteAddress, false), f.RemotePort)
+}
+
+// SetLocalAddrPort sets the local endpoint
+func (f *Flow) SetLocalAddrPort(ap netip.AddrPort) {
+	f.LocalAddress, f.LocalPort = addrToHost(ap.Addr()), ap.Port()
+}
+
+// SetRemoteAddrPort sets the remote endpoint
+func (f *Flow) SetRemoteAddrPort(ap netip.AddrPort) {
+	f.RemoteAddress, f.RemotePort = addrToHost(ap.Addr()), ap.Port()
+}
+
+// LocalAddr returns the local endpoint as a net.Addr
+func (f *Flow) LocalAddr() net.Addr {
+	return netAddr(f.Protocol, f.LocalAddrPort())
+}
+
+// RemoteAddr returns the remote endpoint as a net.Addr
+func (f *Flow) RemoteAddr() net.Addr {
+	return netAddr(f.Protocol, f.RemoteAddrPort())
+}
+
+// LocalAddrPort returns the local endpoint of a flow or socket layer
+// address. IPv4-mapped addresses are kept when the IPv6 flag is set.
+func (a *Address) LocalAddrPort() (netip.AddrPort, bool) {
+	v6 := a.IPv6()
+
+	switch a.Layer() {
+	case LayerFlow:
+		f := a.Flow()
+		return netip.AddrPortFrom(addrFromHost(f.LocalAddress, v6), f.LocalPort), true
+	case LayerSocket:
+		s := a.Socket()
+		return netip.AddrPortFrom(addrFromHost(s.LocalAddress, v6), s.LocalPort), true
+	default:
+		return netip.AddrPort{}, false
+	}
+}
+
+// RemoteAddrPort returns the remote endpoint of a flow or socket layer
+// address. IPv4-mapped addresses are kept when the IPv6 flag is set.
+func (a *Address) RemoteAddrPort() (netip.AddrPort, bool) {
+	v6 := a.IPv6()
+
+	switch a.Layer() {
+	case LayerFlow:
+		f := a.Flow()
+		return netip.AddrPortFrom(addrFromHost(f.RemoteAddress, v6), f.RemotePort), true
+	case LayerSocket:
+		s := a.Socket()
+		return netip.AddrPortFrom(addrFromHost(s.RemoteAddress, v6), s.RemotePort), true
+	default:
+		return netip.AddrPort{}, false
+	}
+}
+
+// Src returns the source address. SrcAddr holds the address as it is
+// stored in the packet, in network byte order.
+func (h *IPv4Header) Src() netip.Addr {
+	var a [4]byte
+	binary.LittleEndian.PutUint32(a[:], h.SrcAddr)
+	return netip.AddrFrom4(a)
+}
+
+// Dst returns the destination address
+func (h *IPv4Header) Dst() netip.Addr {
+	var a [4]byte
+	binary.LittleEndian.PutUint32(a[:], h.DstAddr)
+	return netip.AddrFrom4(a)
+}
+
+// SetSrc sets the source address, addr must be an IPv4 address
+func (h *IPv4Header) SetSrc(addr netip.Addr) {
+	a := addr.Unmap().As4()
+	h.SrcAddr = binary.LittleEndian.Uint32(a[:])
+}
+
+// SetDst sets the destination address, addr must be an IPv4 address
+func (h *IPv4Header) SetDst(addr netip.Addr) {
+	a := addr.Unmap().As4()
+	h.DstAddr = binary.LittleEndian.Uint32(a[:])
+}
+
+// Src returns the source address
+func (h *IPv6Header) Src() netip.Addr {
+	return netip.AddrFrom16(h.SrcAddr)
+}
+
+// Dst returns the destination address
+func (h *IPv6Header) Dst() netip.Addr {
+	return netip.AddrFrom16(h.DstAddr)
+}
+
+// SetSrc sets the source address
+func (h *IPv6Header) SetSrc(addr netip.Addr) {
+	h.SrcAddr = addr.As16()
+}
+
+// SetDst sets the destination address
+func (h *IPv6Header) SetDst(addr netip.Addr) {
+	h.DstAddr = addr.As16()
+}
@@ -0,0 +1,70 @@
+package windivert
+
+import (
+	"net/netip"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// testPacket builds an IP packet from src to dst carrying a TCP or UDP
+// header followed by payload, or only payload for other protocols
+func testPacket(proto uint8, src, dst netip.AddrPort, flags uint8, seq uint32, payload []byte) []byte {
+	var th []byte
+	switch proto {
+	case iana.ProtocolTCP:
+		th = make([]byte, 20)
+		th[12] = 5 << 4
+		th[13] = flags
+		th[4], th[5], th[6], th[7] = byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq)
+		th[14], th[15] = 0xff, 0xff
+	case iana.ProtocolUDP:
+		th = make([]byte, 8)
+		l := 8 + len(payload)
+		th[4], th[5] = byte(l>>8), byte(l)
+	}
+	if th != nil {
+		th[0], th[1] = byte(src.Port()>>8), byte(src.Port())
+		th[2], th[3] = byte(dst.Port()>>8), byte(dst.Port())
+	}
+
+	var b []byte
+	if src.Addr().Is4() {
+		l := 20 + len(th) + len(payload)
+		b = make([]byte, 20, l)
+		b[0] = 0x45
+		b[2], b[3] = byte(l>>8), byte(l)
+		b[4], b[5] = 0x12, 0x34
+		b[8] = 64
+		b[9] = proto
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(b[12:], s[:])
+		copy(b[16:], d[:])
+		setIPv4HeaderChecksum(b)
+	} else {
+		l := len(th) + len(payload)
+		b = make([]byte, 40, 40+l)
+		b[0] = 0x60
+		b[4], b[5] = byte(l>>8), byte(l)
+		b[6] = proto
+		b[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(b[8:], s[:])
+		copy(b[24:], d[:])
+	}
+
+	b = append(b, th...)
+	b = append(b, payload...)
+	if th != nil {
+		setTransportChecksum(b, len(b)-len(th)-len(payload))
+	}
+	return b
+}
+
+// testPayload returns n bytes counting up from zero
+func testPayload(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
@@ -0,0 +1,205 @@
+package windivert
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// ErrInvalidPacket is returned when a packet is truncated or malformed
+var ErrInvalidPacket = errors.New("invalid packet")
+
+// ipv6Ext describes the extension header chain of an IPv6 packet
+type ipv6Ext struct {
+	// proto and off are the upper layer protocol and its offset
+	proto uint8
+	off   int
+	// frag is the offset of the fragment header, 0 if there is none, and
+	// fragNH the offset of the next header field naming it
+	frag   int
+	fragNH int
+	// unfrag is the end of the unfragmentable part and unfragNH the
+	// offset of the next header field that follows it
+	unfrag   int
+	unfragNH int
+}
+
+// parseIPv6Ext walks the extension headers of an IPv6 packet. The walk stops
+// after the fragment header of a non-first fragment.
+func parseIPv6Ext(b []byte) (e ipv6Ext, err error) {
+	if len(b) < ipv6.HeaderLen {
+		return e, ErrInvalidPacket
+	}
+
+	end := ipv6.HeaderLen + (int(b[4])<<8 | int(b[5]))
+	if len(b) < end {
+		return e, ErrInvalidPacket
+	}
+	b = b[:end]
+
+	e.proto, e.off = b[6], ipv6.HeaderLen
+	e.unfrag, e.unfragNH = ipv6.HeaderLen, 6
+
+	nh := 6
+	for {
+		switch e.proto {
+		case iana.ProtocolHOPOPT, iana.ProtocolIPv6Route, iana.ProtocolIPv6Opts, iana.ProtocolIPv6Frag, iana.ProtocolAH, iana.ProtocolMobilityHeader:
+		default:
+			return e, nil
+		}
+
+		if e.off+8 > len(b) {
+			return e, ErrInvalidPacket
+		}
+
+		var l int
+		switch e.proto {
+		case iana.ProtocolIPv6Frag:
+			if e.frag != 0 {
+				return e, ErrInvalidPacket
+			}
+			e.frag, e.fragNH, l = e.off, nh, 8
+		case iana.ProtocolAH:
+			l = (int(b[e.off+1]) + 2) << 2
+		default:
+			l = (int(b[e.off+1]) + 1) << 3
+		}
+
+		if e.frag == 0 && (e.proto == iana.ProtocolHOPOPT || e.proto == iana.ProtocolIPv6Route) {
+			e.unfrag, e.unfragNH = e.off+l, e.off
+		}
+
+		nh = e.off
+		e.proto, e.off = b[e.off], e.off+l
+		if e.off > len(b) {
+			return e, ErrInvalidPacket
+		}
+
+		if e.frag != 0 && (int(b[e.frag+2])<<8|int(b[e.frag+3]))&^7 != 0 {
+			return e, nil
+		}
+	}
+}
+
+// FiveTuple identifies one direction of a transport flow. Ports are zero for
+// protocols other than TCP and UDP.
+type FiveTuple struct {
+	Protocol uint8
+	SrcAddr  netip.Addr
+	DstAddr  netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// Reverse returns the tuple of the opposite direction
+func (t FiveTuple) Reverse() FiveTuple {
+	return FiveTuple{
+		Protocol: t.Protocol,
+		SrcAddr:  t.DstAddr,
+		DstAddr:  t.SrcAddr,
+		SrcPort:  t.DstPort,
+		DstPort:  t.SrcPort,
+	}
+}
+
+// Src returns the source endpoint
+func (t FiveTuple) Src() netip.AddrPort {
+	return netip.AddrPortFrom(t.SrcAddr, t.SrcPort)
+}
+
+// Dst returns the destination endpoint
+func (t FiveTuple) Dst() netip.AddrPort {
+	return netip.AddrPortFrom(t.DstAddr, t.DstPort)
+}
+
+func (t FiveTuple) String() string {
+	var p string
+	switch t.Protocol {
+	case iana.ProtocolTCP:
+		p = "tcp"
+	case iana.ProtocolUDP:
+		p = "udp"
+	case iana.ProtocolICMP:
+		p = "icmp"
+	case iana.ProtocolIPv6ICMP:
+		p = "icmpv6"
+	default:
+		p = strconv.Itoa(int(t.Protocol))
+	}
+	return fmt.Sprintf("%v %v -> %v", p, t.Src(), t.Dst())
+}
+
+// ParseFiveTuple returns the 5-tuple of an IP packet. Fragments other than
+// the first carry no transport header and return ErrInvalidPacket.
+func ParseFiveTuple(b []byte) (FiveTuple, error) {
+	t, _, err := parseTransport(b)
+	return t, err
+}
+
+// parseTransport returns the 5-tuple of an IP packet and the offset of its
+// transport header
+func parseTransport(b []byte) (t FiveTuple, off int, err error) {
+	if len(b) == 0 {
+		return t, 0, ErrInvalidPacket
+	}
+
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		if len(b) < ipv4.HeaderLen {
+			return t, 0, ErrInvalidPacket
+		}
+		off = int(b[0]&0x0f) << 2
+		if off < ipv4.HeaderLen || len(b) < off {
+			return t, 0, ErrInvalidPacket
+		}
+		if (int(b[6])<<8|int(b[7]))&0x1fff != 0 {
+			return t, 0, ErrInvalidPacket
+		}
+		t.Protocol = b[9]
+		t.SrcAddr = netip.AddrFrom4([4]byte(b[12:16]))
+		t.DstAddr = netip.AddrFrom4([4]byte(b[16:20]))
+	case ipv6.Version:
+		e, er := parseIPv6Ext(b)
+		if er != nil {
+			return t, 0, er
+		}
+		if e.frag != 0 && (int(b[e.frag+2])<<8|int(b[e.frag+3]))&^7 != 0 {
+			return t, 0, ErrInvalidPacket
+		}
+		off = e.off
+		t.Protocol = e.proto
+		t.SrcAddr = netip.AddrFrom16([16]byte(b[8:24]))
+		t.DstAddr = netip.AddrFrom16([16]byte(b[24:40]))
+	default:
+		return t, 0, ErrInvalidPacket
+	}
+
+	switch t.Protocol {
+	case iana.ProtocolTCP, iana.ProtocolUDP:
+		if len(b) < off+4 {
+			return t, 0, ErrInvalidPacket
+		}
+		t.SrcPort = uint16(b[off])<<8 | uint16(b[off+1])
+		t.DstPort = uint16(b[off+2])<<8 | uint16(b[off+3])
+	}
+
+	return t, off, nil
+}
+
+// ipPacketLen returns the length of an IP packet from its header
+func ipPacketLen(b []byte) int {
+	switch b[0] >> 4 {
+	case ipv4.Version:
+		return int(b[2])<<8 | int(b[3])
+	case ipv6.Version:
+		return ipv6.HeaderLen + (int(b[4])<<8 | int(b[5]))
+	default:
+		return 0
+	}
+}
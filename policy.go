@@ -0,0 +1,547 @@
+package windivert
+
+import (
+	"container/list"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/sbilly/go-windivert2/internal/utils"
+)
+
+// Verdict is what is done with a packet
+type Verdict uint8
+
+const (
+	// VerdictNone leaves the decision to the next policy
+	VerdictNone Verdict = iota
+	// VerdictDivert hands the packet to the reader of the Device
+	VerdictDivert
+	// VerdictPass lets the packet go on its way
+	VerdictPass
+	// VerdictDrop discards the packet
+	VerdictDrop
+	// VerdictReject discards the packet and answers it with a TCP reset or
+	// an ICMP port unreachable
+	VerdictReject
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case VerdictNone:
+		return "none"
+	case VerdictDivert:
+		return "divert"
+	case VerdictPass:
+		return "pass"
+	case VerdictDrop:
+		return "drop"
+	case VerdictReject:
+		return "reject"
+	default:
+		return ""
+	}
+}
+
+// PolicyContext is the packet a Policy decides on. For TCP and UDP it is
+// the first packet of a connection, the verdict holds for the connection.
+type PolicyContext struct {
+	Packet []byte
+	// Address is the address the packet was received with, nil when not
+	// known
+	Address *Address
+	// Tuple is the tuple of the packet, the ports are zero for protocols
+	// other than TCP and UDP
+	Tuple FiveTuple
+
+	flows  *FlowTracker
+	pid    uint32
+	hasPID bool
+	looked bool
+}
+
+// NewPolicyContext creates the context of a packet. flows attributes the
+// packet to a process and may be nil.
+func NewPolicyContext(b []byte, addr *Address, flows *FlowTracker) (*PolicyContext, error) {
+	t, _, err := parseTransport(b)
+	if err != nil {
+		return nil, err
+	}
+	return &PolicyContext{Packet: b, Address: addr, Tuple: t, flows: flows}, nil
+}
+
+// Outbound reports whether the packet leaves the host, packets received
+// without an address are taken as outbound
+func (c *PolicyContext) Outbound() bool {
+	return c.Address == nil || c.Address.Outbound()
+}
+
+// Process returns the process owning the connection of the packet, it is
+// looked up on first use
+func (c *PolicyContext) Process() (uint32, bool) {
+	if !c.looked && c.flows != nil {
+		t := c.Tuple
+		if !c.Outbound() {
+			t = t.Reverse()
+		}
+		c.pid, c.hasPID = c.flows.Lookup(t)
+	}
+	c.looked = true
+	return c.pid, c.hasPID
+}
+
+// Remote returns the address of the peer of the host
+func (c *PolicyContext) Remote() netip.Addr {
+	if c.Outbound() {
+		return c.Tuple.DstAddr
+	}
+	return c.Tuple.SrcAddr
+}
+
+// Policy decides what is done with packets
+type Policy interface {
+	Verdict(c *PolicyContext) Verdict
+}
+
+// PolicyFunc adapts a function to Policy
+type PolicyFunc func(c *PolicyContext) Verdict
+
+func (f PolicyFunc) Verdict(c *PolicyContext) Verdict {
+	return f(c)
+}
+
+// Default returns a Policy always giving v
+func Default(v Verdict) Policy {
+	return PolicyFunc(func(*PolicyContext) Verdict { return v })
+}
+
+// Chain returns a Policy giving the first verdict other than VerdictNone of
+// ps, or VerdictNone
+func Chain(ps ...Policy) Policy {
+	return PolicyFunc(func(c *PolicyContext) Verdict {
+		for _, p := range ps {
+			if v := p.Verdict(c); v != VerdictNone {
+				return v
+			}
+		}
+		return VerdictNone
+	})
+}
+
+// IPSet gives its verdict to packets whose remote address is in the set
+type IPSet struct {
+	v Verdict
+
+	mu       sync.RWMutex
+	addrs    map[netip.Addr]struct{}
+	prefixes []netip.Prefix
+}
+
+// NewIPSet creates a set of the addresses and networks in prefixes
+func NewIPSet(v Verdict, prefixes ...netip.Prefix) *IPSet {
+	s := &IPSet{v: v, addrs: make(map[netip.Addr]struct{})}
+	for _, p := range prefixes {
+		s.Add(p)
+	}
+	return s
+}
+
+// Add adds a network, single addresses are looked up in constant time and
+// networks one after the other
+func (s *IPSet) Add(p netip.Prefix) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p = p.Masked()
+	if p.IsSingleIP() {
+		s.addrs[p.Addr()] = struct{}{}
+		return
+	}
+	s.prefixes = append(s.prefixes, p)
+}
+
+// Prefixes returns the networks of the set, single addresses as full
+// length prefixes
+func (s *IPSet) Prefixes() []netip.Prefix {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ps := make([]netip.Prefix, 0, len(s.addrs)+len(s.prefixes))
+	for a := range s.addrs {
+		ps = append(ps, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return append(ps, s.prefixes...)
+}
+
+// Contains reports whether addr is in the set
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.addrs[addr]; ok {
+		return true
+	}
+	for _, p := range s.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *IPSet) Verdict(c *PolicyContext) Verdict {
+	if s.Contains(c.Remote()) {
+		return s.v
+	}
+	return VerdictNone
+}
+
+// ipFilterPolicy adapts the IPFilter of a Device
+type ipFilterPolicy struct {
+	f *utils.IPFilter
+	v Verdict
+}
+
+func (p ipFilterPolicy) Verdict(c *PolicyContext) Verdict {
+	if p.f.Lookup(c.Remote().AsSlice()) {
+		return p.v
+	}
+	return VerdictNone
+}
+
+// PIDMatcher matches processes, utils.AppFilter and AppRules are PIDMatchers
+type PIDMatcher interface {
+	Lookup(pid uint32) bool
+}
+
+// AppSet gives its verdict to packets of the processes matched by any of
+// its matchers
+type AppSet struct {
+	v        Verdict
+	matchers []PIDMatcher
+}
+
+// NewAppSet creates an app set
+func NewAppSet(v Verdict, matchers ...PIDMatcher) *AppSet {
+	return &AppSet{v: v, matchers: matchers}
+}
+
+func (s *AppSet) Verdict(c *PolicyContext) Verdict {
+	pid, ok := c.Process()
+	if !ok {
+		return VerdictNone
+	}
+	for _, m := range s.matchers {
+		if m.Lookup(pid) {
+			return s.v
+		}
+	}
+	return VerdictNone
+}
+
+// PortSet gives its verdict to packets sent to one of its remote ports
+type PortSet struct {
+	v     Verdict
+	proto uint8
+	ports map[uint16]struct{}
+}
+
+// NewPortSet creates a port set for protocol proto, any of TCP and UDP when
+// proto is zero
+func NewPortSet(v Verdict, proto uint8, ports ...uint16) *PortSet {
+	s := &PortSet{v: v, proto: proto, ports: make(map[uint16]struct{})}
+	for _, p := range ports {
+		s.ports[p] = struct{}{}
+	}
+	return s
+}
+
+func (s *PortSet) Verdict(c *PolicyContext) Verdict {
+	if s.proto != 0 && s.proto != c.Tuple.Protocol {
+		return VerdictNone
+	}
+
+	port := c.Tuple.DstPort
+	if !c.Outbound() {
+		port = c.Tuple.SrcPort
+	}
+	if _, ok := s.ports[port]; ok {
+		return s.v
+	}
+	return VerdictNone
+}
+
+// DNSObserver learns from DNS responses, DomainSet is a DNSObserver
+type DNSObserver interface {
+	ObserveDNS(msg []byte) error
+}
+
+// DomainSet gives its verdict to packets sent to the addresses domains
+// matching its patterns resolve to. Patterns follow the domain tree syntax,
+// "**.example.com" matches example.com and all its subdomains. The
+// addresses are learnt with Learn or from DNS responses with ObserveDNS,
+// the latter are forgotten when their records expire.
+type DomainSet struct {
+	// MaxAddrs bounds the addresses remembered, the least recently learnt
+	// is forgotten when it is reached. Zero means no bound.
+	MaxAddrs int
+	// MinTTL is the least time an address learnt from DNS is remembered
+	MinTTL time.Duration
+
+	v     Verdict
+	tree  *utils.DomainTree
+	mu    sync.RWMutex
+	addrs map[netip.Addr]*list.Element
+	lru   *list.List
+}
+
+const (
+	// DomainMaxAddrsDefault bounds the addresses of a DomainSet
+	DomainMaxAddrsDefault = 1 << 16
+	// DomainMinTTLDefault is the least time a DomainSet remembers an
+	// address learnt from DNS
+	DomainMinTTLDefault = 30 * time.Second
+
+	// dnsMaxAliases bounds the CNAME chains followed
+	dnsMaxAliases = 8
+)
+
+// domainAddr is an address learnt for name, it never expires when expires
+// is zero
+type domainAddr struct {
+	addr    netip.Addr
+	name    string
+	expires time.Time
+}
+
+// NewDomainSet creates a domain set
+func NewDomainSet(v Verdict, patterns ...string) *DomainSet {
+	s := &DomainSet{
+		MaxAddrs: DomainMaxAddrsDefault,
+		MinTTL:   DomainMinTTLDefault,
+		v:        v,
+		tree:     utils.NewDomainTree("."),
+		addrs:    make(map[netip.Addr]*list.Element),
+		lru:      list.New(),
+	}
+	for _, p := range patterns {
+		s.Add(p)
+	}
+	return s
+}
+
+// Add adds a pattern
+func (s *DomainSet) Add(pattern string) {
+	s.tree.Store(strings.ToLower(pattern), true)
+}
+
+// Match reports whether name matches a pattern
+func (s *DomainSet) Match(name string) bool {
+	v, _ := s.tree.Load(strings.ToLower(strings.TrimSuffix(name, "."))).(bool)
+	return v
+}
+
+// Len returns the number of addresses remembered, expired ones included
+// until they are forgotten
+func (s *DomainSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.addrs)
+}
+
+// Learn records that name resolves to addrs, when it matches a pattern.
+// The addresses do not expire.
+func (s *DomainSet) Learn(name string, addrs ...netip.Addr) {
+	if s.Match(name) {
+		s.learn(name, time.Time{}, time.Time{}, addrs...)
+	}
+}
+
+// learn records addrs for name until expires, now is the time expired
+// addresses are forgotten against
+func (s *DomainSet) learn(name string, expires, now time.Time, addrs ...netip.Addr) {
+	name = strings.TrimSuffix(name, ".")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range addrs {
+		a = a.Unmap()
+		if e, ok := s.addrs[a]; ok {
+			d := e.Value.(*domainAddr)
+			d.name, d.expires = name, expires
+			s.lru.MoveToFront(e)
+			continue
+		}
+
+		// forget the expired and then the least recently learnt
+		for e := s.lru.Back(); e != nil && s.expired(e.Value.(*domainAddr), now); e = s.lru.Back() {
+			s.forget(e)
+		}
+		for s.MaxAddrs > 0 && len(s.addrs) >= s.MaxAddrs {
+			s.forget(s.lru.Back())
+		}
+		s.addrs[a] = s.lru.PushFront(&domainAddr{addr: a, name: name, expires: expires})
+	}
+}
+
+func (s *DomainSet) expired(d *domainAddr, now time.Time) bool {
+	return !d.expires.IsZero() && !now.IsZero() && !now.Before(d.expires)
+}
+
+func (s *DomainSet) forget(e *list.Element) {
+	delete(s.addrs, e.Value.(*domainAddr).addr)
+	s.lru.Remove(e)
+}
+
+// ObserveDNS is ObserveDNSAt at the current time
+func (s *DomainSet) ObserveDNS(msg []byte) error {
+	return s.ObserveDNSAt(msg, time.Now())
+}
+
+// dnsAlias is a CNAME record pointing to a name
+type dnsAlias struct {
+	name string
+	ttl  uint32
+}
+
+// ObserveDNSAt learns the A and AAAA records of a DNS response message
+// received at now. An address is learnt for the owner of its record or any
+// alias of it named by the CNAME records of the message that matches a
+// pattern, the name nearest to the question is preferred. It is remembered
+// for the least TTL of the records leading to it.
+func (s *DomainSet) ObserveDNSAt(msg []byte, now time.Time) error {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return err
+	}
+	if !h.Response || h.RCode != dnsmessage.RCodeSuccess {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return err
+	}
+
+	type record struct {
+		owner string
+		ttl   uint32
+		addr  netip.Addr
+	}
+	records := []record{}
+	// aliases maps the target of a CNAME record to its owners
+	aliases := map[string][]dnsAlias{}
+
+	for {
+		r, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		owner := strings.ToLower(r.Name.String())
+		switch r.Type {
+		case dnsmessage.TypeA:
+			a, err := p.AResource()
+			if err != nil {
+				return err
+			}
+			records = append(records, record{owner, r.TTL, netip.AddrFrom4(a.A)})
+		case dnsmessage.TypeAAAA:
+			a, err := p.AAAAResource()
+			if err != nil {
+				return err
+			}
+			records = append(records, record{owner, r.TTL, netip.AddrFrom16(a.AAAA)})
+		case dnsmessage.TypeCNAME:
+			c, err := p.CNAMEResource()
+			if err != nil {
+				return err
+			}
+			target := strings.ToLower(c.CNAME.String())
+			aliases[target] = append(aliases[target], dnsAlias{owner, r.TTL})
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range records {
+		name, ttl, ok := s.resolveAlias(r.owner, r.ttl, aliases)
+		if !ok {
+			continue
+		}
+		d := time.Duration(ttl) * time.Second
+		if d < s.MinTTL {
+			d = s.MinTTL
+		}
+		s.learn(name, now.Add(d), now, r.addr)
+	}
+	return nil
+}
+
+// resolveAlias walks the aliases of owner back towards the question and
+// returns the matching name nearest to it with the least TTL on the way
+func (s *DomainSet) resolveAlias(owner string, ttl uint32, aliases map[string][]dnsAlias) (string, uint32, bool) {
+	name, minTTL, found := "", ttl, false
+	seen := map[string]bool{}
+
+	cur := []dnsAlias{{owner, ttl}}
+	for depth := 0; len(cur) > 0 && depth <= dnsMaxAliases; depth++ {
+		next := []dnsAlias{}
+		for _, c := range cur {
+			if seen[c.name] {
+				continue
+			}
+			seen[c.name] = true
+			if s.Match(c.name) {
+				name, minTTL, found = c.name, c.ttl, true
+			}
+			for _, a := range aliases[c.name] {
+				if a.ttl > c.ttl {
+					a.ttl = c.ttl
+				}
+				next = append(next, a)
+			}
+		}
+		cur = next
+	}
+	return name, minTTL, found
+}
+
+// Domain is DomainAt at the current time
+func (s *DomainSet) Domain(addr netip.Addr) (string, bool) {
+	return s.DomainAt(addr, time.Now())
+}
+
+// DomainAt returns the domain addr was learnt for, unless it expired
+// before now
+func (s *DomainSet) DomainAt(addr netip.Addr, now time.Time) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.addrs[addr.Unmap()]
+	if !ok {
+		return "", false
+	}
+	d := e.Value.(*domainAddr)
+	if s.expired(d, now) {
+		return "", false
+	}
+	return d.name, true
+}
+
+func (s *DomainSet) Verdict(c *PolicyContext) Verdict {
+	if _, ok := s.Domain(c.Remote()); ok {
+		return s.v
+	}
+	return VerdictNone
+}
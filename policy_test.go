@@ -0,0 +1,173 @@
+package windivert
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsRecord is an answer of testDNSResponse, a CNAME when target is set
+type dnsRecord struct {
+	name   string
+	ttl    uint32
+	addr   string
+	target string
+}
+
+func testDNSResponse(t *testing.T, question string, rs ...dnsRecord) []byte {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(question), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	for _, r := range rs {
+		h := dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(r.name), Class: dnsmessage.ClassINET, TTL: r.ttl}
+		if r.target != "" {
+			b.CNAMEResource(h, dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(r.target)})
+			continue
+		}
+		if a := netip.MustParseAddr(r.addr); a.Is4() {
+			b.AResource(h, dnsmessage.AResource{A: a.As4()})
+		} else {
+			b.AAAAResource(h, dnsmessage.AAAAResource{AAAA: a.As16()})
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestDomainSetObserveDNS(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	for _, tt := range []struct {
+		name    string
+		pattern string
+		msg     []dnsRecord
+		addr    string
+		domain  string
+		ok      bool
+	}{
+		{
+			name: "a", pattern: "**.example.com",
+			msg:  []dnsRecord{{name: "www.example.com.", ttl: 60, addr: "93.184.216.34"}},
+			addr: "93.184.216.34", domain: "www.example.com", ok: true,
+		},
+		{
+			name: "aaaa", pattern: "example.com",
+			msg:  []dnsRecord{{name: "Example.COM.", ttl: 60, addr: "2606:2800:220:1::1"}},
+			addr: "2606:2800:220:1::1", domain: "example.com", ok: true,
+		},
+		{
+			name: "no match", pattern: "example.com",
+			msg:  []dnsRecord{{name: "example.org.", ttl: 60, addr: "1.2.3.4"}},
+			addr: "1.2.3.4",
+		},
+		{
+			name: "cname chain", pattern: "**.example.com",
+			msg: []dnsRecord{
+				{name: "edge.cdn.net.", ttl: 20, addr: "1.2.3.4"},
+				{name: "www.example.com.", ttl: 300, target: "www.example.com.cdn.net."},
+				{name: "www.example.com.cdn.net.", ttl: 300, target: "edge.cdn.net."},
+			},
+			addr: "1.2.3.4", domain: "www.example.com", ok: true,
+		},
+		{
+			name: "cname loop", pattern: "**.example.com",
+			msg: []dnsRecord{
+				{name: "a.net.", ttl: 60, target: "b.net."},
+				{name: "b.net.", ttl: 60, target: "a.net."},
+				{name: "a.net.", ttl: 60, addr: "1.2.3.4"},
+			},
+			addr: "1.2.3.4",
+		},
+	} {
+		s := NewDomainSet(VerdictDivert, tt.pattern)
+		if err := s.ObserveDNSAt(testDNSResponse(t, "www.example.com.", tt.msg...), now); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		domain, ok := s.DomainAt(netip.MustParseAddr(tt.addr), now)
+		if domain != tt.domain || ok != tt.ok {
+			t.Errorf("%s: DomainAt = %q, %v, want %q, %v", tt.name, domain, ok, tt.domain, tt.ok)
+		}
+	}
+}
+
+func TestDomainSetExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewDomainSet(VerdictDivert, "**.example.com")
+	s.MinTTL = 10 * time.Second
+	s.MaxAddrs = 3
+
+	s.Learn("static.example.com", netip.MustParseAddr("10.0.0.1"))
+	msg := testDNSResponse(t, "cdn.example.com.",
+		dnsRecord{name: "short.example.com.", ttl: 0, addr: "10.0.0.2"},
+		dnsRecord{name: "cdn.example.com.", ttl: 100, target: "edge.cdn.net."},
+		dnsRecord{name: "edge.cdn.net.", ttl: 30, addr: "10.0.0.3"},
+	)
+	if err := s.ObserveDNSAt(msg, now); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		at   time.Duration
+		addr string
+		ok   bool
+	}{
+		{0, "10.0.0.2", true},
+		{9 * time.Second, "10.0.0.2", true},
+		// held for MinTTL
+		{10 * time.Second, "10.0.0.2", false},
+		// the least TTL on the CNAME chain
+		{29 * time.Second, "10.0.0.3", true},
+		{30 * time.Second, "10.0.0.3", false},
+		{time.Hour, "10.0.0.1", true},
+	} {
+		if _, ok := s.DomainAt(netip.MustParseAddr(tt.addr), now.Add(tt.at)); ok != tt.ok {
+			t.Errorf("at %v: DomainAt(%s) = %v", tt.at, tt.addr, ok)
+		}
+	}
+
+	// expired addresses go first, then the least recently learnt
+	later := now.Add(time.Minute)
+	s.ObserveDNSAt(testDNSResponse(t, "a.example.com.",
+		dnsRecord{name: "a.example.com.", ttl: 60, addr: "10.0.1.1"},
+		dnsRecord{name: "a.example.com.", ttl: 60, addr: "10.0.1.2"},
+		dnsRecord{name: "a.example.com.", ttl: 60, addr: "10.0.1.3"},
+	), later)
+	if s.Len() != 3 {
+		t.Errorf("Len() = %d", s.Len())
+	}
+	if _, ok := s.DomainAt(netip.MustParseAddr("10.0.0.1"), later); ok {
+		t.Error("least recently learnt address kept")
+	}
+}
+
+func TestDeviceObserveDNS(t *testing.T) {
+	d := &Device{dnsSubs: make(map[int]DNSObserver)}
+	s := NewDomainSet(VerdictDivert, "**.example.com")
+	msg := testDNSResponse(t, "www.example.com.", dnsRecord{name: "www.example.com.", ttl: 60, addr: "93.184.216.34"})
+	dns := netip.MustParseAddrPort("8.8.8.8:53")
+
+	cancel := d.ObserveDNS(s)
+	// a query, not a response from port 53
+	d.observeDNS(testPacket(17, testSrc4, dns, 0, 0, msg))
+	if s.Len() != 0 {
+		t.Fatal("query learnt")
+	}
+
+	d.observeDNS(testPacket(17, dns, testSrc4, 0, 0, msg))
+	if domain, ok := s.Domain(netip.MustParseAddr("93.184.216.34")); !ok || domain != "www.example.com" {
+		t.Errorf("Domain = %q, %v", domain, ok)
+	}
+
+	cancel()
+	msg = testDNSResponse(t, "www.example.com.", dnsRecord{name: "www.example.com.", ttl: 60, addr: "93.184.216.35"})
+	d.observeDNS(testPacket(17, dns, testSrc4, 0, 0, msg))
+	if s.Len() != 1 || d.dnsN.Load() != 0 {
+		t.Error("observed after cancel")
+	}
+}
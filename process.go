@@ -0,0 +1,185 @@
+package windivert
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrProcessNotFound is returned for a PID with no running process
+var ErrProcessNotFound = errors.New("process not found")
+
+// ProcessInfo describes a running process
+type ProcessInfo struct {
+	PID       uint32
+	ParentPID uint32
+	// Path is the full path of the executable image and Name its base name
+	Path string
+	Name string
+	// User is the SID of the user owning the process
+	User      string
+	StartTime time.Time
+}
+
+// ProcessResolver looks up running processes
+type ProcessResolver interface {
+	// Process returns the information of the process pid
+	Process(pid uint32) (ProcessInfo, error)
+	// StartTime returns the start time of the process pid only, it tells
+	// a process apart from an earlier one with the same PID
+	StartTime(pid uint32) (time.Time, error)
+}
+
+// ProcessCacheTTLDefault is the default for ProcessCache.TTL
+const ProcessCacheTTLDefault = 5 * time.Minute
+
+// ProcessCache caches the lookups of a ProcessResolver. A cached entry is
+// checked against the start time of the process on every lookup, so that
+// an exited process or a reused PID is never reported.
+type ProcessCache struct {
+	// TTL is how long a process is cached before it is looked up again in
+	// full
+	TTL time.Duration
+
+	resolver ProcessResolver
+
+	mu    sync.Mutex
+	procs map[uint32]cachedProcess
+}
+
+type cachedProcess struct {
+	info ProcessInfo
+	at   time.Time
+}
+
+// NewProcessCache creates a cache in front of r
+func NewProcessCache(r ProcessResolver) *ProcessCache {
+	return &ProcessCache{
+		TTL:      ProcessCacheTTLDefault,
+		resolver: r,
+		procs:    make(map[uint32]cachedProcess),
+	}
+}
+
+// Len returns the number of cached processes
+func (c *ProcessCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.procs)
+}
+
+// Process is ProcessAt at the current time
+func (c *ProcessCache) Process(pid uint32) (ProcessInfo, error) {
+	return c.ProcessAt(pid, time.Now())
+}
+
+// ProcessAt returns the information of the process pid at time now
+func (c *ProcessCache) ProcessAt(pid uint32, now time.Time) (ProcessInfo, error) {
+	c.mu.Lock()
+	p, ok := c.procs[pid]
+	c.mu.Unlock()
+
+	if ok && now.Sub(p.at) < c.TTL {
+		t, err := c.resolver.StartTime(pid)
+		if err == nil && t.Equal(p.info.StartTime) {
+			return p.info, nil
+		}
+	}
+	if ok {
+		c.Forget(pid)
+	}
+
+	info, err := c.resolver.Process(pid)
+	if err != nil {
+		return info, err
+	}
+
+	c.mu.Lock()
+	c.procs[pid] = cachedProcess{info: info, at: now}
+	c.mu.Unlock()
+	return info, nil
+}
+
+// StartTime returns the start time of the process pid
+func (c *ProcessCache) StartTime(pid uint32) (time.Time, error) {
+	return c.resolver.StartTime(pid)
+}
+
+// Forget drops the process pid, it is called when the process is known to
+// have exited
+func (c *ProcessCache) Forget(pid uint32) {
+	c.mu.Lock()
+	delete(c.procs, pid)
+	c.mu.Unlock()
+}
+
+// Prune is PruneAt at the current time
+func (c *ProcessCache) Prune() {
+	c.PruneAt(time.Now())
+}
+
+// PruneAt drops the processes that have exited, whose PID was reused or
+// that were cached for longer than TTL at time now
+func (c *ProcessCache) PruneAt(now time.Time) {
+	c.mu.Lock()
+	procs := make([]cachedProcess, 0, len(c.procs))
+	for _, p := range c.procs {
+		procs = append(procs, p)
+	}
+	c.mu.Unlock()
+
+	for _, p := range procs {
+		if now.Sub(p.at) >= c.TTL {
+			c.Forget(p.info.PID)
+			continue
+		}
+		if t, err := c.resolver.StartTime(p.info.PID); err != nil || !t.Equal(p.info.StartTime) {
+			c.Forget(p.info.PID)
+		}
+	}
+}
+
+// FakeProcessResolver is a ProcessResolver serving the processes added to
+// it, for tests
+type FakeProcessResolver struct {
+	mu    sync.RWMutex
+	procs map[uint32]ProcessInfo
+}
+
+// NewFakeProcessResolver creates a resolver serving procs
+func NewFakeProcessResolver(procs ...ProcessInfo) *FakeProcessResolver {
+	r := &FakeProcessResolver{procs: make(map[uint32]ProcessInfo)}
+	for _, p := range procs {
+		r.Add(p)
+	}
+	return r
+}
+
+// Add starts the process p, replacing any process with the same PID
+func (r *FakeProcessResolver) Add(p ProcessInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.procs[p.PID] = p
+}
+
+// Remove exits the process pid
+func (r *FakeProcessResolver) Remove(pid uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.procs, pid)
+}
+
+func (r *FakeProcessResolver) Process(pid uint32) (ProcessInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.procs[pid]
+	if !ok {
+		return p, ErrProcessNotFound
+	}
+	return p, nil
+}
+
+func (r *FakeProcessResolver) StartTime(pid uint32) (time.Time, error) {
+	p, err := r.Process(pid)
+	return p.StartTime, err
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import (
+	"errors"
+	"time"
+)
+
+// systemProcessResolver finds no process where there is no Win32 API
+type systemProcessResolver struct{}
+
+// SystemProcessResolver returns a ProcessResolver for the running system
+func SystemProcessResolver() ProcessResolver {
+	return systemProcessResolver{}
+}
+
+var errProcessUnsupported = errors.New("process lookup is only supported on windows")
+
+func (systemProcessResolver) Process(pid uint32) (ProcessInfo, error) {
+	return ProcessInfo{PID: pid}, errProcessUnsupported
+}
+
+func (systemProcessResolver) StartTime(pid uint32) (time.Time, error) {
+	return time.Time{}, errProcessUnsupported
+}
@@ -0,0 +1,92 @@
+package windivert
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProcessCache(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewFakeProcessResolver(ProcessInfo{PID: 10, Path: "C:/Apps/app.exe", Name: "app.exe", User: "S-1-5-18", StartTime: t0})
+	c := NewProcessCache(r)
+	c.TTL = time.Minute
+	now := t0.Add(time.Hour)
+
+	for _, tt := range []struct {
+		name  string
+		start *ProcessInfo
+		exit  bool
+		at    time.Duration
+		want  string
+		err   error
+	}{
+		{name: "first lookup", want: "C:/Apps/app.exe"},
+		{name: "cached", at: 30 * time.Second, want: "C:/Apps/app.exe"},
+		{name: "pid reused", start: &ProcessInfo{PID: 10, Path: "C:/Other/evil.exe", StartTime: t0.Add(time.Minute)}, at: 40 * time.Second, want: "C:/Other/evil.exe"},
+		{name: "exited", exit: true, at: 50 * time.Second, err: ErrProcessNotFound},
+	} {
+		if tt.start != nil {
+			r.Add(*tt.start)
+		}
+		if tt.exit {
+			r.Remove(10)
+		}
+
+		p, err := c.ProcessAt(10, now.Add(tt.at))
+		if err != tt.err || p.Path != tt.want {
+			t.Errorf("%s: Process(10) = %q, %v, want %q, %v", tt.name, p.Path, err, tt.want, tt.err)
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after the process exited", c.Len())
+	}
+}
+
+func TestProcessCacheTTL(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewFakeProcessResolver(ProcessInfo{PID: 10, User: "S-1-5-18", StartTime: t0})
+	c := NewProcessCache(r)
+	c.TTL = time.Minute
+
+	c.ProcessAt(10, t0)
+	r.Add(ProcessInfo{PID: 10, User: "S-1-5-19", StartTime: t0})
+
+	for _, tt := range []struct {
+		at   time.Duration
+		want string
+	}{
+		{59 * time.Second, "S-1-5-18"},
+		{time.Minute, "S-1-5-19"},
+		{90 * time.Second, "S-1-5-19"},
+	} {
+		if p, _ := c.ProcessAt(10, t0.Add(tt.at)); p.User != tt.want {
+			t.Errorf("at %v: User = %q, want %q", tt.at, p.User, tt.want)
+		}
+	}
+}
+
+func TestProcessCachePrune(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := NewFakeProcessResolver(
+		ProcessInfo{PID: 10, StartTime: t0},
+		ProcessInfo{PID: 11, StartTime: t0},
+		ProcessInfo{PID: 12, StartTime: t0},
+	)
+	c := NewProcessCache(r)
+	c.TTL = time.Minute
+	for pid := uint32(10); pid <= 12; pid++ {
+		c.ProcessAt(pid, t0.Add(time.Duration(pid-10)*10*time.Second))
+	}
+
+	r.Remove(11)
+	r.Add(ProcessInfo{PID: 12, StartTime: t0.Add(time.Second)})
+	c.PruneAt(t0.Add(30 * time.Second))
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d after the processes exited", c.Len())
+	}
+
+	c.PruneAt(t0.Add(time.Minute))
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d after the entries expired", c.Len())
+	}
+}
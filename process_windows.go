@@ -0,0 +1,107 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code of a running process, STILL_ACTIVE
+const stillActive = 259
+
+// systemProcessResolver looks up processes with the Win32 API
+type systemProcessResolver struct{}
+
+// SystemProcessResolver returns a ProcessResolver for the running system
+func SystemProcessResolver() ProcessResolver {
+	return systemProcessResolver{}
+}
+
+func openProcess(pid uint32) (windows.Handle, error) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err == windows.ERROR_INVALID_PARAMETER {
+		return 0, ErrProcessNotFound
+	}
+	return h, err
+}
+
+func processStartTime(h windows.Handle) (time.Time, error) {
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, creation.Nanoseconds()), nil
+}
+
+func (systemProcessResolver) StartTime(pid uint32) (time.Time, error) {
+	h, err := openProcess(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer windows.CloseHandle(h)
+
+	// a process that has exited but still has open handles is gone too
+	code := uint32(0)
+	if err := windows.GetExitCodeProcess(h, &code); err == nil && code != stillActive {
+		return time.Time{}, ErrProcessNotFound
+	}
+
+	return processStartTime(h)
+}
+
+func (systemProcessResolver) Process(pid uint32) (ProcessInfo, error) {
+	p := ProcessInfo{PID: pid}
+
+	h, err := openProcess(pid)
+	if err != nil {
+		return p, err
+	}
+	defer windows.CloseHandle(h)
+
+	if p.StartTime, err = processStartTime(h); err != nil {
+		return p, fmt.Errorf("get process times error: %v", err)
+	}
+
+	buf := make([]uint16, windows.MAX_LONG_PATH)
+	n := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &n); err != nil {
+		return p, fmt.Errorf("query process image name error: %v", err)
+	}
+	p.Path = windows.UTF16ToString(buf[:n])
+	p.Name = filepath.Base(p.Path)
+
+	var token windows.Token
+	if err := windows.OpenProcessToken(h, windows.TOKEN_QUERY, &token); err == nil {
+		if u, err := token.GetTokenUser(); err == nil {
+			p.User = u.User.Sid.String()
+		}
+		token.Close()
+	}
+
+	p.ParentPID, _ = parentPID(pid)
+
+	return p, nil
+}
+
+// parentPID finds the parent of pid in a process snapshot
+func parentPID(pid uint32) (uint32, error) {
+	s, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(s)
+
+	e := windows.ProcessEntry32{Size: uint32(unsafe.Sizeof(windows.ProcessEntry32{}))}
+	for err = windows.Process32First(s, &e); err == nil; err = windows.Process32Next(s, &e) {
+		if e.ProcessID == pid {
+			return e.ParentProcessID, nil
+		}
+	}
+	return 0, ErrProcessNotFound
+}
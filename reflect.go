@@ -0,0 +1,206 @@
+package windivert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// HandleInfo describes a WinDivert handle as reported by the reflect layer
+type HandleInfo struct {
+	PID      uint32
+	Layer    Layer
+	Flags    uint64
+	Priority int16
+	// Filter is the filter of the handle formatted by FormatFilter, or the
+	// compiled object when it cannot be formatted
+	Filter string
+	// Timestamp is when the handle was opened
+	Timestamp int64
+}
+
+// Sniffing reports whether the handle only copies packets
+func (h HandleInfo) Sniffing() bool {
+	return h.Flags&FlagSniff == FlagSniff
+}
+
+// Overlaps reports whether h may take packets away from a handle opened on
+// layer with priority and filter, that is whether h is a handle of higher or
+// equal priority on the same layer that does not sniff and whose filter
+// overlaps filter as FiltersOverlap tells
+func (h HandleInfo) Overlaps(layer Layer, priority int16, filter string) bool {
+	if h.Layer != layer || h.Priority < priority || h.Sniffing() {
+		return false
+	}
+	return FiltersOverlap(h.Filter, filter)
+}
+
+// HandleEvent is passed to the subscribers of a HandleInventory
+type HandleEvent struct {
+	// Event is EventReflectOpen or EventReflectClose
+	Event Event
+	HandleInfo
+}
+
+// handleKey identifies a handle, the reflect layer has no handle id
+type handleKey struct {
+	pid       uint32
+	layer     Layer
+	flags     uint64
+	priority  int16
+	timestamp int64
+}
+
+// HandleInventory keeps the WinDivert handles open on the system. It is fed
+// by Run, which is told about existing handles when it starts, or with
+// recorded events by Process.
+type HandleInventory struct {
+	mu      sync.RWMutex
+	handles map[handleKey]HandleInfo
+	subs    map[int]func(HandleEvent)
+	nextSub int
+}
+
+// NewHandleInventory creates an empty inventory
+func NewHandleInventory() *HandleInventory {
+	return &HandleInventory{
+		handles: make(map[handleKey]HandleInfo),
+		subs:    make(map[int]func(HandleEvent)),
+	}
+}
+
+// Handles returns the open handles
+func (v *HandleInventory) Handles() []HandleInfo {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	hs := make([]HandleInfo, 0, len(v.handles))
+	for _, h := range v.handles {
+		hs = append(hs, h)
+	}
+	return hs
+}
+
+// Conflicts returns the handles of other processes that overlap a handle
+// opened on layer with priority and filter
+func (v *HandleInventory) Conflicts(layer Layer, priority int16, filter string) []HandleInfo {
+	pid := uint32(os.Getpid())
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	hs := []HandleInfo{}
+	for _, h := range v.handles {
+		if h.PID != pid && h.Overlaps(layer, priority, filter) {
+			hs = append(hs, h)
+		}
+	}
+	return hs
+}
+
+// Subscribe calls fn for every handle opened or closed until cancel is
+// called
+func (v *HandleInventory) Subscribe(fn func(HandleEvent)) (cancel func()) {
+	v.mu.Lock()
+	id := v.nextSub
+	v.nextSub++
+	v.subs[id] = fn
+	v.mu.Unlock()
+
+	return func() {
+		v.mu.Lock()
+		delete(v.subs, id)
+		v.mu.Unlock()
+	}
+}
+
+// Process feeds a reflect layer address and its packet, the compiled filter
+// object of the handle, to the inventory
+func (v *HandleInventory) Process(addr *Address, b []byte) {
+	if addr.Layer() != LayerReflect {
+		return
+	}
+
+	r := addr.Reflect()
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	filter, err := FormatFilter(string(b), r.Layer())
+	if err != nil {
+		filter = string(b)
+	}
+
+	ev := HandleEvent{
+		Event: addr.Event(),
+		HandleInfo: HandleInfo{
+			PID:       r.ProcessID,
+			Layer:     r.Layer(),
+			Flags:     r.Flags,
+			Priority:  r.Priority,
+			Filter:    filter,
+			Timestamp: r.TimeStamp,
+		},
+	}
+	k := handleKey{
+		pid:       r.ProcessID,
+		layer:     r.Layer(),
+		flags:     r.Flags,
+		priority:  r.Priority,
+		timestamp: r.TimeStamp,
+	}
+
+	v.mu.Lock()
+	switch ev.Event {
+	case EventReflectOpen:
+		v.handles[k] = ev.HandleInfo
+	case EventReflectClose:
+		delete(v.handles, k)
+	default:
+		v.mu.Unlock()
+		return
+	}
+	subs := make([]func(HandleEvent), 0, len(v.subs))
+	for _, fn := range v.subs {
+		subs = append(subs, fn)
+	}
+	v.mu.Unlock()
+
+	for _, fn := range subs {
+		fn(ev)
+	}
+}
+
+// Run opens a reflect layer handle and feeds its events to the inventory
+// until ctx is done
+func (v *HandleInventory) Run(ctx context.Context) error {
+	hd, err := Open("true", LayerReflect, PriorityDefault, FlagSniff|FlagRecvOnly)
+	if err != nil {
+		return fmt.Errorf("open reflect handle error: %v", err)
+	}
+	defer hd.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hd.Shutdown(ShutdownBoth)
+		case <-done:
+		}
+	}()
+
+	b := [][]byte{make([]byte, MTUMax)}
+	a := make([]Address, 1)
+	for {
+		n, _, err := hd.RecvEx(b, a, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("recv error: %v", err)
+		}
+		v.Process(&a[0], b[0][:n])
+	}
+}
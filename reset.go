@@ -0,0 +1,228 @@
+package windivert
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// ErrNotTCP is returned when a TCP segment is expected
+var ErrNotTCP = errors.New("not a tcp segment")
+
+// tcpSegment holds the fields of a TCP segment needed to reset it
+type tcpSegment struct {
+	tuple FiveTuple
+	off   int
+	flags uint8
+	seq   uint32
+	ack   uint32
+	// len is the sequence space used by the segment, SYN and FIN included
+	len uint32
+}
+
+func parseTCPSegment(b []byte) (s tcpSegment, err error) {
+	t, off, err := parseTransport(b)
+	if err != nil {
+		return s, err
+	}
+	if t.Protocol != iana.ProtocolTCP {
+		return s, ErrNotTCP
+	}
+
+	end := ipPacketLen(b)
+	if len(b) < end || end < off+20 {
+		return s, ErrInvalidPacket
+	}
+	doff := int(b[off+12]>>4) << 2
+	if doff < 20 || off+doff > end {
+		return s, ErrInvalidPacket
+	}
+
+	s = tcpSegment{
+		tuple: t,
+		off:   off,
+		flags: b[off+13],
+		seq:   binary.BigEndian.Uint32(b[off+4:]),
+		ack:   binary.BigEndian.Uint32(b[off+8:]),
+		len:   uint32(end - off - doff),
+	}
+	if s.flags&SYN == SYN {
+		s.len++
+	}
+	if s.flags&FIN == FIN {
+		s.len++
+	}
+	return s, nil
+}
+
+// newTCPReset builds a bare TCP segment from src to dst of tuple t
+func newTCPReset(t FiveTuple, flags uint8, seq, ack uint32) []byte {
+	var p []byte
+	var off int
+
+	if t.SrcAddr.Is4() {
+		off = ipv4.HeaderLen
+		p = make([]byte, off+20)
+		p[0] = ipv4.Version<<4 | ipv4.HeaderLen>>2
+		binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+		p[8] = 64
+		p[9] = iana.ProtocolTCP
+		s, d := t.SrcAddr.As4(), t.DstAddr.As4()
+		copy(p[12:16], s[:])
+		copy(p[16:20], d[:])
+		setIPv4HeaderChecksum(p)
+	} else {
+		off = ipv6.HeaderLen
+		p = make([]byte, off+20)
+		p[0] = ipv6.Version << 4
+		binary.BigEndian.PutUint16(p[4:], 20)
+		p[6] = iana.ProtocolTCP
+		p[7] = 64
+		s, d := t.SrcAddr.As16(), t.DstAddr.As16()
+		copy(p[8:24], s[:])
+		copy(p[24:40], d[:])
+	}
+
+	h := p[off:]
+	binary.BigEndian.PutUint16(h[0:], t.SrcPort)
+	binary.BigEndian.PutUint16(h[2:], t.DstPort)
+	binary.BigEndian.PutUint32(h[4:], seq)
+	binary.BigEndian.PutUint32(h[8:], ack)
+	h[12] = 5 << 4
+	h[13] = flags
+	setTransportChecksum(p, off)
+
+	return p
+}
+
+// RejectTCP builds the RST answering a TCP segment received with addr as
+// specified by RFC 793: the sequence number is taken from the segment's
+// acknowledgment, or the segment is acknowledged when it carries none. The
+// returned address sends the RST back towards the sender of the segment.
+func RejectTCP(b []byte, addr *Address) ([]byte, *Address, error) {
+	s, err := parseTCPSegment(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.flags&RST == RST {
+		return nil, nil, errors.New("never reset a reset")
+	}
+
+	var p []byte
+	if s.flags&ACK == ACK {
+		p = newTCPReset(s.tuple.Reverse(), RST, s.ack, 0)
+	} else {
+		p = newTCPReset(s.tuple.Reverse(), RST|ACK, 0, s.seq+s.len)
+	}
+
+	return p, replyAddress(addr), nil
+}
+
+// resetReceiver builds the RST that the receiver of a TCP segment takes as
+// coming from its sender, using the sequence number it expects next
+func resetReceiver(b []byte, addr *Address) ([]byte, *Address, error) {
+	s, err := parseTCPSegment(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p := newTCPReset(s.tuple, RST|ACK, s.seq+s.len, s.ack)
+
+	a := *addr
+	a.UnsetSniffed()
+	a.SetIPChecksum()
+	a.SetTCPChecksum()
+	return p, &a, nil
+}
+
+// tupleFilter returns a filter matching both directions of the flow t
+func tupleFilter(t FiveTuple) string {
+	t.SrcAddr, t.DstAddr = t.SrcAddr.Unmap(), t.DstAddr.Unmap()
+	ip := "ip"
+	if t.SrcAddr.Is6() {
+		ip = "ipv6"
+	}
+
+	dir := func(t FiveTuple) string {
+		return fmt.Sprintf("(%s.SrcAddr == %v and %s.DstAddr == %v and tcp.SrcPort == %d and tcp.DstPort == %d)", ip, t.SrcAddr, ip, t.DstAddr, t.SrcPort, t.DstPort)
+	}
+
+	return fmt.Sprintf("tcp and (%s or %s)", dir(t), dir(t.Reverse()))
+}
+
+// KillConnection waits for the next segment of the TCP connection t in
+// either direction and resets it by injecting a RST to both peers. It
+// returns when the RSTs are sent or ctx is done.
+func KillConnection(ctx context.Context, t FiveTuple) error {
+	if t.Protocol != iana.ProtocolTCP {
+		return ErrNotTCP
+	}
+
+	hd, err := Open(tupleFilter(t), LayerNetwork, PriorityDefault, FlagSniff|FlagRecvOnly)
+	if err != nil {
+		return fmt.Errorf("open sniff handle error: %v", err)
+	}
+	defer hd.Close()
+
+	sd, err := Open("false", LayerNetwork, PriorityDefault, FlagSendOnly)
+	if err != nil {
+		return fmt.Errorf("open send handle error: %v", err)
+	}
+	defer sd.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			hd.Shutdown(ShutdownBoth)
+		case <-done:
+		}
+	}()
+
+	a := new(Address)
+	b := make([]byte, MTUMax)
+	for {
+		n, err := hd.Recv(b, a)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("recv error: %v", err)
+		}
+
+		s, err := parseTCPSegment(b[:n])
+		if err != nil || s.flags&RST == RST {
+			continue
+		}
+
+		// a segment without ACK tells nothing about what the sender expects
+		if s.flags&ACK != ACK {
+			continue
+		}
+
+		p, pa, err := RejectTCP(b[:n], a)
+		if err != nil {
+			return err
+		}
+		if _, err := sd.Send(p, pa); err != nil {
+			return fmt.Errorf("send reset error: %v", err)
+		}
+
+		p, pa, err = resetReceiver(b[:n], a)
+		if err != nil {
+			return err
+		}
+		if _, err := sd.Send(p, pa); err != nil {
+			return fmt.Errorf("send reset error: %v", err)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"testing"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+func TestTCPReset(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		receiver bool
+		flags    uint8
+		payload  string
+		// want are the flags, seq and ack of the RST
+		want     uint8
+		seq, ack uint32
+	}{
+		{"syn", false, SYN, "", RST | ACK, 0, 101},
+		{"syn ack", false, SYN | ACK, "", RST, 500, 0},
+		{"data without ack", false, PSH, "abc", RST | ACK, 0, 103},
+		{"fin without ack", false, FIN, "abc", RST | ACK, 0, 104},
+		{"data", false, PSH | ACK, "abc", RST, 500, 0},
+		{"fin", false, FIN | ACK, "abc", RST, 500, 0},
+		{"receiver data", true, PSH | ACK, "abc", RST | ACK, 103, 500},
+		{"receiver syn", true, SYN, "", RST | ACK, 101, 500},
+		{"receiver fin", true, FIN | ACK, "", RST | ACK, 101, 500},
+	} {
+		for _, ap := range [][2]netip.AddrPort{{testSrc4, testDst4}, {testSrc6, testDst6}} {
+			b := testPacket(iana.ProtocolTCP, ap[0], ap[1], tt.flags, 100, []byte(tt.payload))
+			s, _ := parseTCPSegment(b)
+			binary.BigEndian.PutUint32(b[s.off+8:], 500)
+
+			addr := &Address{}
+			addr.SetOutbound()
+			build, tuple := RejectTCP, s.tuple.Reverse()
+			if tt.receiver {
+				build, tuple = resetReceiver, s.tuple
+			}
+			p, ra, err := build(b, addr)
+			if err != nil {
+				t.Errorf("%s %v: %v", tt.name, ap[0].Addr(), err)
+				continue
+			}
+
+			r, err := parseTCPSegment(p)
+			if err != nil || r.tuple != tuple {
+				t.Errorf("%s %v: tuple = %v, %v, want %v", tt.name, ap[0].Addr(), r.tuple, err, tuple)
+			}
+			if r.flags != tt.want || r.seq != tt.seq || r.ack != tt.ack {
+				t.Errorf("%s %v: flags %#x seq %d ack %d, want %#x %d %d", tt.name, ap[0].Addr(), r.flags, r.seq, r.ack, tt.want, tt.seq, tt.ack)
+			}
+			if checksumFold(checksumAdd(pseudoHeaderSum(p, r.off, iana.ProtocolTCP), p[r.off:])) != 0 {
+				t.Errorf("%s %v: invalid TCP checksum", tt.name, ap[0].Addr())
+			}
+			if ra.Outbound() != tt.receiver || !ra.IPChecksum() || !ra.TCPChecksum() {
+				t.Errorf("%s %v: address %+v", tt.name, ap[0].Addr(), ra)
+			}
+		}
+	}
+}
+
+func TestRejectTCPInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		b    []byte
+	}{
+		{"rst", testPacket(iana.ProtocolTCP, testSrc4, testDst4, RST, 100, nil)},
+		{"udp", testPacket(iana.ProtocolUDP, testSrc4, testDst4, 0, 0, nil)},
+		{"truncated", testPacket(iana.ProtocolTCP, testSrc4, testDst4, ACK, 100, nil)[:30]},
+	} {
+		if _, _, err := RejectTCP(tt.b, &Address{}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestTupleFilter(t *testing.T) {
+	for _, tt := range []struct {
+		src, dst string
+		want     string
+	}{
+		{"10.0.0.1:40000", "1.1.1.1:443", "tcp and ((ip.SrcAddr == 10.0.0.1 and ip.DstAddr == 1.1.1.1 and tcp.SrcPort == 40000 and tcp.DstPort == 443) or (ip.SrcAddr == 1.1.1.1 and ip.DstAddr == 10.0.0.1 and tcp.SrcPort == 443 and tcp.DstPort == 40000))"},
+		{"[::ffff:10.0.0.1]:40000", "[::ffff:1.1.1.1]:443", "tcp and ((ip.SrcAddr == 10.0.0.1 and ip.DstAddr == 1.1.1.1 and tcp.SrcPort == 40000 and tcp.DstPort == 443) or (ip.SrcAddr == 1.1.1.1 and ip.DstAddr == 10.0.0.1 and tcp.SrcPort == 443 and tcp.DstPort == 40000))"},
+		{"[2001:db8::1]:40000", "[2001:db8::2]:443", "tcp and ((ipv6.SrcAddr == 2001:db8::1 and ipv6.DstAddr == 2001:db8::2 and tcp.SrcPort == 40000 and tcp.DstPort == 443) or (ipv6.SrcAddr == 2001:db8::2 and ipv6.DstAddr == 2001:db8::1 and tcp.SrcPort == 443 and tcp.DstPort == 40000))"},
+	} {
+		s, d := netip.MustParseAddrPort(tt.src), netip.MustParseAddrPort(tt.dst)
+		tu := FiveTuple{Protocol: iana.ProtocolTCP, SrcAddr: s.Addr(), DstAddr: d.Addr(), SrcPort: s.Port(), DstPort: d.Port()}
+		if got := tupleFilter(tu); got != tt.want {
+			t.Errorf("%s > %s: filter = %s", tt.src, tt.dst, got)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package windivert
+
+import "errors"
+
+// notifyRouteChange calls fn on every change of the routing table
+func notifyRouteChange(fn func()) (cancel func() error, err error) {
+	return nil, errors.New("route change notifications are only supported on windows")
+}
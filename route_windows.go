@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package windivert
+
+import "github.com/sbilly/go-windivert2/internal/utils"
+
+// notifyRouteChange calls fn on every change of the routing table
+func notifyRouteChange(fn func()) (cancel func() error, err error) {
+	return utils.NotifyRouteChange(fn)
+}
@@ -0,0 +1,522 @@
+package windivert
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TimeSource tells the time to a Shaper
+type TimeSource interface {
+	Now() time.Time
+}
+
+type systemTime struct{}
+
+func (systemTime) Now() time.Time {
+	return time.Now()
+}
+
+// VirtualTime is a TimeSource moved by hand, for deterministic tests
+type VirtualTime struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewVirtualTime creates a virtual time starting at t
+func NewVirtualTime(t time.Time) *VirtualTime {
+	return &VirtualTime{now: t}
+}
+
+func (v *VirtualTime) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+// Advance moves the time forward by d
+func (v *VirtualTime) Advance(d time.Duration) {
+	v.mu.Lock()
+	v.now = v.now.Add(d)
+	v.mu.Unlock()
+}
+
+// TokenBucket limits a rate in bytes per second, allowing bursts of up to
+// Burst bytes. A packet larger than the burst passes when the bucket is
+// full and leaves it in debt.
+type TokenBucket struct {
+	Rate  float64
+	Burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket. A burst of zero is a tenth of a
+// second of traffic, at least MTUDefault bytes.
+func NewTokenBucket(rate float64, burst int, now time.Time) *TokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate / 10
+		if b < MTUDefault {
+			b = MTUDefault
+		}
+	}
+	return &TokenBucket{Rate: rate, Burst: b, tokens: b, last: now}
+}
+
+func (b *TokenBucket) fill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+		b.last = now
+	}
+}
+
+func (b *TokenBucket) need(n int) float64 {
+	if float64(n) > b.Burst {
+		return b.Burst
+	}
+	return float64(n)
+}
+
+// Ready reports whether n bytes may pass at now
+func (b *TokenBucket) Ready(n int, now time.Time) bool {
+	b.fill(now)
+	return b.tokens >= b.need(n)
+}
+
+// Take removes n bytes worth of tokens
+func (b *TokenBucket) Take(n int, now time.Time) {
+	b.fill(now)
+	b.tokens -= float64(n)
+}
+
+// Wait returns how long until n bytes may pass, rounded up so the bytes
+// may pass once it has elapsed
+func (b *TokenBucket) Wait(n int, now time.Time) time.Duration {
+	b.fill(now)
+	missing := b.need(n) - b.tokens
+	if missing <= 0 {
+		return 0
+	}
+	if b.Rate <= 0 {
+		return time.Duration(1<<63 - 1)
+	}
+	w := time.Duration(math.Ceil(missing / b.Rate * float64(time.Second)))
+	if w < 1 {
+		w = 1
+	}
+	return w
+}
+
+// ShapeMode is what is done with packets over the limit of a class
+type ShapeMode uint8
+
+const (
+	// ShapeDelay queues packets until the class has tokens for them
+	ShapeDelay ShapeMode = iota
+	// ShapeDrop drops packets over the limit, it polices the class
+	ShapeDrop
+)
+
+// ShapeResult is what a Shaper did with a packet
+type ShapeResult uint8
+
+const (
+	// ShapePass lets the packet go at once
+	ShapePass ShapeResult = iota
+	// ShapeQueued keeps the packet until it may be sent
+	ShapeQueued
+	// ShapeDropped drops the packet
+	ShapeDropped
+)
+
+func (r ShapeResult) String() string {
+	switch r {
+	case ShapePass:
+		return "pass"
+	case ShapeQueued:
+		return "queued"
+	case ShapeDropped:
+		return "dropped"
+	default:
+		return ""
+	}
+}
+
+// ShapeQueueLimitDefault bounds the packets queued in a class
+const ShapeQueueLimitDefault = 1024
+
+// ShapeClass is a class of traffic sharing a token bucket
+type ShapeClass struct {
+	Name string
+	// Rate is the limit of the class in bytes per second, zero means no
+	// limit of its own
+	Rate  float64
+	Burst int
+	// Priority orders the classes competing for the link, lower values
+	// are served first
+	Priority int
+	// Weight is the share of the link among classes of the same priority,
+	// zero means one
+	Weight int
+	Mode   ShapeMode
+	// QueueLimit bounds the packets queued, zero means
+	// ShapeQueueLimitDefault
+	QueueLimit int
+	// MaxDelay drops packets queued for longer, zero means no bound
+	MaxDelay time.Duration
+}
+
+// ShapedPacket is a packet held by a Shaper
+type ShapedPacket struct {
+	Packet  []byte
+	Address Address
+	Class   string
+	// Flow is the connection of the packet, the packets of a class are
+	// served flow by flow
+	Flow FiveTuple
+
+	queued time.Time
+	// kind is where the device sends the packet
+	kind shapeKind
+}
+
+// ShapeStats are the counters of a class
+type ShapeStats struct {
+	Name    string
+	Queued  int
+	Sent    Counters
+	Dropped Counters
+}
+
+type shapeFlow struct {
+	key    FiveTuple
+	q      []*ShapedPacket
+	served float64
+}
+
+type shapeClass struct {
+	ShapeClass
+	bucket  *TokenBucket
+	flows   map[FiveTuple]*shapeFlow
+	vtime   float64
+	served  float64
+	queued  int
+	sent    Counters
+	dropped Counters
+}
+
+// Shaper queues packets per class with token buckets. Classes of a lower
+// priority value are served first, classes of the same priority share the
+// link by weight and the flows of a class share it equally, as in start
+// time fair queuing.
+type Shaper struct {
+	// Classify returns the class of a packet, packets of unknown classes
+	// are only limited by the link
+	Classify func(c *PolicyContext) string
+
+	time    TimeSource
+	mu      sync.Mutex
+	link    *TokenBucket
+	classes map[string]*shapeClass
+	levels  []int
+	vtimes  map[int]float64
+	queued  int
+	wake    chan struct{}
+}
+
+// NewShaper creates a shaper limiting the link to rate bytes per second,
+// zero means no limit. ts may be nil for the system time.
+func NewShaper(ts TimeSource, rate float64, burst int, classes ...ShapeClass) *Shaper {
+	if ts == nil {
+		ts = systemTime{}
+	}
+	s := &Shaper{
+		time:    ts,
+		classes: make(map[string]*shapeClass),
+		vtimes:  make(map[int]float64),
+		wake:    make(chan struct{}, 1),
+	}
+	if rate > 0 {
+		s.link = NewTokenBucket(rate, burst, ts.Now())
+	}
+	// packets of unknown classes
+	s.add(ShapeClass{})
+	for _, c := range classes {
+		s.add(c)
+	}
+	return s
+}
+
+func (s *Shaper) add(c ShapeClass) {
+	if c.Weight <= 0 {
+		c.Weight = 1
+	}
+	if c.QueueLimit <= 0 {
+		c.QueueLimit = ShapeQueueLimitDefault
+	}
+
+	sc := &shapeClass{ShapeClass: c, flows: make(map[FiveTuple]*shapeFlow)}
+	if c.Rate > 0 {
+		sc.bucket = NewTokenBucket(c.Rate, c.Burst, s.time.Now())
+	}
+	if _, ok := s.classes[c.Name]; !ok {
+		s.levels = append(s.levels, c.Priority)
+		sort.Ints(s.levels)
+	}
+	s.classes[c.Name] = sc
+}
+
+// Shape classifies the packet of c and enqueues it
+func (s *Shaper) Shape(c *PolicyContext) ShapeResult {
+	return s.shape(c, shapeInject)
+}
+
+func (s *Shaper) shape(c *PolicyContext, kind shapeKind) ShapeResult {
+	p := &ShapedPacket{Packet: c.Packet, Flow: c.Tuple, kind: kind}
+	if c.Address != nil {
+		p.Address = *c.Address
+	}
+	if s.Classify != nil {
+		p.Class = s.Classify(c)
+	}
+
+	return s.Enqueue(p)
+}
+
+// Enqueue takes a packet. The packet passes at once when nothing is queued
+// and its class and the link have tokens for it, otherwise it is queued or
+// dropped as its class says. Queued packets are copied and returned by
+// Dequeue.
+func (s *Shaper) Enqueue(p *ShapedPacket) ShapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.classes[p.Class]
+	if !ok {
+		c = s.classes[""]
+	}
+	now := s.time.Now()
+	n := len(p.Packet)
+
+	if c.queued == 0 && s.ready(c, n, now) && (s.link == nil || !s.busy(c.Priority)) {
+		s.take(c, n, now)
+		return ShapePass
+	}
+	if c.Mode == ShapeDrop || c.queued >= c.QueueLimit {
+		c.dropped.Packets++
+		c.dropped.Bytes += uint64(n)
+		return ShapeDropped
+	}
+
+	f, ok := c.flows[p.Flow]
+	if !ok {
+		f = &shapeFlow{key: p.Flow, served: c.vtime}
+		c.flows[p.Flow] = f
+	}
+	if c.queued == 0 && c.served < s.vtimes[c.Priority] {
+		c.served = s.vtimes[c.Priority]
+	}
+
+	p.Packet = append([]byte(nil), p.Packet...)
+	p.queued = now
+	f.q = append(f.q, p)
+	c.queued++
+	s.queued++
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return ShapeQueued
+}
+
+// busy reports whether classes of a priority up to prio have packets
+// queued, which go first
+func (s *Shaper) busy(prio int) bool {
+	if s.queued == 0 {
+		return false
+	}
+	for _, c := range s.classes {
+		if c.queued > 0 && c.Priority <= prio {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Shaper) ready(c *shapeClass, n int, now time.Time) bool {
+	return (c.bucket == nil || c.bucket.Ready(n, now)) && (s.link == nil || s.link.Ready(n, now))
+}
+
+func (s *Shaper) take(c *shapeClass, n int, now time.Time) {
+	if c.bucket != nil {
+		c.bucket.Take(n, now)
+	}
+	if s.link != nil {
+		s.link.Take(n, now)
+	}
+	c.sent.Packets++
+	c.sent.Bytes += uint64(n)
+}
+
+// Dequeue returns the next packet that may be sent. When none may be sent
+// yet it returns how long until one may, or zero when none is queued.
+func (s *Shaper) Dequeue() (*ShapedPacket, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.time.Now()
+	var wait time.Duration
+
+	for i, prio := range s.levels {
+		if i > 0 && prio == s.levels[i-1] {
+			continue
+		}
+
+		var best *shapeClass
+		for _, c := range s.classes {
+			if c.Priority != prio || c.queued == 0 {
+				continue
+			}
+			f := s.expire(c, now)
+			if f == nil {
+				continue
+			}
+
+			n := len(f.q[0].Packet)
+			if c.bucket != nil && !c.bucket.Ready(n, now) {
+				if w := c.bucket.Wait(n, now); wait == 0 || w < wait {
+					wait = w
+				}
+				continue
+			}
+			if best == nil || c.served < best.served || c.served == best.served && c.Name < best.Name {
+				best = c
+			}
+		}
+		if best == nil {
+			continue
+		}
+
+		f := s.next(best)
+		p := f.q[0]
+		n := len(p.Packet)
+		// lower priorities must not take the link from this one
+		if s.link != nil && !s.link.Ready(n, now) {
+			return nil, s.link.Wait(n, now)
+		}
+
+		f.q[0] = nil
+		f.q = f.q[1:]
+		if len(f.q) == 0 {
+			delete(best.flows, f.key)
+		}
+		best.queued--
+		s.queued--
+
+		best.vtime = f.served
+		f.served += float64(n)
+		s.vtimes[prio] = best.served
+		best.served += float64(n) / float64(best.Weight)
+
+		s.take(best, n, now)
+		return p, 0
+	}
+	return nil, wait
+}
+
+// expire drops the packets of c queued for longer than MaxDelay and returns
+// the flow served next, nil when c has no packets left
+func (s *Shaper) expire(c *shapeClass, now time.Time) *shapeFlow {
+	for c.queued > 0 {
+		f := s.next(c)
+		p := f.q[0]
+		if c.MaxDelay <= 0 || now.Sub(p.queued) <= c.MaxDelay {
+			return f
+		}
+
+		f.q[0] = nil
+		f.q = f.q[1:]
+		if len(f.q) == 0 {
+			delete(c.flows, f.key)
+		}
+		c.queued--
+		s.queued--
+		c.dropped.Packets++
+		c.dropped.Bytes += uint64(len(p.Packet))
+	}
+	return nil
+}
+
+// next returns the flow of c served the least
+func (s *Shaper) next(c *shapeClass) *shapeFlow {
+	var best *shapeFlow
+	for _, f := range c.flows {
+		if best == nil || f.served < best.served || f.served == best.served && f.q[0].queued.Before(best.q[0].queued) {
+			best = f
+		}
+	}
+	return best
+}
+
+// Len returns the number of packets queued
+func (s *Shaper) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued
+}
+
+// Stats returns the counters of the classes, sorted by name
+func (s *Shaper) Stats() []ShapeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := make([]ShapeStats, 0, len(s.classes))
+	for _, c := range s.classes {
+		st = append(st, ShapeStats{Name: c.Name, Queued: c.queued, Sent: c.sent, Dropped: c.dropped})
+	}
+	sort.Slice(st, func(i, j int) bool { return st[i].Name < st[j].Name })
+	return st
+}
+
+// Run passes the queued packets to send as they may be sent until ctx is
+// done. It sleeps on the system timer, tests on a VirtualTime call Dequeue
+// instead.
+func (s *Shaper) Run(ctx context.Context, send func(p *ShapedPacket)) {
+	t := time.NewTimer(time.Hour)
+	defer t.Stop()
+
+	for {
+		p, wait := s.Dequeue()
+		if p != nil {
+			send(p)
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+			t.Reset(wait)
+			timeout = t.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.wake:
+		case <-timeout:
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package windivert
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketWait(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := NewTokenBucket(3, 10, now)
+	b.Take(10, now)
+
+	w := b.Wait(1, now)
+	if w != 333333334 {
+		t.Errorf("Wait = %v", w)
+	}
+	if b.Ready(1, now.Add(w-1)) || !b.Ready(1, now.Add(w)) {
+		t.Error("not ready once the wait elapsed")
+	}
+
+	// a wait shorter than a nanosecond is not zero
+	b = NewTokenBucket(1e12, 10, now)
+	b.Take(10, now)
+	b.tokens = 0.9999
+	if w := b.Wait(1, now); w != 1 {
+		t.Errorf("Wait = %v, want 1ns", w)
+	}
+}
+
+func TestShaperDelay(t *testing.T) {
+	vt := NewVirtualTime(time.Unix(1000, 0))
+	s := NewShaper(vt, 0, 0,
+		ShapeClass{Name: "bulk", Rate: 1000, Burst: 1000},
+		ShapeClass{Name: "police", Rate: 1000, Burst: 1000, Mode: ShapeDrop},
+		ShapeClass{Name: "slow", Rate: 1000, Burst: 1000, MaxDelay: time.Second},
+	)
+
+	for _, tt := range []struct {
+		class string
+		n     int
+		want  ShapeResult
+	}{
+		{"bulk", 600, ShapePass},
+		{"bulk", 600, ShapeQueued},
+		{"police", 600, ShapePass},
+		{"police", 600, ShapeDropped},
+		{"slow", 1000, ShapePass},
+		{"slow", 1000, ShapeQueued},
+		{"slow", 1000, ShapeQueued},
+	} {
+		if r := s.Enqueue(&ShapedPacket{Packet: testPayload(tt.n), Class: tt.class}); r != tt.want {
+			t.Errorf("%s %d: Enqueue = %v, want %v", tt.class, tt.n, r, tt.want)
+		}
+	}
+
+	if p, wait := s.Dequeue(); p != nil || wait != 200*time.Millisecond {
+		t.Fatalf("Dequeue = %v, %v", p, wait)
+	}
+	vt.Advance(199 * time.Millisecond)
+	if p, _ := s.Dequeue(); p != nil {
+		t.Fatal("dequeued before the wait elapsed")
+	}
+	vt.Advance(time.Millisecond)
+	if p, _ := s.Dequeue(); p == nil || p.Class != "bulk" {
+		t.Fatalf("Dequeue = %+v", p)
+	}
+
+	// the first slow packet goes at 1s, the second is then held too long
+	vt.Advance(800 * time.Millisecond)
+	if p, _ := s.Dequeue(); p == nil || p.Class != "slow" {
+		t.Fatalf("Dequeue = %+v", p)
+	}
+	vt.Advance(time.Second + time.Millisecond)
+	if p, wait := s.Dequeue(); p != nil || wait != 0 || s.Len() != 0 {
+		t.Errorf("Dequeue = %+v, %v, Len() = %d", p, wait, s.Len())
+	}
+
+	want := []ShapeStats{
+		{Name: ""},
+		{Name: "bulk", Sent: Counters{2, 1200}},
+		{Name: "police", Sent: Counters{1, 600}, Dropped: Counters{1, 600}},
+		{Name: "slow", Sent: Counters{2, 2000}, Dropped: Counters{1, 1000}},
+	}
+	st := s.Stats()
+	if len(st) != len(want) {
+		t.Fatalf("Stats() = %+v", st)
+	}
+	for i := range st {
+		if st[i] != want[i] {
+			t.Errorf("Stats()[%d] = %+v, want %+v", i, st[i], want[i])
+		}
+	}
+}
+
+func TestShaperPriority(t *testing.T) {
+	vt := NewVirtualTime(time.Unix(1000, 0))
+	s := NewShaper(vt, 1000, 1000,
+		ShapeClass{Name: "hi", Priority: 0},
+		ShapeClass{Name: "lo", Priority: 1},
+	)
+
+	s.Enqueue(&ShapedPacket{Packet: testPayload(1000), Class: "lo"})
+	s.Enqueue(&ShapedPacket{Packet: testPayload(500), Class: "lo"})
+	if r := s.Enqueue(&ShapedPacket{Packet: testPayload(500), Class: "hi"}); r != ShapeQueued {
+		t.Fatalf("Enqueue = %v", r)
+	}
+
+	vt.Advance(500 * time.Millisecond)
+	if p, _ := s.Dequeue(); p == nil || p.Class != "hi" {
+		t.Fatalf("Dequeue = %+v", p)
+	}
+	if p, wait := s.Dequeue(); p != nil || wait != 500*time.Millisecond {
+		t.Fatalf("Dequeue = %+v, %v", p, wait)
+	}
+	vt.Advance(500 * time.Millisecond)
+	if p, _ := s.Dequeue(); p == nil || p.Class != "lo" {
+		t.Fatalf("Dequeue = %+v", p)
+	}
+}
+
+func TestDeviceShape(t *testing.T) {
+	vt := NewVirtualTime(time.Unix(1000, 0))
+	s := NewShaper(vt, 100, 100)
+	d := &Device{Flows: NewFlowTracker(&countingFlowSource{}), Conns: NewConnTrack()}
+	d.shaper.Store(s)
+
+	p := testPacket(6, testDst4, testSrc4, ACK, 1, testPayload(60))
+	var a Address
+	if r := d.shape(p, &a, shapeDivert); r != ShapePass {
+		t.Fatalf("shape = %v", r)
+	}
+	if r := d.shape(p, &a, shapeDivert); r != ShapeQueued {
+		t.Fatalf("shape = %v", r)
+	}
+
+	vt.Advance(time.Second)
+	sp, _ := s.Dequeue()
+	if sp == nil {
+		t.Fatal("nothing dequeued")
+	}
+	if err := d.sendShaped(sp); err == nil {
+		t.Error("diverted packet sent without a writer")
+	}
+
+	var w bytes.Buffer
+	d.out = &w
+	if err := d.sendShaped(sp); err != nil || !bytes.Equal(w.Bytes(), p) {
+		t.Errorf("sendShaped = %v, wrote %d bytes", err, w.Len())
+	}
+}
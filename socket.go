@@ -0,0 +1,210 @@
+package windivert
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// ErrNotSocketEvent is returned for an address that is not a socket event
+var ErrNotSocketEvent = errors.New("not a socket layer event")
+
+// SocketInfo holds the fields shared by all socket events
+type SocketInfo struct {
+	PID              uint32
+	EndpointID       uint64
+	ParentEndpointID uint64
+	Protocol         uint8
+	Loopback         bool
+	Timestamp        int64
+	// Process is the process owning the socket, nil when it is not known
+	// or has exited
+	Process *ProcessInfo
+}
+
+// Info returns the shared fields of the event
+func (i SocketInfo) Info() SocketInfo {
+	return i
+}
+
+// SocketEvent is one of SocketBind, SocketConnect, SocketListen,
+// SocketAccept and SocketClose
+type SocketEvent interface {
+	Event() Event
+	Info() SocketInfo
+}
+
+// SocketBind is reported when a socket is bound to Local
+type SocketBind struct {
+	SocketInfo
+	Local netip.AddrPort
+}
+
+func (SocketBind) Event() Event { return EventSocketBind }
+
+// SocketConnect is reported when a socket connects from Local to Remote
+type SocketConnect struct {
+	SocketInfo
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+}
+
+func (SocketConnect) Event() Event { return EventSocketConnect }
+
+// SocketListen is reported when a socket listens on Local
+type SocketListen struct {
+	SocketInfo
+	Local netip.AddrPort
+}
+
+func (SocketListen) Event() Event { return EventSocketListen }
+
+// SocketAccept is reported when a connection from Remote is accepted on
+// Local
+type SocketAccept struct {
+	SocketInfo
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+}
+
+func (SocketAccept) Event() Event { return EventSocketAccept }
+
+// SocketClose is reported when a socket is closed
+type SocketClose struct {
+	SocketInfo
+	Local  netip.AddrPort
+	Remote netip.AddrPort
+}
+
+func (SocketClose) Event() Event { return EventSocketClose }
+
+// ParseSocketEvent converts a socket layer address to a typed event. The
+// process owning the socket is looked up with r when it is not nil.
+func ParseSocketEvent(addr *Address, r ProcessResolver) (SocketEvent, error) {
+	if addr.Layer() != LayerSocket {
+		return nil, ErrNotSocketEvent
+	}
+
+	s := addr.Socket()
+	info := SocketInfo{
+		PID:              s.ProcessID,
+		EndpointID:       s.EndpointID,
+		ParentEndpointID: s.ParentEndpointID,
+		Protocol:         s.Protocol,
+		Loopback:         addr.Loopback(),
+		Timestamp:        addr.Timestamp,
+	}
+	if r != nil {
+		info.Process = socketProcess(r, s.ProcessID, addr.Time())
+	}
+	local, _ := addr.LocalAddrPort()
+	remote, _ := addr.RemoteAddrPort()
+
+	switch addr.Event() {
+	case EventSocketBind:
+		return SocketBind{SocketInfo: info, Local: local}, nil
+	case EventSocketConnect:
+		return SocketConnect{SocketInfo: info, Local: local, Remote: remote}, nil
+	case EventSocketListen:
+		return SocketListen{SocketInfo: info, Local: local}, nil
+	case EventSocketAccept:
+		return SocketAccept{SocketInfo: info, Local: local, Remote: remote}, nil
+	case EventSocketClose:
+		return SocketClose{SocketInfo: info, Local: local, Remote: remote}, nil
+	default:
+		return nil, ErrNotSocketEvent
+	}
+}
+
+// socketProcess returns the process pid if it was running at time at. A
+// process started later reuses the PID of the owner of the socket, which has
+// exited since.
+func socketProcess(r ProcessResolver, pid uint32, at time.Time) *ProcessInfo {
+	p, err := r.Process(pid)
+	if err != nil || p.StartTime.After(at) {
+		return nil
+	}
+	return &p
+}
+
+// SocketMonitor reads the events of a socket layer handle
+type SocketMonitor struct {
+	// Processes finds the processes owning the sockets, it may be nil. It
+	// is a cache in front of SystemProcessResolver by default.
+	Processes ProcessResolver
+
+	hd    *Handle
+	sniff bool
+	b     [][]byte
+	a     []Address
+}
+
+// NewSocketMonitor opens a socket layer handle reporting the events
+// matching filter without affecting them
+func NewSocketMonitor(filter string) (*SocketMonitor, error) {
+	return openSocketMonitor(filter, FlagSniff|FlagRecvOnly)
+}
+
+// BlockSockets opens a socket layer handle that blocks the operations
+// matching filter. The blocked operations are reported by Recv. WinDivert
+// takes no verdict from user space at the socket layer, the filter is the
+// verdict.
+func BlockSockets(filter string) (*SocketMonitor, error) {
+	return openSocketMonitor(filter, FlagRecvOnly)
+}
+
+// BlockConnect blocks the connect attempts matching filter
+func BlockConnect(filter string) (*SocketMonitor, error) {
+	return BlockSockets(fmt.Sprintf("event == CONNECT and (%s)", filter))
+}
+
+func openSocketMonitor(filter string, flags uint64) (*SocketMonitor, error) {
+	hd, err := Open(filter, LayerSocket, PriorityDefault, flags)
+	if err != nil {
+		return nil, fmt.Errorf("open socket handle error: %v", err)
+	}
+
+	m := &SocketMonitor{
+		Processes: NewProcessCache(SystemProcessResolver()),
+		hd:        hd,
+		sniff:     flags&FlagSniff == FlagSniff,
+		// socket events carry no packet, the buffer only has to be non empty
+		b: [][]byte{make([]byte, 1)},
+		a: make([]Address, 1),
+	}
+	return m, nil
+}
+
+// Blocking reports whether the operations reported are blocked
+func (m *SocketMonitor) Blocking() bool {
+	return !m.sniff
+}
+
+// Recv waits for the next event
+func (m *SocketMonitor) Recv() (SocketEvent, error) {
+	for {
+		if _, _, err := m.hd.RecvEx(m.b, m.a, 0); err != nil {
+			return nil, err
+		}
+
+		ev, err := ParseSocketEvent(&m.a[0], m.Processes)
+		if err == ErrNotSocketEvent {
+			continue
+		}
+		return ev, err
+	}
+}
+
+// Close shuts down and closes the handle
+func (m *SocketMonitor) Close() error {
+	if err := m.hd.Shutdown(ShutdownBoth); err != nil {
+		return fmt.Errorf("shutdown handle error: %v", err)
+	}
+
+	if err := m.hd.Close(); err != nil {
+		return fmt.Errorf("close handle error: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package windivert
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseSocketEvent(t *testing.T) {
+	local4, remote4 := netip.MustParseAddrPort("10.0.0.1:40000"), netip.MustParseAddrPort("93.184.216.34:443")
+	local6, remote6 := netip.MustParseAddrPort("[2001:db8::1]:40000"), netip.MustParseAddrPort("[2001:db8::2]:443")
+	info := SocketInfo{PID: 42, EndpointID: 7, ParentEndpointID: 3, Protocol: 6, Timestamp: 12345}
+
+	for _, tt := range []struct {
+		name          string
+		event         Event
+		local, remote netip.AddrPort
+		want          SocketEvent
+	}{
+		{"bind", EventSocketBind, local4, netip.AddrPort{}, SocketBind{SocketInfo: info, Local: local4}},
+		{"bind v6", EventSocketBind, local6, netip.AddrPort{}, SocketBind{SocketInfo: info, Local: local6}},
+		{"connect", EventSocketConnect, local4, remote4, SocketConnect{SocketInfo: info, Local: local4, Remote: remote4}},
+		{"connect v6", EventSocketConnect, local6, remote6, SocketConnect{SocketInfo: info, Local: local6, Remote: remote6}},
+		{"listen", EventSocketListen, local4, netip.AddrPort{}, SocketListen{SocketInfo: info, Local: local4}},
+		{"listen v6", EventSocketListen, local6, netip.AddrPort{}, SocketListen{SocketInfo: info, Local: local6}},
+		{"accept", EventSocketAccept, local4, remote4, SocketAccept{SocketInfo: info, Local: local4, Remote: remote4}},
+		{"accept v6", EventSocketAccept, local6, remote6, SocketAccept{SocketInfo: info, Local: local6, Remote: remote6}},
+		{"close", EventSocketClose, local4, remote4, SocketClose{SocketInfo: info, Local: local4, Remote: remote4}},
+		{"close v6", EventSocketClose, local6, remote6, SocketClose{SocketInfo: info, Local: local6, Remote: remote6}},
+	} {
+		addr := &Address{Timestamp: 12345}
+		addr.SetLayer(LayerSocket)
+		addr.SetEvent(tt.event)
+		if tt.local.Addr().Is6() {
+			addr.SetIPv6()
+		}
+		s := addr.Socket()
+		s.ProcessID, s.EndpointID, s.ParentEndpointID, s.Protocol = 42, 7, 3, 6
+		s.SetLocalAddrPort(tt.local)
+		if tt.remote.IsValid() {
+			s.SetRemoteAddrPort(tt.remote)
+		}
+
+		ev, err := ParseSocketEvent(addr, nil)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if ev != tt.want || ev.Event() != tt.event {
+			t.Errorf("%s: event = %+v", tt.name, ev)
+		}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		layer Layer
+		event Event
+	}{
+		{"network layer", LayerNetwork, EventNetworkPacket},
+		{"flow layer", LayerFlow, EventFlowEstablished},
+		{"unknown event", LayerSocket, EventNetworkPacket},
+	} {
+		addr := &Address{}
+		addr.SetLayer(tt.layer)
+		addr.SetEvent(tt.event)
+		if _, err := ParseSocketEvent(addr, nil); err != ErrNotSocketEvent {
+			t.Errorf("%s: err = %v, want ErrNotSocketEvent", tt.name, err)
+		}
+	}
+}
+
+func TestParseSocketEventProcess(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer SetDefaultClock(DefaultClock())
+	SetDefaultClock(NewClock(&FixedClockSource{Freq: 1, Time: t0}))
+
+	r := NewFakeProcessResolver(
+		ProcessInfo{PID: 10, Name: "app.exe", StartTime: t0},
+		// started after the event, the PID of the owner was reused
+		ProcessInfo{PID: 11, Name: "new.exe", StartTime: t0.Add(time.Hour)},
+	)
+
+	for _, tt := range []struct {
+		pid  uint32
+		want string
+	}{
+		{10, "app.exe"},
+		{11, ""},
+		{12, ""},
+	} {
+		addr := &Address{Timestamp: 60}
+		addr.SetLayer(LayerSocket)
+		addr.SetEvent(EventSocketConnect)
+		addr.Socket().ProcessID = tt.pid
+
+		ev, err := ParseSocketEvent(addr, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ""
+		if p := ev.Info().Process; p != nil {
+			name = p.Name
+		}
+		if name != tt.want {
+			t.Errorf("pid %d: process = %q, want %q", tt.pid, name, tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package windivert
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// StatsKey is the protocol class and direction counters are kept for. The
+// protocol is one of "tcp", "udp", "icmp" and "other", the direction
+// "inbound" or "outbound".
+type StatsKey struct {
+	Protocol  string
+	Direction string
+}
+
+// Counters count packets and their bytes
+type Counters struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// TrafficStats are the counters of a protocol class and direction
+type TrafficStats struct {
+	// Received are the packets read from the handle
+	Received Counters
+	// Diverted are the packets written to the reader
+	Diverted Counters
+	// Passed are the packets reinjected unchanged
+	Passed Counters
+	// Dropped are the packets discarded
+	Dropped Counters
+	// Rejected are the packets discarded and answered
+	Rejected Counters
+	// Injected are the packets written to the device and injected
+	Injected Counters
+}
+
+// LatencyHistogram is a histogram of durations
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of the buckets, the last bucket has no
+	// bound
+	Bounds []time.Duration
+	// Counts are the observations in each bucket, one more than Bounds
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// DeviceStats is a snapshot of the counters of a Device
+type DeviceStats struct {
+	Traffic map[StatsKey]TrafficStats
+	// Conns is the number of tracked connections
+	Conns int
+	// WriteQueue is the number of written packets waiting for their batch
+	// to be sent
+	WriteQueue int
+	// Batches and BatchPackets count the batches injected and their packets
+	Batches      uint64
+	BatchPackets uint64
+	// SendErrors counts the batches that could not be sent, once retries
+	// are given up, and SendRetries the SendEx calls retried
+	SendErrors  uint64
+	SendRetries uint64
+	// RecvErrors counts the failed RecvEx calls
+	RecvErrors uint64
+	// AccountDropped counts the packets left out by the accountant falling
+	// behind
+	AccountDropped uint64
+	// PolicyLatency is the time the policy takes to decide
+	PolicyLatency LatencyHistogram
+}
+
+// BatchFill returns the average fill ratio of the injected batches
+func (s *DeviceStats) BatchFill() float64 {
+	if s.Batches == 0 {
+		return 0
+	}
+	return float64(s.BatchPackets) / float64(s.Batches*BatchMax)
+}
+
+const (
+	statTCP = iota
+	statUDP
+	statICMP
+	statOther
+	statProtos
+)
+
+var statProtoNames = [statProtos]string{"tcp", "udp", "icmp", "other"}
+
+const (
+	statReceived = iota
+	statDiverted
+	statPassed
+	statDropped
+	statRejected
+	statInjected
+	statKinds
+)
+
+var statKindNames = [statKinds]string{"received", "diverted", "passed", "dropped", "rejected", "injected"}
+
+// statVerdicts maps verdicts to the kind they are counted as
+var statVerdicts = [...]int{
+	VerdictDivert: statDiverted,
+	VerdictPass:   statPassed,
+	VerdictDrop:   statDropped,
+	VerdictReject: statRejected,
+}
+
+// policyLatencyBounds are the bucket bounds of the policy latency
+var policyLatencyBounds = [...]time.Duration{
+	time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+}
+
+type statCounter struct {
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// deviceStats are the live counters of a Device
+type deviceStats struct {
+	traffic      [statProtos][2][statKinds]statCounter
+	writeQueue   atomic.Int64
+	batches      atomic.Uint64
+	batchPackets atomic.Uint64
+	sendErrors   atomic.Uint64
+	sendRetries  atomic.Uint64
+	recvErrors   atomic.Uint64
+	// accountDropped counts the packets the accountant had no room for
+	accountDropped atomic.Uint64
+	latency        [len(policyLatencyBounds) + 1]atomic.Uint64
+	latencySum     atomic.Int64
+}
+
+// count counts packet b of kind
+func (s *deviceStats) count(kind int, b []byte, outbound bool) {
+	dir := 0
+	if outbound {
+		dir = 1
+	}
+	c := &s.traffic[statProto(b)][dir][kind]
+	c.packets.Add(1)
+	c.bytes.Add(uint64(len(b)))
+}
+
+// verdict counts packet b under verdict v
+func (s *deviceStats) verdict(v Verdict, b []byte, outbound bool) {
+	if int(v) < len(statVerdicts) && v != VerdictNone {
+		s.count(statVerdicts[v], b, outbound)
+	}
+}
+
+// observe records a policy decision taking d
+func (s *deviceStats) observe(d time.Duration) {
+	i := sort.Search(len(policyLatencyBounds), func(i int) bool { return d <= policyLatencyBounds[i] })
+	s.latency[i].Add(1)
+	s.latencySum.Add(int64(d))
+}
+
+func (s *deviceStats) snapshot() DeviceStats {
+	st := DeviceStats{
+		Traffic:        make(map[StatsKey]TrafficStats),
+		WriteQueue:     int(s.writeQueue.Load()),
+		Batches:        s.batches.Load(),
+		BatchPackets:   s.batchPackets.Load(),
+		SendErrors:     s.sendErrors.Load(),
+		SendRetries:    s.sendRetries.Load(),
+		RecvErrors:     s.recvErrors.Load(),
+		AccountDropped: s.accountDropped.Load(),
+		PolicyLatency: LatencyHistogram{
+			Bounds: append([]time.Duration(nil), policyLatencyBounds[:]...),
+			Counts: make([]uint64, len(s.latency)),
+			Sum:    time.Duration(s.latencySum.Load()),
+		},
+	}
+	for i := range s.latency {
+		st.PolicyLatency.Counts[i] = s.latency[i].Load()
+		st.PolicyLatency.Count += st.PolicyLatency.Counts[i]
+	}
+
+	for p := range s.traffic {
+		for dir, name := range [2]string{"inbound", "outbound"} {
+			var cs [statKinds]Counters
+			seen := false
+			for k := range cs {
+				c := &s.traffic[p][dir][k]
+				cs[k] = Counters{Packets: c.packets.Load(), Bytes: c.bytes.Load()}
+				seen = seen || cs[k].Packets != 0
+			}
+			if !seen {
+				continue
+			}
+			st.Traffic[StatsKey{Protocol: statProtoNames[p], Direction: name}] = TrafficStats{
+				Received: cs[statReceived],
+				Diverted: cs[statDiverted],
+				Passed:   cs[statPassed],
+				Dropped:  cs[statDropped],
+				Rejected: cs[statRejected],
+				Injected: cs[statInjected],
+			}
+		}
+	}
+	return st
+}
+
+// statProto returns the protocol class of packet b
+func statProto(b []byte) int {
+	proto := uint8(0)
+	switch {
+	case len(b) >= ipv4.HeaderLen && b[0]>>4 == ipv4.Version:
+		proto = b[9]
+	case len(b) >= ipv6.HeaderLen && b[0]>>4 == ipv6.Version:
+		if e, err := parseIPv6Ext(b); err == nil {
+			proto = e.proto
+		}
+	}
+
+	switch proto {
+	case iana.ProtocolTCP:
+		return statTCP
+	case iana.ProtocolUDP:
+		return statUDP
+	case iana.ProtocolICMP, iana.ProtocolIPv6ICMP:
+		return statICMP
+	default:
+		return statOther
+	}
+}
+
+// WritePrometheus writes the stats in the Prometheus text exposition
+// format
+func (s *DeviceStats) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	keys := make([]StatsKey, 0, len(s.Traffic))
+	for k := range s.Traffic {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Protocol != keys[j].Protocol {
+			return keys[i].Protocol < keys[j].Protocol
+		}
+		return keys[i].Direction < keys[j].Direction
+	})
+
+	for _, m := range []struct {
+		name, help string
+		value      func(Counters) uint64
+	}{
+		{"windivert_packets_total", "Packets handled by the device.", func(c Counters) uint64 { return c.Packets }},
+		{"windivert_bytes_total", "Bytes handled by the device.", func(c Counters) uint64 { return c.Bytes }},
+	} {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, k := range keys {
+			t := s.Traffic[k]
+			for i, c := range [statKinds]Counters{t.Received, t.Diverted, t.Passed, t.Dropped, t.Rejected, t.Injected} {
+				fmt.Fprintf(bw, "%s{action=%q,protocol=%q,direction=%q} %d\n",
+					m.name, statKindNames[i], k.Protocol, k.Direction, m.value(c))
+			}
+		}
+	}
+
+	writeMetric(bw, "windivert_conntrack_entries", "gauge", "Connections tracked.", strconv.Itoa(s.Conns))
+	writeMetric(bw, "windivert_write_queue_length", "gauge", "Written packets waiting to be injected.", strconv.Itoa(s.WriteQueue))
+	writeMetric(bw, "windivert_batches_total", "counter", "Batches injected.", strconv.FormatUint(s.Batches, 10))
+	writeMetric(bw, "windivert_batch_packets_total", "counter", "Packets in the batches injected.", strconv.FormatUint(s.BatchPackets, 10))
+	writeMetric(bw, "windivert_batch_fill_ratio", "gauge", "Average fill ratio of the batches injected.", strconv.FormatFloat(s.BatchFill(), 'g', -1, 64))
+	writeMetric(bw, "windivert_send_errors_total", "counter", "Batches not sent.", strconv.FormatUint(s.SendErrors, 10))
+	writeMetric(bw, "windivert_send_retries_total", "counter", "SendEx calls retried after a transient error.", strconv.FormatUint(s.SendRetries, 10))
+	writeMetric(bw, "windivert_recv_errors_total", "counter", "Failed RecvEx calls, retries included.", strconv.FormatUint(s.RecvErrors, 10))
+	writeMetric(bw, "windivert_account_dropped_total", "counter", "Packets left out by the accountant falling behind.", strconv.FormatUint(s.AccountDropped, 10))
+
+	const h = "windivert_policy_latency_seconds"
+	fmt.Fprintf(bw, "# HELP %s Time taken by the policy to decide.\n# TYPE %s histogram\n", h, h)
+	n := uint64(0)
+	for i, c := range s.PolicyLatency.Counts {
+		n += c
+		le := "+Inf"
+		if i < len(s.PolicyLatency.Bounds) {
+			le = strconv.FormatFloat(s.PolicyLatency.Bounds[i].Seconds(), 'g', -1, 64)
+		}
+		fmt.Fprintf(bw, "%s_bucket{le=%q} %d\n", h, le, n)
+	}
+	fmt.Fprintf(bw, "%s_sum %s\n", h, strconv.FormatFloat(s.PolicyLatency.Sum.Seconds(), 'g', -1, 64))
+	fmt.Fprintf(bw, "%s_count %d\n", h, s.PolicyLatency.Count)
+
+	return bw.Flush()
+}
+
+func writeMetric(w io.Writer, name, typ, help, value string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, value)
+}
+
+// MetricsHandler returns a handler serving the snapshots returned by stats
+// in the Prometheus text exposition format
+func MetricsHandler(stats func() DeviceStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,118 @@
+package windivert
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeviceStats(t *testing.T) {
+	var s deviceStats
+	tcp := testPacket(6, testSrc4, testDst4, ACK, 1, testPayload(60))
+	udp := testPacket(17, testSrc6, testDst6, 0, 0, testPayload(10))
+	icmp := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 1, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 8, 0, 0, 0, 0, 0, 0, 0}
+
+	s.count(statReceived, tcp, true)
+	s.verdict(VerdictDivert, tcp, true)
+	s.count(statReceived, udp, false)
+	s.verdict(VerdictDrop, udp, false)
+	s.verdict(VerdictNone, udp, false)
+	s.count(statInjected, icmp, false)
+	s.observe(3 * time.Microsecond)
+	s.observe(time.Second)
+	s.batches.Add(2)
+	s.batchPackets.Add(BatchMax)
+	s.sendErrors.Add(3)
+	s.sendRetries.Add(5)
+
+	st := s.snapshot()
+	st.Conns = 7
+	for _, tt := range []struct {
+		key  StatsKey
+		want TrafficStats
+	}{
+		{StatsKey{"tcp", "outbound"}, TrafficStats{Received: Counters{1, uint64(len(tcp))}, Diverted: Counters{1, uint64(len(tcp))}}},
+		{StatsKey{"udp", "inbound"}, TrafficStats{Received: Counters{1, uint64(len(udp))}, Dropped: Counters{1, uint64(len(udp))}}},
+		{StatsKey{"icmp", "inbound"}, TrafficStats{Injected: Counters{1, uint64(len(icmp))}}},
+	} {
+		if got := st.Traffic[tt.key]; got != tt.want {
+			t.Errorf("%v = %+v, want %+v", tt.key, got, tt.want)
+		}
+	}
+	if len(st.Traffic) != 3 {
+		t.Errorf("Traffic = %v", st.Traffic)
+	}
+	if st.BatchFill() != 0.5 || st.PolicyLatency.Count != 2 || st.PolicyLatency.Counts[1] != 1 || st.PolicyLatency.Counts[len(policyLatencyBounds)] != 1 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(func() DeviceStats { return st }).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %s", ct)
+	}
+	out := rec.Body.String()
+	for _, line := range []string{
+		"# TYPE windivert_packets_total counter",
+		`windivert_packets_total{action="diverted",protocol="tcp",direction="outbound"} 1`,
+		`windivert_bytes_total{action="dropped",protocol="udp",direction="inbound"} 58`,
+		`windivert_packets_total{action="injected",protocol="icmp",direction="inbound"} 1`,
+		"windivert_conntrack_entries 7",
+		"windivert_batch_fill_ratio 0.5",
+		"windivert_send_errors_total 3",
+		"windivert_send_retries_total 5",
+		`windivert_policy_latency_seconds_bucket{le="5e-06"} 1`,
+		`windivert_policy_latency_seconds_bucket{le="0.05"} 1`,
+		`windivert_policy_latency_seconds_bucket{le="+Inf"} 2`,
+		"windivert_policy_latency_seconds_sum 1.000003",
+		"windivert_policy_latency_seconds_count 2",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// every sample follows its HELP and TYPE lines
+	typed := map[string]bool{}
+	for _, l := range strings.Split(strings.TrimSpace(out), "\n") {
+		if strings.HasPrefix(l, "# TYPE ") {
+			typed[strings.Fields(l)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(l, "#") {
+			continue
+		}
+		name := strings.FieldsFunc(l, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base := strings.TrimSuffix(name, suffix); base != name && typed[base] {
+				name = base
+			}
+		}
+		if !typed[name] {
+			t.Errorf("sample without type: %s", l)
+		}
+	}
+}
+
+func TestDeviceSendStats(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		n       int
+		err     error
+		errors  uint64
+		retries uint64
+	}{
+		{"sent", 0, nil, 0, 0},
+		{"retried", 2, outOfBuffers[0], 0, 2},
+		{"dropped", deviceRetries + 1, outOfBuffers[0], 1, deviceRetries},
+		{"unreachable", 1, ErrHostUnreachable, 1, 0},
+	} {
+		d := newTestDevice()
+		d.send(&failingSender{n: tt.n, err: tt.err}, testPayload(40), make([]Address, 1))
+		if st := d.stats.snapshot(); st.SendErrors != tt.errors || st.SendRetries != tt.retries {
+			t.Errorf("%s: %d send errors, %d retries", tt.name, st.SendErrors, st.SendRetries)
+		}
+		d.Close()
+	}
+}
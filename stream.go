@@ -0,0 +1,364 @@
+package windivert
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+// StreamDirection is the direction of data within a Stream
+type StreamDirection int
+
+const (
+	ClientToServer StreamDirection = 0
+	ServerToClient StreamDirection = 1
+)
+
+func (d StreamDirection) String() string {
+	switch d {
+	case ClientToServer:
+		return "client to server"
+	case ServerToClient:
+		return "server to client"
+	default:
+		return ""
+	}
+}
+
+// StreamCloseReason tells why a Stream was closed
+type StreamCloseReason int
+
+const (
+	StreamFinished StreamCloseReason = 0
+	StreamReset    StreamCloseReason = 1
+	StreamTimeout  StreamCloseReason = 2
+	StreamFlushed  StreamCloseReason = 3
+)
+
+func (r StreamCloseReason) String() string {
+	switch r {
+	case StreamFinished:
+		return "finished"
+	case StreamReset:
+		return "reset"
+	case StreamTimeout:
+		return "timeout"
+	case StreamFlushed:
+		return "flushed"
+	default:
+		return ""
+	}
+}
+
+// StreamHandler receives the reassembled data of TCP connections. The
+// methods are called with the assembler locked and must not call back into
+// it.
+type StreamHandler interface {
+	// StreamOpen is called when a new connection is seen
+	StreamOpen(s *Stream)
+	// StreamData is called with in order payload sent in direction dir. b is
+	// only valid for the duration of the call.
+	StreamData(s *Stream, dir StreamDirection, b []byte)
+	// StreamClose is called once when the connection goes away
+	StreamClose(s *Stream, reason StreamCloseReason)
+}
+
+// Stream is a TCP connection tracked by a StreamAssembler
+type Stream struct {
+	// Tuple is the tuple of the client to server direction
+	Tuple FiveTuple
+	// InterfaceIndex and SubInterfaceIndex are taken from the Address of
+	// the first segment
+	InterfaceIndex    uint32
+	SubInterfaceIndex uint32
+	// Outbound is whether client to server segments are outbound
+	Outbound bool
+	// Start and Last are the Address timestamps of the first and the latest
+	// segment
+	Start int64
+	Last  int64
+	// Skipped counts the bytes given up on because of missing segments
+	Skipped uint64
+	// Context is free for use by the StreamHandler
+	Context interface{}
+
+	half  [2]halfStream
+	seen  time.Time
+	clock *Clock
+}
+
+// StartTime returns Start as wall clock time
+func (s *Stream) StartTime() time.Time {
+	return s.clock.Time(s.Start)
+}
+
+// LastTime returns Last as wall clock time
+func (s *Stream) LastTime() time.Time {
+	return s.clock.Time(s.Last)
+}
+
+// Duration returns the time between the first and the latest segment
+func (s *Stream) Duration() time.Duration {
+	return s.clock.Duration(s.Last - s.Start)
+}
+
+// halfStream is the state of one direction of a Stream
+type halfStream struct {
+	init     bool
+	next     uint32
+	fin      bool
+	finSeq   uint32
+	done     bool
+	pending  []streamSegment
+	buffered int
+}
+
+type streamSegment struct {
+	seq  uint32
+	data []byte
+}
+
+// seqDiff returns a-b taking sequence number wraparound into account
+func seqDiff(a, b uint32) int32 {
+	return int32(a - b)
+}
+
+// StreamMaxBufferedDefault is the default bound on out of order bytes held
+// per direction
+const StreamMaxBufferedDefault = 1 << 20
+
+// StreamAssembler reassembles TCP segments into ordered byte streams
+type StreamAssembler struct {
+	// MaxBuffered bounds the out of order bytes held per direction. When
+	// exceeded the missing data is skipped.
+	MaxBuffered int
+	// Midstream allows picking up connections whose handshake was not seen,
+	// the sender of the first segment is taken as the client
+	Midstream bool
+	// Clock converts the timestamps of streams, DefaultClock is used when
+	// nil
+	Clock *Clock
+
+	mu      sync.Mutex
+	handler StreamHandler
+	streams map[FiveTuple]*Stream
+}
+
+// NewStreamAssembler creates an assembler delivering to h
+func NewStreamAssembler(h StreamHandler) *StreamAssembler {
+	return &StreamAssembler{
+		MaxBuffered: StreamMaxBufferedDefault,
+		handler:     h,
+		streams:     make(map[FiveTuple]*Stream),
+	}
+}
+
+// Len returns the number of tracked streams
+func (a *StreamAssembler) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.streams)
+}
+
+// Assemble feeds a packet received with addr to the assembler. Packets other
+// than TCP are ignored. addr may be nil, the streams then have zero
+// timestamps and interface.
+func (a *StreamAssembler) Assemble(b []byte, addr *Address) error {
+	t, off, err := parseTransport(b)
+	if err != nil {
+		return err
+	}
+	if t.Protocol != iana.ProtocolTCP {
+		return nil
+	}
+	if addr == nil {
+		addr = &Address{}
+	}
+
+	end := ipPacketLen(b)
+	if len(b) < end || end < off+20 {
+		return ErrInvalidPacket
+	}
+	doff := int(b[off+12]>>4) << 2
+	if doff < 20 || off+doff > end {
+		return ErrInvalidPacket
+	}
+
+	flags := b[off+13]
+	seq := uint32(b[off+4])<<24 | uint32(b[off+5])<<16 | uint32(b[off+6])<<8 | uint32(b[off+7])
+	payload := b[off+doff : end]
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	s, dir := a.streams[t], ClientToServer
+	if s == nil {
+		if s = a.streams[t.Reverse()]; s != nil {
+			dir = ServerToClient
+		}
+	}
+
+	if s == nil {
+		switch {
+		case flags&RST == RST:
+			return nil
+		case flags&SYN == SYN && flags&ACK == ACK:
+			dir = ServerToClient
+		case flags&SYN == SYN:
+		case a.Midstream && len(payload) > 0:
+		default:
+			return nil
+		}
+
+		s = &Stream{Tuple: t, Start: addr.Timestamp, clock: a.Clock}
+		if s.clock == nil {
+			s.clock = DefaultClock()
+		}
+		if dir == ServerToClient {
+			s.Tuple = t.Reverse()
+		}
+		nw := addr.Network()
+		s.InterfaceIndex, s.SubInterfaceIndex = nw.InterfaceIndex, nw.SubInterfaceIndex
+		s.Outbound = addr.Outbound() == (dir == ClientToServer)
+
+		a.streams[s.Tuple] = s
+		a.handler.StreamOpen(s)
+	}
+
+	s.Last, s.seen = addr.Timestamp, time.Now()
+
+	if flags&RST == RST {
+		a.close(s, StreamReset)
+		return nil
+	}
+
+	h := &s.half[dir]
+	if flags&SYN == SYN {
+		if h.init {
+			return nil
+		}
+		seq++
+		h.init, h.next = true, seq
+	} else if !h.init {
+		h.init, h.next = true, seq
+	}
+	// nothing follows the FIN
+	if h.done {
+		return nil
+	}
+
+	if flags&FIN == FIN && !h.fin {
+		h.fin, h.finSeq = true, seq+uint32(len(payload))
+	}
+
+	if d := seqDiff(seq, h.next); d > 0 {
+		a.queue(s, dir, h, seq, payload)
+	} else {
+		a.deliver(s, dir, h, seq, payload)
+	}
+	a.drain(s, dir, h)
+
+	if h.fin && !h.done && h.next == h.finSeq {
+		h.done = true
+		h.next++
+	}
+	if s.half[0].done && s.half[1].done {
+		a.close(s, StreamFinished)
+	}
+
+	return nil
+}
+
+// deliver passes the part of data that is not yet seen to the handler
+func (a *StreamAssembler) deliver(s *Stream, dir StreamDirection, h *halfStream, seq uint32, data []byte) {
+	if h.done {
+		return
+	}
+	if d := -seqDiff(seq, h.next); d > 0 {
+		if int(d) >= len(data) {
+			return
+		}
+		data = data[d:]
+	}
+	if h.fin {
+		if n := seqDiff(h.finSeq, h.next); n < int32(len(data)) {
+			if n < 0 {
+				n = 0
+			}
+			data = data[:n]
+		}
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	h.next += uint32(len(data))
+	a.handler.StreamData(s, dir, data)
+}
+
+// queue keeps an out of order segment until the gap before it is filled.
+// When more than MaxBuffered bytes are held the gap is given up on.
+func (a *StreamAssembler) queue(s *Stream, dir StreamDirection, h *halfStream, seq uint32, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	i := sort.Search(len(h.pending), func(i int) bool { return seqDiff(h.pending[i].seq, seq) > 0 })
+	h.pending = append(h.pending, streamSegment{})
+	copy(h.pending[i+1:], h.pending[i:])
+	h.pending[i] = streamSegment{seq: seq, data: append([]byte(nil), data...)}
+	h.buffered += len(data)
+
+	for h.buffered > a.MaxBuffered && len(h.pending) > 0 {
+		if d := seqDiff(h.pending[0].seq, h.next); d > 0 {
+			s.Skipped += uint64(d)
+			h.next = h.pending[0].seq
+		}
+		a.drain(s, dir, h)
+	}
+}
+
+// drain delivers held segments that became in order
+func (a *StreamAssembler) drain(s *Stream, dir StreamDirection, h *halfStream) {
+	for len(h.pending) > 0 {
+		p := h.pending[0]
+		if seqDiff(p.seq, h.next) > 0 {
+			return
+		}
+		h.pending = h.pending[1:]
+		h.buffered -= len(p.data)
+		a.deliver(s, dir, h, p.seq, p.data)
+	}
+}
+
+// close removes s and notifies the handler
+func (a *StreamAssembler) close(s *Stream, reason StreamCloseReason) {
+	delete(a.streams, s.Tuple)
+	s.half[0].pending, s.half[1].pending = nil, nil
+	a.handler.StreamClose(s, reason)
+}
+
+// Expire closes the streams that saw no segment for longer than idle
+func (a *StreamAssembler) Expire(idle time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range a.streams {
+		if now.Sub(s.seen) > idle {
+			a.close(s, StreamTimeout)
+		}
+	}
+}
+
+// Flush closes all streams
+func (a *StreamAssembler) Flush() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, s := range a.streams {
+		a.close(s, StreamFlushed)
+	}
+}
@@ -0,0 +1,215 @@
+package windivert
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sbilly/go-windivert2/internal/iana"
+)
+
+type testStreamHandler struct {
+	opened int
+	data   [2]bytes.Buffer
+	closed []StreamCloseReason
+}
+
+func (h *testStreamHandler) StreamOpen(s *Stream) {
+	h.opened++
+}
+
+func (h *testStreamHandler) StreamData(s *Stream, dir StreamDirection, b []byte) {
+	h.data[dir].Write(b)
+}
+
+func (h *testStreamHandler) StreamClose(s *Stream, reason StreamCloseReason) {
+	h.closed = append(h.closed, reason)
+}
+
+// testSegment is a TCP segment of the test connection, from the client
+// when out is set
+type testSegment struct {
+	out     bool
+	flags   uint8
+	seq     uint32
+	payload string
+}
+
+func assembleSegments(t *testing.T, a *StreamAssembler, segs []testSegment) {
+	t.Helper()
+	for _, sg := range segs {
+		src, dst, addr := testSrc4, testDst4, NewOutboundAddress(1, 0)
+		if !sg.out {
+			src, dst, addr = testDst4, testSrc4, NewInboundAddress(1, 0)
+		}
+		b := testPacket(iana.ProtocolTCP, src, dst, sg.flags, sg.seq, []byte(sg.payload))
+		if err := a.Assemble(b, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestStreamAssembler(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		segs   []testSegment
+		client string
+		server string
+		closed []StreamCloseReason
+	}{
+		{
+			name: "in order",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{false, SYN | ACK, 500, ""},
+				{true, ACK, 101, "hello "},
+				{true, ACK, 107, "world"},
+				{false, ACK, 501, "hi"},
+			},
+			client: "hello world",
+			server: "hi",
+		},
+		{
+			name: "out of order and retransmitted",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{true, ACK, 107, "world"},
+				{true, ACK, 101, "hello "},
+				{true, ACK, 101, "hello "},
+				{true, ACK, 104, "lo wor"},
+			},
+			client: "hello world",
+		},
+		{
+			name: "fin on both sides",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{false, SYN | ACK, 500, ""},
+				{true, ACK | FIN, 101, "bye"},
+				{false, ACK | FIN, 501, "ok"},
+			},
+			client: "bye",
+			server: "ok",
+			closed: []StreamCloseReason{StreamFinished},
+		},
+		{
+			name: "reset",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{true, ACK, 101, "a"},
+				{false, RST, 0, ""},
+			},
+			client: "a",
+			closed: []StreamCloseReason{StreamReset},
+		},
+		{
+			name: "data after fin",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{false, SYN | ACK, 500, ""},
+				{true, ACK | FIN, 101, "bye"},
+				// seq equal to the next expected after the FIN
+				{true, ACK, 105, "more"},
+				{true, ACK, 104, "late"},
+			},
+			client: "bye",
+		},
+		{
+			name: "queued beyond fin",
+			segs: []testSegment{
+				{true, SYN, 100, ""},
+				{false, SYN | ACK, 500, ""},
+				{true, ACK, 110, "beyond"},
+				{true, ACK | FIN, 101, "bye"},
+				{true, ACK, 104, "fill"},
+			},
+			client: "bye",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testStreamHandler{}
+			a := NewStreamAssembler(h)
+			assembleSegments(t, a, tt.segs)
+
+			if h.opened != 1 {
+				t.Errorf("opened %d streams", h.opened)
+			}
+			if got := h.data[ClientToServer].String(); got != tt.client {
+				t.Errorf("client data = %q, want %q", got, tt.client)
+			}
+			if got := h.data[ServerToClient].String(); got != tt.server {
+				t.Errorf("server data = %q, want %q", got, tt.server)
+			}
+			if len(h.closed) != len(tt.closed) {
+				t.Fatalf("closed = %v, want %v", h.closed, tt.closed)
+			}
+			for i := range tt.closed {
+				if h.closed[i] != tt.closed[i] {
+					t.Errorf("closed = %v, want %v", h.closed, tt.closed)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamMaxBuffered(t *testing.T) {
+	h := &testStreamHandler{}
+	a := NewStreamAssembler(h)
+	a.MaxBuffered = 4
+	assembleSegments(t, a, []testSegment{
+		{true, SYN, 100, ""},
+		{true, ACK, 111, "abc"},
+		{true, ACK, 114, "def"},
+	})
+
+	if got := h.data[ClientToServer].String(); got != "abcdef" {
+		t.Errorf("data = %q", got)
+	}
+
+	a.Flush()
+	if len(h.closed) != 1 || h.closed[0] != StreamFlushed {
+		t.Errorf("closed = %v", h.closed)
+	}
+	if a.Len() != 0 {
+		t.Errorf("Len() = %d", a.Len())
+	}
+}
+
+func TestStreamMidstream(t *testing.T) {
+	segs := []testSegment{{true, ACK, 100, "abc"}}
+
+	h := &testStreamHandler{}
+	assembleSegments(t, NewStreamAssembler(h), segs)
+	if h.opened != 0 {
+		t.Error("stream opened without a handshake")
+	}
+
+	h = &testStreamHandler{}
+	a := NewStreamAssembler(h)
+	a.Midstream = true
+	assembleSegments(t, a, segs)
+	if got := h.data[ClientToServer].String(); got != "abc" {
+		t.Errorf("data = %q", got)
+	}
+}
+
+func TestStreamNilAddress(t *testing.T) {
+	h := &testStreamHandler{}
+	a := NewStreamAssembler(h)
+	for _, b := range [][]byte{
+		testPacket(iana.ProtocolTCP, testSrc4, testDst4, SYN, 100, nil),
+		testPacket(iana.ProtocolTCP, testSrc4, testDst4, ACK, 101, []byte("abc")),
+	} {
+		if err := a.Assemble(b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := h.data[ClientToServer].String(); h.opened != 1 || got != "abc" {
+		t.Errorf("opened %d streams, data = %q", h.opened, got)
+	}
+	for _, s := range a.streams {
+		if s.Start != 0 || s.Last != 0 || s.InterfaceIndex != 0 {
+			t.Errorf("stream = %+v", s)
+		}
+	}
+}
@@ -1,3 +1,6 @@
+//go:build windows
+// +build windows
+
 package windivert
 
 /*
@@ -158,7 +161,8 @@ func (h *Handle) RecvEx(packets [][]byte, addrs []Address, flags uint64) (uint,
 	defer h.mutex.Unlock()
 
 	var readLen C.UINT
-	var addrLen C.UINT
+	// the length of the addresses is in bytes both ways
+	addrLen := C.UINT(uintptr(len(addrs)) * unsafe.Sizeof(addrs[0]))
 
 	ret := C.WinDivertRecvEx(
 		h.handle,
@@ -175,7 +179,7 @@ func (h *Handle) RecvEx(packets [][]byte, addrs []Address, flags uint64) (uint,
 		return 0, 0, getLastError()
 	}
 
-	return uint(readLen), uint(addrLen), nil
+	return uint(readLen), uint(uintptr(addrLen) / unsafe.Sizeof(addrs[0])), nil
 }
 
 // SendEx sends multiple packets